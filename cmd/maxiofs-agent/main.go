@@ -4,10 +4,20 @@ import (
 	"context"
 	_ "embed"
 	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"maxiofs-agent/internal/audit"
+	"maxiofs-agent/internal/cache"
 	"maxiofs-agent/internal/cgofuse"
 	"maxiofs-agent/internal/config"
+	"maxiofs-agent/internal/logging"
+	"maxiofs-agent/internal/metrics"
 	"maxiofs-agent/internal/storage"
 	"maxiofs-agent/internal/vfs"
 
@@ -35,6 +45,15 @@ type App struct {
 	// Fyne app for windows
 	fyneApp fyne.App
 
+	// Local metrics endpoint (nil when disabled)
+	metricsServer *metrics.Server
+
+	// Audit log shared by every mount (nil when disabled)
+	auditLog *audit.Logger
+
+	// On-disk block cache shared by every mount (nil when disabled)
+	blockCache *cache.BlockCache
+
 	// Menu items
 	statusItem     *systray.MenuItem
 	connectItem    *systray.MenuItem
@@ -46,11 +65,14 @@ type App struct {
 type MountedBucket struct {
 	BucketName  string
 	DriveLetter string
+	FS          *vfs.S3FS
 	Host        *cgofuse.FileSystemHost
 }
 
 var app *App
 
+var logger = logging.For("agent")
+
 func main() {
 	// Create Fyne app first
 	fyneApp := fyneapp.NewWithID("com.maxiofs.agent")
@@ -70,6 +92,56 @@ func main() {
 	}
 	app.config = cfg
 
+	setupLogging(cfg)
+	defer logging.Close()
+	logger.Info("MaxIOFS Agent starting")
+	if err != nil {
+		logger.Warn("could not load configuration, using defaults", "error", err)
+	}
+
+	if cfg.MetricsEnabled {
+		addr := cfg.MetricsAddress
+		if addr == "" {
+			addr = "127.0.0.1:9464"
+		}
+		server, err := metrics.StartServer(addr)
+		if err != nil {
+			logger.Error("could not start metrics endpoint", "address", addr, "error", err)
+		} else {
+			app.metricsServer = server
+			logger.Info("metrics endpoint listening", "url", "http://"+server.Addr()+"/metrics")
+		}
+	}
+
+	if cfg.AuditEnabled {
+		if path, err := cfg.GetAuditPath(); err != nil {
+			logger.Error("could not resolve audit log path", "error", err)
+		} else if auditLog, err := audit.Open(path); err != nil {
+			logger.Error("could not open audit log", "path", path, "error", err)
+		} else {
+			app.auditLog = auditLog
+			logger.Info("audit log enabled", "path", path)
+		}
+	}
+
+	if cfg.CachePath != "" {
+		chunkSize := int64(cfg.BlockCacheChunkSizeKB) * 1024
+		if chunkSize <= 0 {
+			chunkSize = 4 * 1024 * 1024
+		}
+		maxSize := int64(cfg.BlockCacheMaxSizeMB) * 1024 * 1024
+		if maxSize <= 0 {
+			maxSize = 2048 * 1024 * 1024
+		}
+		dir := filepath.Join(cfg.CachePath, "blocks")
+		if blockCache, err := cache.Open(dir, chunkSize, maxSize); err != nil {
+			logger.Error("could not open block cache", "path", dir, "error", err)
+		} else {
+			app.blockCache = blockCache
+			logger.Info("block cache enabled", "path", dir, "chunk_size", chunkSize, "max_size", maxSize)
+		}
+	}
+
 	// Crear una ventana invisible para mantener la app viva
 	// Esto evita que Fyne cierre la app cuando todas las ventanas visibles se cierran
 	dummyWindow := fyneApp.NewWindow("")
@@ -83,6 +155,27 @@ func main() {
 	fyneApp.Run()
 }
 
+// setupLogging writes logs under ~/.maxiofs-agent/logs using the configured levels
+func setupLogging(cfg *config.Config) {
+	opts := logging.Options{
+		Level:     cfg.LogLevel,
+		Levels:    cfg.LogLevels,
+		MaxSizeMB: cfg.LogMaxSizeMB,
+		MaxFiles:  cfg.LogMaxFiles,
+		Secrets:   []string{cfg.AccessKeyID, cfg.SecretAccessKey},
+	}
+	if dir, err := config.GetLogDir(); err == nil {
+		opts.Dir = dir
+	}
+	if err := logging.Setup(opts); err != nil {
+		// Fall back to the defaults rather than running without logs
+		opts.Level = ""
+		opts.Levels = nil
+		logging.Setup(opts)
+		logger.Warn("invalid logging configuration, using defaults", "error", err)
+	}
+}
+
 func onReady() {
 	systray.SetIcon(iconData)
 	systray.SetTitle("MaxIOFS")
@@ -110,6 +203,12 @@ func onReady() {
 
 	systray.AddSeparator()
 
+	// Statistics
+	statsItem := systray.AddMenuItem("📊 Statistics", "Request and cache statistics")
+
+	// Uploads
+	uploadsItem := systray.AddMenuItem("📤 Uploads", "Pending and failed uploads")
+
 	// Help
 	helpItem := systray.AddMenuItem("❓ Help", "How to use")
 
@@ -134,6 +233,10 @@ func onReady() {
 				go showSettings()
 			case <-app.disconnectItem.ClickedCh:
 				go disconnect()
+			case <-statsItem.ClickedCh:
+				go showStatistics()
+			case <-uploadsItem.ClickedCh:
+				go showUploads()
 			case <-helpItem.ClickedCh:
 				go showHelp()
 			case <-aboutItem.ClickedCh:
@@ -147,6 +250,12 @@ func onReady() {
 
 func onExit() {
 	disconnect()
+	if app.metricsServer != nil {
+		app.metricsServer.Close()
+	}
+	if app.auditLog != nil {
+		app.auditLog.Close()
+	}
 }
 
 func showSettings() {
@@ -207,7 +316,11 @@ func showSettings() {
 			app.config.SecretAccessKey = secretKey
 			app.config.UseSSL = useSSL
 			app.config.InsecureSkipVerify = insecureSkipVerify
-			app.config.Save()
+			if err := app.config.Save(); err != nil {
+				logger.Error("could not save configuration", "error", err)
+			}
+			// New credentials must be redacted from now on
+			setupLogging(app.config)
 
 			window.Close()
 			go tryConnect()
@@ -246,6 +359,7 @@ func tryConnect() {
 			app.config.InsecureSkipVerify,
 		)
 		if err != nil {
+			logger.Error("could not create S3 client", "endpoint", app.config.Endpoint, "error", err)
 			app.statusItem.SetTitle("⚫ Connection error")
 			dlgs.Error("Error", "Could not connect: "+err.Error())
 			return
@@ -253,6 +367,7 @@ func tryConnect() {
 
 		ctx := context.Background()
 		if err := client.TestConnection(ctx); err != nil {
+			logger.Error("connection test failed", "endpoint", app.config.Endpoint, "error", err)
 			app.statusItem.SetTitle("⚫ Connection error")
 			dlgs.Error("Error", "Could not connect: "+err.Error())
 			return
@@ -262,6 +377,7 @@ func tryConnect() {
 		app.s3Client = client
 		app.mu.Unlock()
 
+		logger.Info("connected", "endpoint", app.config.Endpoint)
 		app.statusItem.SetTitle("🟢 Connected - " + app.config.Endpoint)
 		app.connectItem.Disable()
 		app.disconnectItem.Enable()
@@ -278,9 +394,7 @@ func disconnect() {
 
 	// Unmount all buckets
 	for _, mounted := range app.mountedBuckets {
-		if mounted.Host != nil {
-			mounted.Host.Unmount()
-		}
+		unmountBucket(mounted)
 	}
 	app.mountedBuckets = make(map[string]*MountedBucket)
 
@@ -312,6 +426,7 @@ func loadBuckets() {
 	ctx := context.Background()
 	buckets, err := app.s3Client.ListBuckets(ctx)
 	if err != nil {
+		logger.Error("error listing buckets", "error", err)
 		dlgs.Error("Error", "Error listing buckets: "+err.Error())
 		return
 	}
@@ -337,11 +452,20 @@ func toggleBucketMount(bucketName string, menuItem *systray.MenuItem) {
 
 	// If already mounted, unmount
 	if mounted, exists := app.mountedBuckets[bucketName]; exists {
-		if mounted.Host != nil {
-			mounted.Host.Unmount()
+		app.mu.Unlock()
+		if !confirmPendingUploads(mounted.FS) {
+			return
 		}
+		app.mu.Lock()
+		if app.mountedBuckets[bucketName] != mounted {
+			// Unmounted meanwhile (disconnect)
+			app.mu.Unlock()
+			return
+		}
+		unmountBucket(mounted)
 		delete(app.mountedBuckets, bucketName)
 		app.mu.Unlock()
+		logger.Info("unmounted bucket", "bucket", bucketName)
 
 		menuItem.SetTitle("📦 " + bucketName)
 		dlgs.Info("Unmounted", "Bucket unmounted successfully")
@@ -362,28 +486,64 @@ func toggleBucketMount(bucketName string, menuItem *systray.MenuItem) {
 	mountPoint := driveLetter + ":"
 
 	// Create filesystem
-	fs := vfs.NewS3FS(app.s3Client, bucketName)
+	fs, err := vfs.NewS3FS(app.s3Client, bucketName, vfs.Options{
+		MetadataTimeout: time.Duration(app.config.MetadataTimeoutSeconds) * time.Second,
+		DataTimeout:     time.Duration(app.config.DataTimeoutSeconds) * time.Second,
+		Audit:           app.auditLog,
+		BlockCache:      app.blockCache,
+		ReadAheadMax:    int64(app.config.ReadAheadMaxMB) * 1024 * 1024,
+		FileAttrTTL:     time.Duration(app.config.FileAttrTTLSeconds) * time.Second,
+		DirAttrTTL:      time.Duration(app.config.DirAttrTTLSeconds) * time.Second,
+		NegativeAttrTTL: time.Duration(app.config.NegativeAttrTTLSeconds) * time.Second,
+		ListingRefresh:  time.Duration(app.config.ListingRefreshSeconds) * time.Second,
+		DirMarkers:      vfs.DirMarkers(app.config.GetDirectoryMarkers(bucketName)),
+		NameEncoding:    app.config.GetFilenameEncoding(bucketName),
+		CaseInsensitive: app.config.CaseInsensitive,
+		StagingDir:      app.config.GetStagingDir(bucketName),
+
+		UploadConcurrency: app.config.UploadConcurrency,
+		UploadRetries:     app.config.UploadRetries,
+		OnUploadFailed: func(path string, err error) {
+			notifyUploadFailed(bucketName, path, err)
+		},
+
+		Leases:     app.config.LeaseLocksEnabled,
+		LeaseTTL:   time.Duration(app.config.LeaseTTLSeconds) * time.Second,
+		LeaseOwner: leaseOwner(),
+		OnLeaseConflict: func(path, holder string) {
+			notifyLeaseConflict(bucketName, path, holder)
+		},
+	})
+	if err != nil {
+		logger.Error("could not prepare filesystem", "bucket", bucketName, "error", err)
+		dlgs.Error("Error", fmt.Sprintf("Could not mount bucket '%s': %v", bucketName, err))
+		return
+	}
 	host := cgofuse.NewFileSystemHost(fs)
 
 	// Enable write capabilities
-	host.SetCapCaseInsensitive(false)
+	host.SetCapCaseInsensitive(app.config.CaseInsensitive)
 	host.SetCapReaddirPlus(false)
+	host.SetCapOpenTrunc(true)
+	host.SetUseIno(true) // Stable inode numbers (see vfs/inode.go)
 
 	// Simplified mount options
 	mountOpts := []string{
 		"-o", "volname=" + bucketName,
 		"-o", "umask=0",
+		"-o", "use_ino",
 	}
 
-	fmt.Printf("Mounting bucket '%s' on '%s' with write permissions...\n", bucketName, mountPoint)
+	logger.Info("mounting bucket", "bucket", bucketName, "mountpoint", mountPoint)
 
 	// Mount in goroutine
 	go func() {
 		if !host.Mount(mountPoint, mountOpts) {
+			logger.Error("could not mount bucket", "bucket", bucketName, "mountpoint", mountPoint)
 			dlgs.Error("Error", fmt.Sprintf("Could not mount bucket '%s' on '%s'", bucketName, mountPoint))
 			return
 		}
-		fmt.Printf("Mount completed for %s\n", bucketName)
+		logger.Info("mount completed", "bucket", bucketName)
 	}()
 
 	// Save reference
@@ -391,6 +551,7 @@ func toggleBucketMount(bucketName string, menuItem *systray.MenuItem) {
 	app.mountedBuckets[bucketName] = &MountedBucket{
 		BucketName:  bucketName,
 		DriveLetter: driveLetter,
+		FS:          fs,
 		Host:        host,
 	}
 	app.mu.Unlock()
@@ -399,6 +560,252 @@ func toggleBucketMount(bucketName string, menuItem *systray.MenuItem) {
 	dlgs.Info("Mounted", fmt.Sprintf("Bucket '%s' mounted on %s:\n\nAccess from Windows Explorer", bucketName, driveLetter+":"))
 }
 
+// notifyUploadFailed tells the user that a change could not be uploaded in the background
+func notifyUploadFailed(bucketName, path string, err error) {
+	fyne.Do(func() {
+		app.fyneApp.SendNotification(fyne.NewNotification("Upload failed",
+			fmt.Sprintf("%s/%s: %v\nThe change is kept under Uploads in the tray menu.", bucketName, path, err)))
+	})
+}
+
+// notifyLeaseConflict warns that a file opened for writing is being edited on another machine
+func notifyLeaseConflict(bucketName, path, holder string) {
+	fyne.Do(func() {
+		app.fyneApp.SendNotification(fyne.NewNotification("File in use",
+			fmt.Sprintf("%s/%s is being edited by %s.\nChanges saved here may overwrite theirs.", bucketName, path, holder)))
+	})
+}
+
+// leaseOwner names this user and workstation in the leases of files being edited
+func leaseOwner() string {
+	owner, _ := os.Hostname()
+	if u, err := user.Current(); err == nil {
+		owner = u.Username + "@" + owner
+	}
+	return owner
+}
+
+// confirmPendingUploads asks before detaching mounts whose changes are still being uploaded
+func confirmPendingUploads(filesystems ...*vfs.S3FS) bool {
+	count := 0
+	for _, fs := range filesystems {
+		if fs == nil {
+			continue
+		}
+		for _, upload := range fs.PendingUploads() {
+			if upload.State != vfs.UploadFailed {
+				count++
+			}
+		}
+	}
+	if count == 0 {
+		return true
+	}
+	ok, _ := dlgs.Question("Uploads in progress",
+		fmt.Sprintf("%d changed file(s) have not been uploaded yet. They will be uploaded the next time the bucket is mounted.\n\nContinue anyway?", count), false)
+	return ok
+}
+
+// unmountBucket aborts the in-flight S3 requests of a mount and detaches its drive
+func unmountBucket(mounted *MountedBucket) {
+	if mounted.FS != nil {
+		mounted.FS.Shutdown()
+	}
+	if mounted.Host != nil {
+		mounted.Host.Unmount()
+	}
+}
+
+func showStatistics() {
+	fyne.Do(func() {
+		window := app.fyneApp.NewWindow("MaxIOFS - Statistics")
+		window.SetIcon(fyne.NewStaticResource("icon.png", iconPNG))
+
+		statsLabel := widget.NewLabelWithStyle(formatStatistics(), fyne.TextAlignLeading, fyne.TextStyle{Monospace: true})
+
+		refreshBtn := widget.NewButton("Refresh", func() {
+			statsLabel.SetText(formatStatistics())
+		})
+		closeBtn := widget.NewButton("Close", func() {
+			window.Close()
+		})
+
+		content := container.NewBorder(
+			widget.NewLabelWithStyle("Statistics", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+			container.NewGridWithColumns(2, closeBtn, refreshBtn),
+			nil, nil,
+			container.NewVScroll(statsLabel),
+		)
+
+		window.SetContent(container.NewPadded(content))
+		window.Resize(fyne.NewSize(520, 480))
+		window.CenterOnScreen()
+		window.Show()
+	})
+}
+
+func showUploads() {
+	fyne.Do(func() {
+		window := app.fyneApp.NewWindow("MaxIOFS - Uploads")
+		window.SetIcon(fyne.NewStaticResource("icon.png", iconPNG))
+
+		uploadsLabel := widget.NewLabelWithStyle(formatUploads(), fyne.TextAlignLeading, fyne.TextStyle{Monospace: true})
+
+		refreshBtn := widget.NewButton("Refresh", func() {
+			uploadsLabel.SetText(formatUploads())
+		})
+		retryBtn := widget.NewButton("Retry failed", func() {
+			for _, fs := range mountedFilesystems() {
+				fs.RetryFailedUploads()
+			}
+			uploadsLabel.SetText(formatUploads())
+		})
+		discardBtn := widget.NewButton("Discard failed", func() {
+			dialog.ShowConfirm("Discard failed uploads",
+				"The local changes of every failed upload will be deleted. Continue?",
+				func(ok bool) {
+					if !ok {
+						return
+					}
+					for _, fs := range mountedFilesystems() {
+						fs.DiscardFailedUploads()
+					}
+					uploadsLabel.SetText(formatUploads())
+				}, window)
+		})
+		closeBtn := widget.NewButton("Close", func() {
+			window.Close()
+		})
+
+		content := container.NewBorder(
+			widget.NewLabelWithStyle("Uploads", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+			container.NewGridWithColumns(4, closeBtn, discardBtn, retryBtn, refreshBtn),
+			nil, nil,
+			container.NewVScroll(uploadsLabel),
+		)
+
+		window.SetContent(container.NewPadded(content))
+		window.Resize(fyne.NewSize(640, 420))
+		window.CenterOnScreen()
+		window.Show()
+	})
+}
+
+// mountedFilesystems returns the filesystems of the mounted buckets
+func mountedFilesystems() []*vfs.S3FS {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	filesystems := make([]*vfs.S3FS, 0, len(app.mountedBuckets))
+	for _, name := range sortedNames(app.mountedBuckets) {
+		filesystems = append(filesystems, app.mountedBuckets[name].FS)
+	}
+	return filesystems
+}
+
+// formatUploads renders the changes that have not reached the bucket yet
+func formatUploads() string {
+	var b strings.Builder
+	count := 0
+	for _, fs := range mountedFilesystems() {
+		for _, upload := range fs.PendingUploads() {
+			count++
+			fmt.Fprintf(&b, "%-9s %s/%s (%s)\n", upload.State, upload.Bucket, upload.Path, formatBytes(float64(upload.Size)))
+			if upload.Error != "" {
+				fmt.Fprintf(&b, "          %s\n", upload.Error)
+			}
+		}
+	}
+	if count == 0 {
+		return "No pending uploads.\n\nChanges left by a previous run are uploaded when their bucket is mounted again."
+	}
+	return b.String()
+}
+
+// formatStatistics renders the agent metrics as a plain text report
+func formatStatistics() string {
+	var b strings.Builder
+
+	requests := storage.RequestsTotal.Values()
+	requestErrors := storage.RequestErrorsTotal.Values()
+	latency := storage.RequestDuration.Stats()
+	b.WriteString("S3 requests\n")
+	if len(requests) == 0 {
+		b.WriteString("  (none yet)\n")
+	}
+	for _, op := range sortedNames(requests) {
+		fmt.Fprintf(&b, "  %-14s %8.0f  avg %7.1f ms  errors %.0f\n",
+			op, requests[op], latency[op].Mean()*1000, requestErrors[op])
+	}
+
+	transferred := storage.BytesTotal.Values()
+	fmt.Fprintf(&b, "\nTransferred\n  downloaded %s, uploaded %s\n",
+		formatBytes(transferred["download"]), formatBytes(transferred["upload"]))
+
+	ops := vfs.OpsTotal.Values()
+	opLatency := vfs.OpDuration.Stats()
+	b.WriteString("\nFilesystem operations\n")
+	if len(ops) == 0 {
+		b.WriteString("  (none yet)\n")
+	}
+	for _, op := range sortedNames(ops) {
+		fmt.Fprintf(&b, "  %-14s %8.0f  avg %7.1f ms\n", op, ops[op], opLatency[op].Mean()*1000)
+	}
+
+	lookups := vfs.CacheLookupsTotal.Values()
+	caches := map[string]bool{}
+	for key := range lookups {
+		caches[strings.Split(key, "/")[0]] = true
+	}
+	b.WriteString("\nCache hit ratio\n")
+	if len(caches) == 0 {
+		b.WriteString("  (none yet)\n")
+	}
+	for _, cache := range sortedNames(caches) {
+		hits, misses := lookups[cache+"/hit"], lookups[cache+"/miss"]
+		fmt.Fprintf(&b, "  %-14s %7.1f%%  (%.0f hits, %.0f misses)\n",
+			cache, 100*hits/(hits+misses), hits, misses)
+	}
+
+	opErrors := vfs.OpErrorsTotal.Values()
+	if len(opErrors) > 0 {
+		b.WriteString("\nErrors by errno\n")
+		for _, key := range sortedNames(opErrors) {
+			fmt.Fprintf(&b, "  %-24s %8.0f\n", key, opErrors[key])
+		}
+	}
+
+	if app.blockCache != nil {
+		fmt.Fprintf(&b, "\nBlock cache: %s used\n", formatBytes(float64(app.blockCache.Size())))
+	}
+
+	if app.metricsServer != nil {
+		fmt.Fprintf(&b, "\nPrometheus endpoint: http://%s/metrics\n", app.metricsServer.Addr())
+	}
+	return b.String()
+}
+
+func sortedNames[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	div, exp := float64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", n/div, "KMGTPE"[exp])
+}
+
 func showHelp() {
 	dlgs.Info("Help - MaxIOFS Agent",
 		"How to use:\n\n"+
@@ -421,7 +828,7 @@ func showAbout() {
 
 func confirmQuit() {
 	ok, _ := dlgs.Question("Quit", "Are you sure you want to quit MaxIOFS Agent?", false)
-	if ok {
+	if ok && confirmPendingUploads(mountedFilesystems()...) {
 		disconnect()
 		systray.Quit()
 		app.fyneApp.Quit()
@@ -0,0 +1,104 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Outcomes of an audited operation
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Record describes one mutation of a mounted bucket
+type Record struct {
+	Time        time.Time `json:"time"`
+	Workstation string    `json:"workstation"`
+	User        string    `json:"user"` // Account running the agent
+	UID         uint32    `json:"uid"`  // Caller as reported by the FUSE layer
+	GID         uint32    `json:"gid"`
+	PID         int       `json:"pid"`
+	Bucket      string    `json:"bucket"`
+	Op          string    `json:"op"`
+	Key         string    `json:"key"`
+	NewKey      string    `json:"new_key,omitempty"`
+	ETagBefore  string    `json:"etag_before,omitempty"`
+	ETagAfter   string    `json:"etag_after,omitempty"`
+	Outcome     string    `json:"outcome"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Logger appends records to a JSON-lines file. Every record is synced to
+// disk before Log returns, and the file is never rewritten or truncated.
+type Logger struct {
+	mu          sync.Mutex
+	file        *os.File
+	workstation string
+	user        string
+}
+
+// Open opens (or creates) the audit log at path for appending
+func Open(path string) (*Logger, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("error creating audit directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %w", err)
+	}
+
+	workstation, _ := os.Hostname()
+	account := ""
+	if u, err := user.Current(); err == nil {
+		account = u.Username
+	}
+
+	return &Logger{
+		file:        file,
+		workstation: workstation,
+		user:        account,
+	}, nil
+}
+
+// Log appends a record, filling in the time, workstation and user
+func (l *Logger) Log(r Record) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	r.Workstation = l.workstation
+	r.User = l.user
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("error encoding audit record: %w", err)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return os.ErrClosed
+	}
+	if _, err := l.file.Write(line); err != nil {
+		return fmt.Errorf("error writing audit record: %w", err)
+	}
+	return l.file.Sync()
+}
+
+// Close closes the audit log
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
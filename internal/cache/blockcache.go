@@ -0,0 +1,380 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metaFileName  = "meta.json"
+	blockExt      = ".blk"
+	tempExt       = ".tmp"
+	touchInterval = time.Minute
+)
+
+// BlockCache is a persistent content cache of fixed-size object chunks.
+//
+// Chunks are stored as <dir>/<object>/<version>/<index>.blk where object is a
+// hash of bucket and key and version a hash of the ETag. Every file is written
+// to a temporary name and renamed into place, and each version directory holds
+// a meta.json describing it, so a crash never leaves a partial chunk behind.
+// The least recently used chunks are evicted once the cache exceeds maxSize.
+type BlockCache struct {
+	dir       string
+	chunkSize int64
+	maxSize   int64
+
+	mu       sync.Mutex
+	lru      *list.List               // Front is the most recently used chunk
+	blocks   map[string]*list.Element // Chunk path -> LRU element
+	versions map[string]*version      // Object dir -> cached version
+	size     int64
+}
+
+// version is the cached ETag of one object
+type version struct {
+	dir    string
+	etag   string
+	blocks int
+}
+
+// block is one cached chunk
+type block struct {
+	path      string
+	objectDir string
+	size      int64
+	touched   time.Time
+}
+
+// meta is persisted in every version directory
+type meta struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	ETag      string `json:"etag"`
+	ChunkSize int64  `json:"chunk_size"`
+}
+
+// Open loads (or creates) a block cache in dir
+func Open(dir string, chunkSize, maxSize int64) (*BlockCache, error) {
+	if chunkSize <= 0 || maxSize <= 0 {
+		return nil, fmt.Errorf("invalid block cache sizes: chunk=%d max=%d", chunkSize, maxSize)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating cache directory: %w", err)
+	}
+
+	c := &BlockCache{
+		dir:       dir,
+		chunkSize: chunkSize,
+		maxSize:   maxSize,
+		lru:       list.New(),
+		blocks:    make(map[string]*list.Element),
+		versions:  make(map[string]*version),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// ChunkSize returns the size of every chunk except the last one of an object
+func (c *BlockCache) ChunkSize() int64 {
+	return c.chunkSize
+}
+
+// Size returns the bytes currently cached
+func (c *BlockCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Get returns chunk index of bucket/key if it is cached for etag.
+// A cached chunk of a different ETag is stale and is discarded.
+func (c *BlockCache) Get(bucket, key, etag string, index int64) ([]byte, bool) {
+	objectDir := c.objectDir(bucket, key)
+	path := filepath.Join(objectDir, versionName(etag), blockName(index))
+
+	c.mu.Lock()
+	v, ok := c.versions[objectDir]
+	if ok && v.etag != etag {
+		c.dropVersion(objectDir)
+		ok = false
+	}
+	elem, cached := c.blocks[path]
+	if !ok || !cached {
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	b := elem.Value.(*block)
+	touch := time.Since(b.touched) > touchInterval
+	if touch {
+		b.touched = time.Now()
+	}
+	c.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		c.mu.Lock()
+		c.removeBlock(path)
+		c.mu.Unlock()
+		return nil, false
+	}
+	if touch {
+		// Persist recency so LRU order survives restarts
+		os.Chtimes(path, b.touched, b.touched)
+	}
+	return data, true
+}
+
+// Contains reports whether chunk index of bucket/key is cached for etag
+func (c *BlockCache) Contains(bucket, key, etag string, index int64) bool {
+	objectDir := c.objectDir(bucket, key)
+	path := filepath.Join(objectDir, versionName(etag), blockName(index))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.versions[objectDir]
+	if !ok || v.etag != etag {
+		return false
+	}
+	_, cached := c.blocks[path]
+	return cached
+}
+
+// Put stores chunk index of bucket/key for etag, replacing any other cached version
+func (c *BlockCache) Put(bucket, key, etag string, index int64, data []byte) error {
+	if int64(len(data)) > c.chunkSize {
+		return fmt.Errorf("chunk of %d bytes exceeds chunk size %d", len(data), c.chunkSize)
+	}
+	objectDir := c.objectDir(bucket, key)
+	versionDir := filepath.Join(objectDir, versionName(etag))
+	path := filepath.Join(versionDir, blockName(index))
+
+	c.mu.Lock()
+	if v, ok := c.versions[objectDir]; ok && v.etag != etag {
+		c.dropVersion(objectDir)
+	}
+	_, exists := c.versions[objectDir]
+	c.mu.Unlock()
+
+	if !exists {
+		if err := os.MkdirAll(versionDir, 0700); err != nil {
+			return fmt.Errorf("error creating cache directory: %w", err)
+		}
+		metaData, err := json.Marshal(meta{Bucket: bucket, Key: key, ETag: etag, ChunkSize: c.chunkSize})
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(versionDir, metaFileName), metaData); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.versions[objectDir]
+	if !ok {
+		v = &version{dir: versionDir, etag: etag}
+		c.versions[objectDir] = v
+	} else if v.etag != etag {
+		// Another version won the race, ours is already stale
+		os.Remove(path)
+		return nil
+	}
+	if _, cached := c.blocks[path]; !cached {
+		c.addBlock(&block{path: path, objectDir: objectDir, size: int64(len(data)), touched: time.Now()})
+	}
+	c.evict()
+	return nil
+}
+
+// Invalidate discards every cached chunk of bucket/key
+func (c *BlockCache) Invalidate(bucket, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropVersion(c.objectDir(bucket, key))
+}
+
+// load rebuilds the index from disk, discarding anything that is not a complete,
+// described chunk of the current chunk size
+func (c *BlockCache) load() error {
+	objectDirs, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("error reading cache directory: %w", err)
+	}
+
+	var loaded []*block
+	for _, objectEntry := range objectDirs {
+		objectDir := filepath.Join(c.dir, objectEntry.Name())
+		if !objectEntry.IsDir() {
+			os.Remove(objectDir)
+			continue
+		}
+		versionDirs, _ := os.ReadDir(objectDir)
+		var current *version
+		for _, versionEntry := range versionDirs {
+			versionDir := filepath.Join(objectDir, versionEntry.Name())
+			m, ok := readMeta(versionDir)
+			if !ok || m.ChunkSize != c.chunkSize || current != nil {
+				os.RemoveAll(versionDir)
+				continue
+			}
+			current = &version{dir: versionDir, etag: m.ETag}
+		}
+		if current == nil {
+			os.RemoveAll(objectDir)
+			continue
+		}
+		c.versions[objectDir] = current
+
+		files, _ := os.ReadDir(current.dir)
+		for _, file := range files {
+			path := filepath.Join(current.dir, file.Name())
+			if file.Name() == metaFileName {
+				continue
+			}
+			info, err := file.Info()
+			if err != nil || !strings.HasSuffix(file.Name(), blockExt) || info.Size() > c.chunkSize {
+				os.Remove(path)
+				continue
+			}
+			loaded = append(loaded, &block{path: path, objectDir: objectDir, size: info.Size(), touched: info.ModTime()})
+		}
+	}
+
+	// Oldest first, so the most recently used end up at the front
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].touched.Before(loaded[j].touched) })
+	for _, b := range loaded {
+		c.addBlock(b)
+	}
+	return nil
+}
+
+// addBlock indexes a chunk as the most recently used. Must be called with mu held.
+func (c *BlockCache) addBlock(b *block) {
+	c.blocks[b.path] = c.lru.PushFront(b)
+	c.size += b.size
+	if v, ok := c.versions[b.objectDir]; ok {
+		v.blocks++
+	}
+}
+
+// removeBlock forgets and deletes one chunk. Must be called with mu held.
+func (c *BlockCache) removeBlock(path string) {
+	elem, ok := c.blocks[path]
+	if !ok {
+		return
+	}
+	b := elem.Value.(*block)
+	c.lru.Remove(elem)
+	delete(c.blocks, path)
+	c.size -= b.size
+	os.Remove(path)
+
+	if v, ok := c.versions[b.objectDir]; ok {
+		v.blocks--
+		if v.blocks <= 0 {
+			delete(c.versions, b.objectDir)
+			os.RemoveAll(b.objectDir)
+		}
+	}
+}
+
+// dropVersion removes every chunk of an object. Must be called with mu held.
+func (c *BlockCache) dropVersion(objectDir string) {
+	v, ok := c.versions[objectDir]
+	if !ok {
+		return
+	}
+	prefix := v.dir + string(filepath.Separator)
+	for path := range c.blocks {
+		if strings.HasPrefix(path, prefix) {
+			c.removeBlock(path)
+		}
+	}
+	delete(c.versions, objectDir)
+	os.RemoveAll(objectDir)
+}
+
+// evict removes least recently used chunks until the cache fits. Must be called with mu held.
+func (c *BlockCache) evict() {
+	for c.size > c.maxSize {
+		back := c.lru.Back()
+		if back == nil {
+			return
+		}
+		c.removeBlock(back.Value.(*block).path)
+	}
+}
+
+func (c *BlockCache) objectDir(bucket, key string) string {
+	return filepath.Join(c.dir, hashName(bucket+"\x00"+key, 32))
+}
+
+func versionName(etag string) string {
+	return hashName(etag, 16)
+}
+
+func blockName(index int64) string {
+	return strconv.FormatInt(index, 10) + blockExt
+}
+
+func hashName(s string, length int) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:length]
+}
+
+func readMeta(versionDir string) (meta, bool) {
+	var m meta
+	data, err := os.ReadFile(filepath.Join(versionDir, metaFileName))
+	if err != nil || json.Unmarshal(data, &m) != nil {
+		return m, false
+	}
+	return m, versionName(m.ETag) == filepath.Base(versionDir)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+"-*"+tempExt)
+	if err != nil {
+		return fmt.Errorf("error writing cache file: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing cache file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing cache file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing cache file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func chunk(index int64) []byte {
+	return bytes.Repeat([]byte{byte('a' + index)}, 4)
+}
+
+func TestBlockCacheEvict(t *testing.T) {
+	tests := []struct {
+		name string
+		get  []int64 // Chunks read after putting 0, 1 and 2
+		put  int64   // Chunk put last, over the limit
+		kept []int64
+		lost []int64
+	}{
+		{"least recently put", nil, 3, []int64{1, 2, 3}, []int64{0}},
+		{"read moves to the front", []int64{0}, 3, []int64{0, 2, 3}, []int64{1}},
+		{"reads in order", []int64{1, 0}, 3, []int64{0, 1, 3}, []int64{2}},
+		{"put again is not new", nil, 2, []int64{0, 1, 2}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Open(t.TempDir(), 4, 12)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range int64(3) {
+				if err := c.Put("b", "k", "e1", i, chunk(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, i := range tt.get {
+				if _, ok := c.Get("b", "k", "e1", i); !ok {
+					t.Fatalf("chunk %d missing before eviction", i)
+				}
+			}
+			if err := c.Put("b", "k", "e1", tt.put, chunk(tt.put)); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, i := range tt.kept {
+				if data, ok := c.Get("b", "k", "e1", i); !ok || !bytes.Equal(data, chunk(i)) {
+					t.Errorf("chunk %d = %q, %v, want it kept", i, data, ok)
+				}
+			}
+			for _, i := range tt.lost {
+				if c.Contains("b", "k", "e1", i) {
+					t.Errorf("chunk %d kept, want it evicted", i)
+				}
+			}
+			if size := c.Size(); size > 12 {
+				t.Errorf("size = %d, over the limit", size)
+			}
+		})
+	}
+}
+
+// fillCache leaves chunks 0 to 2 of b/k in a cache in dir, chunk 1 the least
+// recently used, along with the debris of a crash
+func fillCache(t *testing.T, dir string) {
+	c, err := Open(dir, 4, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range int64(3) {
+		if err := c.Put("b", "k", "e1", i, chunk(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Recency is kept in the modification times
+	versionDir := filepath.Join(c.objectDir("b", "k"), versionName("e1"))
+	now := time.Now()
+	for i, age := range []time.Duration{time.Hour, 3 * time.Hour, 2 * time.Hour} {
+		mtime := now.Add(-age)
+		os.Chtimes(filepath.Join(versionDir, blockName(int64(i))), mtime, mtime)
+	}
+	os.WriteFile(filepath.Join(versionDir, blockName(3)+"-1"+tempExt), []byte("partial"), 0600)
+	os.WriteFile(filepath.Join(dir, "stray"), nil, 0600)
+}
+
+func TestBlockCacheLoad(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunkSize int64
+		maxSize   int64
+		kept      []int64
+		lost      []int64
+	}{
+		{"everything fits", 4, 1024, []int64{0, 1, 2}, nil},
+		{"least recently used evicted", 4, 8, []int64{0, 2}, []int64{1}},
+		{"chunk size changed", 8, 1024, nil, []int64{0, 1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fillCache(t, dir)
+			c, err := Open(dir, tt.chunkSize, tt.maxSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, i := range tt.lost {
+				if c.Contains("b", "k", "e1", i) {
+					t.Errorf("chunk %d loaded, want it discarded", i)
+				}
+			}
+			for _, i := range tt.kept {
+				if data, ok := c.Get("b", "k", "e1", i); !ok || !bytes.Equal(data, chunk(i)) {
+					t.Errorf("chunk %d = %q, %v, want it loaded", i, data, ok)
+				}
+			}
+			if size, want := c.Size(), int64(4*len(tt.kept)); size != want {
+				t.Errorf("size = %d, want %d", size, want)
+			}
+
+			if _, err := os.Stat(filepath.Join(dir, "stray")); !os.IsNotExist(err) {
+				t.Error("stray file kept")
+			}
+			temps, _ := filepath.Glob(filepath.Join(dir, "*", "*", "*"+tempExt))
+			if len(temps) != 0 {
+				t.Errorf("partial chunks kept: %v", temps)
+			}
+		})
+	}
+}
+
+func TestBlockCacheVersions(t *testing.T) {
+	c, err := Open(t.TempDir(), 4, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Put("b", "k", "e1", 0, chunk(0))
+	c.Put("b", "k", "e1", 1, chunk(1))
+
+	// A new version replaces every chunk of the old one
+	if err := c.Put("b", "k", "e2", 0, chunk(2)); err != nil {
+		t.Fatal(err)
+	}
+	if c.Contains("b", "k", "e1", 1) {
+		t.Error("chunk of the old version kept")
+	}
+	if data, ok := c.Get("b", "k", "e2", 0); !ok || !bytes.Equal(data, chunk(2)) {
+		t.Errorf("new version = %q, %v", data, ok)
+	}
+	if size := c.Size(); size != 4 {
+		t.Errorf("size = %d, want 4", size)
+	}
+	if _, err := os.Stat(filepath.Join(c.objectDir("b", "k"), versionName("e1"))); !os.IsNotExist(err) {
+		t.Error("old version directory kept")
+	}
+
+	// Reading another version discards the cached one as stale
+	if _, ok := c.Get("b", "k", "e3", 0); ok {
+		t.Error("chunk returned for another version")
+	}
+	if c.Contains("b", "k", "e2", 0) {
+		t.Error("stale version kept after reading another one")
+	}
+
+	c.Put("b", "k", "e3", 0, chunk(0))
+	c.Invalidate("b", "k")
+	if c.Contains("b", "k", "e3", 0) || c.Size() != 0 {
+		t.Error("chunks kept after Invalidate")
+	}
+	if err := c.Put("b", "k", "e3", 0, make([]byte, 5)); err == nil {
+		t.Error("chunk larger than the chunk size accepted")
+	}
+}
@@ -169,7 +169,6 @@ type FileInfo_t struct {
 	Fh uint64
 }
 
-/*
 // Lock_t contains file locking information.
 // This structure is analogous to the POSIX struct flock.
 type Lock_t struct {
@@ -188,7 +187,6 @@ type Lock_t struct {
 	// Process ID of the process holding the lock
 	Pid int
 }
-*/
 
 // FileSystemInterface is the interface that a user mode file system must implement.
 //
@@ -283,7 +281,7 @@ type FileSystemInterface interface {
 	Fsync(path string, datasync bool, fh uint64) int
 
 	// Lock performs a file locking operation.
-	//Lock(path string, cmd int, lock *Lock_t, fh uint64) int
+	Lock(path string, cmd int, lock *Lock_t, fh uint64) int
 
 	// Opendir opens a directory.
 	Opendir(path string) (int, uint64)
@@ -570,13 +568,11 @@ func (*FileSystemBase) Fsync(path string, datasync bool, fh uint64) int {
 	return -ENOSYS
 }
 
-/*
 // Lock performs a file locking operation.
 // The FileSystemBase implementation returns -ENOSYS.
 func (*FileSystemBase) Lock(path string, cmd int, lock *Lock_t, fh uint64) int {
 	return -ENOSYS
 }
-*/
 
 // Opendir opens a directory.
 // The FileSystemBase implementation returns -ENOSYS.
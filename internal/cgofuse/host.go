@@ -100,6 +100,23 @@ func copyCstatFromFusestat(dst *c_fuse_stat_t, src *Stat_t) {
 		c_uint32_t(src.Flags))
 }
 
+func copyFuselockFromCflock(dst *Lock_t, src *c_fuse_flock_t) {
+	dst.Type = int16(src.l_type)
+	dst.Whence = int16(src.l_whence)
+	dst.Start = int64(src.l_start)
+	dst.Len = int64(src.l_len)
+	dst.Pid = int(src.l_pid)
+}
+
+func copyCflockFromFuselock(dst *c_fuse_flock_t, src *Lock_t) {
+	c_hostCflockFromFuselock(dst,
+		c_int(src.Type),
+		c_int(src.Whence),
+		c_int64_t(src.Start),
+		c_int64_t(src.Len),
+		c_int64_t(src.Pid))
+}
+
 func copyFusetimespecFromCtimespec(dst *Timespec, src *c_fuse_timespec_t) {
 	dst.Sec = int64(src.tv_sec)
 	dst.Nsec = int64(src.tv_nsec)
@@ -340,6 +357,18 @@ func hostFsync(path0 *c_char, datasync c_int, fi0 *c_struct_fuse_file_info) (err
 	return c_int(errc)
 }
 
+func hostLock(path0 *c_char, fi0 *c_struct_fuse_file_info, cmd c_int,
+	lock0 *c_fuse_flock_t) (errc0 c_int) {
+	defer recoverAsErrno(&errc0)
+	fsop := hostHandleGet(c_fuse_get_context().private_data).fsop
+	path := c_GoString(path0)
+	lock := &Lock_t{}
+	copyFuselockFromCflock(lock, lock0)
+	errc := fsop.Lock(path, int(cmd), lock, uint64(fi0.fh))
+	copyCflockFromFuselock(lock0, lock)
+	return c_int(errc)
+}
+
 func hostSetxattr(path0 *c_char, name0 *c_char, buff0 *c_char, size0 c_size_t,
 	flags c_int) (errc0 c_int) {
 	defer recoverAsErrno(&errc0)
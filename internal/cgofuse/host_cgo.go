@@ -326,12 +326,14 @@ typedef dev_t fuse_dev_t;
 typedef uid_t fuse_uid_t;
 typedef gid_t fuse_gid_t;
 typedef off_t fuse_off_t;
+typedef struct flock fuse_flock_t;
 typedef unsigned long fuse_opt_offset_t;
 #elif defined(_WIN32)
 typedef struct fuse_stat fuse_stat_t;
 typedef struct fuse_stat_ex fuse_stat_ex_t;
 typedef struct fuse_statvfs fuse_statvfs_t;
 typedef struct fuse_timespec fuse_timespec_t;
+typedef struct fuse_flock fuse_flock_t;
 typedef unsigned int fuse_opt_offset_t;
 #endif
 
@@ -404,7 +406,7 @@ extern int go_hostCreate(char *path, fuse_mode_t mode, struct fuse_file_info *fi
 extern int go_hostFtruncate(char *path, fuse_off_t off, struct fuse_file_info *fi);
 extern int go_hostFgetattr(char *path, fuse_stat_t *stbuf, struct fuse_file_info *fi);
 #endif
-//extern int go_hostLock(char *path, struct fuse_file_info *fi, int cmd, struct fuse_flock *lock);
+extern int go_hostLock(char *path, struct fuse_file_info *fi, int cmd, fuse_flock_t *lock);
 #if FUSE_USE_VERSION < 30
 extern int go_hostUtimens(char *path, fuse_timespec_t tv[2]);
 #else
@@ -579,6 +581,20 @@ static inline void hostAsgnCfileinfo(struct fuse_file_info *fi,
 	fi->fh = fh;
 }
 
+static inline void hostCflockFromFuselock(fuse_flock_t *lock,
+	int type,
+	int whence,
+	int64_t start,
+	int64_t len,
+	int64_t pid)
+{
+	lock->l_type = type;
+	lock->l_whence = whence;
+	lock->l_start = start;
+	lock->l_len = len;
+	lock->l_pid = pid;
+}
+
 static inline int hostFilldir(fuse_fill_dir_t filler, void *buf,
 	char *name, fuse_stat_t *stbuf, fuse_off_t off)
 {
@@ -696,8 +712,8 @@ static int hostMount(int argc, char *argv[], void *data)
 		.ftruncate = (int (*)(const char *, fuse_off_t, struct fuse_file_info *))go_hostFtruncate,
 		.fgetattr = (int (*)(const char *, fuse_stat_t *, struct fuse_file_info *))go_hostFgetattr,
 #endif
-		//.lock = (int (*)(const char *, struct fuse_file_info *, int, struct fuse_flock *))
-		//	go_hostFlock,
+		.lock = (int (*)(const char *, struct fuse_file_info *, int, fuse_flock_t *))
+			go_hostLock,
 #if FUSE_USE_VERSION < 30
 		.utimens = (int (*)(const char *, const fuse_timespec_t [2]))go_hostUtimens,
 #else
@@ -843,6 +859,7 @@ type (
 	c_fuse_stat_ex_t          = C.fuse_stat_ex_t
 	c_fuse_statvfs_t          = C.fuse_statvfs_t
 	c_fuse_timespec_t         = C.fuse_timespec_t
+	c_fuse_flock_t            = C.fuse_flock_t
 	c_fuse_uid_t              = C.fuse_uid_t
 	c_int                     = C.int
 	c_int16_t                 = C.int16_t
@@ -974,6 +991,14 @@ func c_hostAsgnCfileinfo(fi *c_struct_fuse_file_info,
 		nonseekable,
 		fh)
 }
+func c_hostCflockFromFuselock(lock *c_fuse_flock_t,
+	typ c_int,
+	whence c_int,
+	start c_int64_t,
+	len c_int64_t,
+	pid c_int64_t) {
+	C.hostCflockFromFuselock(lock, typ, whence, start, len, pid)
+}
 func c_hostFilldir(filler c_fuse_fill_dir_t,
 	buf unsafe.Pointer, name *c_char, stbuf *c_fuse_stat_t, off c_fuse_off_t) c_int {
 	return C.hostFilldir(filler, buf, name, stbuf, off)
@@ -1213,6 +1238,11 @@ func go_hostFgetattr(path0 *c_char, stat0 *c_fuse_stat_t,
 	return hostFgetattr(path0, stat0, fi0)
 }
 
+//export go_hostLock
+func go_hostLock(path0 *c_char, fi0 *c_struct_fuse_file_info, cmd c_int, lock0 *c_fuse_flock_t) (errc0 c_int) {
+	return hostLock(path0, fi0, cmd, lock0)
+}
+
 //export go_hostUtimens
 func go_hostUtimens(path0 *c_char, tmsp0 *c_fuse_timespec_t) (errc0 c_int) {
 	return hostUtimens(path0, tmsp0, nil)
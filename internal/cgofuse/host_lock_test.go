@@ -0,0 +1,120 @@
+//go:build linux
+
+package cgofuse
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type lockfs struct {
+	FileSystemBase
+	mu    sync.Mutex
+	calls []int
+	held  *Lock_t
+}
+
+func (self *lockfs) Getattr(path string, stat *Stat_t, fh uint64) (errc int) {
+	switch path {
+	case "/":
+		stat.Mode = S_IFDIR | 0555
+	case "/f":
+		stat.Mode = S_IFREG | 0666
+	default:
+		return -ENOENT
+	}
+	return 0
+}
+
+func (self *lockfs) Open(path string, flags int) (int, uint64) {
+	return 0, 1
+}
+
+func (self *lockfs) Release(path string, fh uint64) int {
+	return 0
+}
+
+func (self *lockfs) Lock(path string, cmd int, lock *Lock_t, fh uint64) int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.calls = append(self.calls, cmd)
+	switch cmd {
+	case syscall.F_GETLK:
+		if nil != self.held {
+			*lock = *self.held
+		} else {
+			lock.Type = syscall.F_UNLCK
+		}
+	case syscall.F_SETLK, syscall.F_SETLKW:
+		if syscall.F_UNLCK == lock.Type {
+			self.held = nil
+		} else {
+			held := *lock
+			held.Pid = 4242
+			self.held = &held
+		}
+	}
+	return 0
+}
+
+func TestLock(t *testing.T) {
+	path, err := os.MkdirTemp("", "test")
+	if nil != err {
+		panic(err)
+	}
+	defer os.Remove(path)
+	mntp := filepath.Join(path, "m")
+	if err = os.Mkdir(mntp, os.FileMode(0755)); nil != err {
+		panic(err)
+	}
+	defer os.Remove(mntp)
+
+	tstf := &lockfs{}
+	host := NewFileSystemHost(tstf)
+	done := make(chan bool)
+	go func() {
+		host.Mount(mntp, nil)
+		done <- true
+	}()
+	defer func() {
+		host.Unmount()
+		<-done
+	}()
+	for i := 0; ; i++ {
+		if _, err = os.Stat(filepath.Join(mntp, "f")); nil == err {
+			break
+		}
+		if 30 == i {
+			t.Fatal("mount did not come up:", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	file, err := os.OpenFile(filepath.Join(mntp, "f"), os.O_RDWR, 0)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 10, Len: 20}
+	if err = syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &lock); nil != err {
+		t.Fatal("F_SETLK:", err)
+	}
+	probe := syscall.Flock_t{Type: syscall.F_RDLCK, Whence: 0, Start: 0, Len: 0}
+	if err = syscall.FcntlFlock(file.Fd(), syscall.F_GETLK, &probe); nil != err {
+		t.Fatal("F_GETLK:", err)
+	}
+	if syscall.F_WRLCK != probe.Type || 10 != probe.Start || 20 != probe.Len {
+		t.Errorf("F_GETLK returned %+v; expected the write lock on [10, 30)", probe)
+	}
+
+	tstf.mu.Lock()
+	defer tstf.mu.Unlock()
+	if 2 > len(tstf.calls) || syscall.F_SETLK != tstf.calls[0] || syscall.F_GETLK != tstf.calls[1] {
+		t.Errorf("Lock() called with %v; expected F_SETLK then F_GETLK", tstf.calls)
+	}
+}
@@ -132,6 +132,15 @@ type fuse_timespec_t struct {
 	tv_nsec uintptr
 }
 
+type fuse_flock_t struct {
+	l_type   int16
+	l_whence int16
+	_        align64
+	l_start  c_fuse_off_t
+	l_len    c_fuse_off_t
+	l_pid    c_fuse_pid_t
+}
+
 type struct_fuse struct {
 	_ struct{}
 }
@@ -200,6 +209,7 @@ type (
 	c_fuse_stat_ex_t        = fuse_stat_ex_t
 	c_fuse_statvfs_t        = fuse_statvfs_t
 	c_fuse_timespec_t       = fuse_timespec_t
+	c_fuse_flock_t          = fuse_flock_t
 	c_fuse_uid_t            = uint32
 	c_int                   = int32
 	c_int16_t               = int16
@@ -353,6 +363,20 @@ func c_hostCstatvfsFromFusestatfs(stbuf *c_fuse_statvfs_t,
 		f_namemax: uintptr(namemax),
 	}
 }
+func c_hostCflockFromFuselock(lock *c_fuse_flock_t,
+	typ c_int,
+	whence c_int,
+	start c_int64_t,
+	len c_int64_t,
+	pid c_int64_t) {
+	*lock = c_fuse_flock_t{
+		l_type:   int16(typ),
+		l_whence: int16(whence),
+		l_start:  c_fuse_off_t(start),
+		l_len:    c_fuse_off_t(len),
+		l_pid:    c_fuse_pid_t(pid),
+	}
+}
 func c_hostCstatFromFusestat(stbuf *c_fuse_stat_t,
 	dev c_uint64_t,
 	ino c_uint64_t,
@@ -639,6 +663,7 @@ func init() {
 			create:      syscall.NewCallbackCDecl(go_hostCreate64),
 			ftruncate:   syscall.NewCallbackCDecl(go_hostFtruncate64),
 			fgetattr:    syscall.NewCallbackCDecl(go_hostFgetattr64),
+			lock:        syscall.NewCallbackCDecl(go_hostLock64),
 			utimens:     syscall.NewCallbackCDecl(go_hostUtimens64),
 			getpath:     syscall.NewCallbackCDecl(go_hostGetpath64),
 			setchgtime:  syscall.NewCallbackCDecl(go_hostSetchgtime64),
@@ -680,6 +705,7 @@ func init() {
 			create:      syscall.NewCallbackCDecl(go_hostCreate32),
 			ftruncate:   syscall.NewCallbackCDecl(go_hostFtruncate32),
 			fgetattr:    syscall.NewCallbackCDecl(go_hostFgetattr32),
+			lock:        syscall.NewCallbackCDecl(go_hostLock32),
 			utimens:     syscall.NewCallbackCDecl(go_hostUtimens32),
 			getpath:     syscall.NewCallbackCDecl(go_hostGetpath32),
 			setchgtime:  syscall.NewCallbackCDecl(go_hostSetchgtime32),
@@ -832,6 +858,11 @@ func go_hostFgetattr64(path0 *c_char, stat0 *c_fuse_stat_t,
 	return uintptr(int(hostFgetattr(path0, stat0, fi0)))
 }
 
+func go_hostLock64(path0 *c_char, fi0 *c_struct_fuse_file_info, cmd uintptr,
+	lock0 *c_fuse_flock_t) (errc0 uintptr) {
+	return uintptr(int(hostLock(path0, fi0, c_int(cmd), lock0)))
+}
+
 func go_hostUtimens64(path0 *c_char, tmsp0 *c_fuse_timespec_t) (errc0 uintptr) {
 	return uintptr(int(hostUtimens(path0, tmsp0, nil)))
 }
@@ -999,6 +1030,11 @@ func go_hostFgetattr32(path0 *c_char, stat0 *c_fuse_stat_t,
 	return uintptr(int(hostFgetattr(path0, stat0, fi0)))
 }
 
+func go_hostLock32(path0 *c_char, fi0 *c_struct_fuse_file_info, cmd uintptr,
+	lock0 *c_fuse_flock_t) (errc0 uintptr) {
+	return uintptr(int(hostLock(path0, fi0, c_int(cmd), lock0)))
+}
+
 func go_hostUtimens32(path0 *c_char, tmsp0 *c_fuse_timespec_t) (errc0 uintptr) {
 	return uintptr(int(hostUtimens(path0, tmsp0, nil)))
 }
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"os"
 	"path/filepath"
@@ -15,6 +17,62 @@ type Config struct {
 	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
 	CachePath          string `json:"cache_path"`
 	MountPath          string `json:"mount_path"`
+
+	// Per-operation timeouts in seconds (0 uses the built-in default)
+	MetadataTimeoutSeconds int `json:"metadata_timeout_seconds"`
+	DataTimeoutSeconds     int `json:"data_timeout_seconds"`
+
+	// Logging: default level, per-subsystem overrides (storage, vfs, agent) and rotation
+	LogLevel     string            `json:"log_level"`
+	LogLevels    map[string]string `json:"log_levels"`
+	LogMaxSizeMB int               `json:"log_max_size_mb"`
+	LogMaxFiles  int               `json:"log_max_files"`
+
+	// Opt-in Prometheus-compatible endpoint, restricted to loopback addresses
+	MetricsEnabled bool   `json:"metrics_enabled"`
+	MetricsAddress string `json:"metrics_address"`
+
+	// Append-only JSON-lines record of every mutation (empty path uses the default)
+	AuditEnabled bool   `json:"audit_enabled"`
+	AuditPath    string `json:"audit_path"`
+
+	// Persistent block cache under CachePath (0 uses the built-in default, empty CachePath disables it)
+	BlockCacheChunkSizeKB int `json:"block_cache_chunk_size_kb"`
+	BlockCacheMaxSizeMB   int `json:"block_cache_max_size_mb"`
+
+	// Largest prefetch window for sequential reads (0 uses the built-in default, negative disables it)
+	ReadAheadMaxMB int `json:"read_ahead_max_mb"`
+
+	// Attribute cache lifetimes in seconds (0 uses the built-in default, negative disables it)
+	FileAttrTTLSeconds     int `json:"file_attr_ttl_seconds"`
+	DirAttrTTLSeconds      int `json:"dir_attr_ttl_seconds"`
+	NegativeAttrTTLSeconds int `json:"negative_attr_ttl_seconds"`
+
+	// How often the folder index is rebuilt from a full listing, in seconds (0 uses the built-in default)
+	ListingRefreshSeconds int `json:"listing_refresh_seconds"`
+
+	// Background uploads of closed files: parallel uploads and retries of a
+	// failed upload (0 uses the built-in default, negative retries disables them)
+	UploadConcurrency int `json:"upload_concurrency"`
+	UploadRetries     int `json:"upload_retries"`
+
+	// How empty folders are stored: "slash" ("dir/" objects), "folder" (Hadoop/s3fs
+	// "dir_$folder$" objects) or "none" (kept locally only), with per-bucket overrides
+	DirectoryMarkers       string            `json:"directory_markers"`
+	BucketDirectoryMarkers map[string]string `json:"bucket_directory_markers"`
+
+	// Substitutions that show object keys invalid on Windows as valid file names, as a
+	// comma-separated list ("windows" for all, "none"), with per-bucket overrides
+	FilenameEncoding       string            `json:"filename_encoding"`
+	BucketFilenameEncoding map[string]string `json:"bucket_filename_encoding"`
+
+	// Opt-in case-insensitive lookups, as Windows applications expect; names that
+	// differ only in case are shown with a " (2)" suffix
+	CaseInsensitive bool `json:"case_insensitive"`
+
+	// Opt-in leases under .maxiofs-locks/ that warn when another agent edits the same file
+	LeaseLocksEnabled bool `json:"lease_locks_enabled"`
+	LeaseTTLSeconds   int  `json:"lease_ttl_seconds"`
 }
 
 // GetConfigPath returns the configuration file path
@@ -30,6 +88,60 @@ func GetConfigPath() (string, error) {
 	return filepath.Join(configDir, "config.json"), nil
 }
 
+// GetLogDir returns the directory where log files are written
+func GetLogDir() (string, error) {
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(configPath), "logs"), nil
+}
+
+// GetAuditPath returns the audit log path, using the configured one if set
+func (c *Config) GetAuditPath() (string, error) {
+	if c.AuditPath != "" {
+		return c.AuditPath, nil
+	}
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(configPath), "audit", "audit.jsonl"), nil
+}
+
+// GetStagingDir returns the private directory for the staging files of a mounted bucket
+func (c *Config) GetStagingDir(bucketName string) string {
+	return StagingDir(c.CachePath, c.Endpoint, bucketName)
+}
+
+// StagingDir returns the private directory for the staging files of a bucket
+// of endpoint, below cachePath or, if it is empty, the system temp dir
+func StagingDir(cachePath, endpoint, bucketName string) string {
+	base := cachePath
+	if base == "" {
+		base = filepath.Join(os.TempDir(), "maxiofs-agent")
+	}
+	// The same bucket name may exist on several endpoints
+	sum := sha256.Sum256([]byte(endpoint))
+	return filepath.Join(base, "staging", bucketName+"-"+hex.EncodeToString(sum[:4]))
+}
+
+// GetDirectoryMarkers returns the folder marker convention of a bucket
+func (c *Config) GetDirectoryMarkers(bucketName string) string {
+	if markers, ok := c.BucketDirectoryMarkers[bucketName]; ok {
+		return markers
+	}
+	return c.DirectoryMarkers
+}
+
+// GetFilenameEncoding returns the filename encoding of a bucket
+func (c *Config) GetFilenameEncoding(bucketName string) string {
+	if encoding, ok := c.BucketFilenameEncoding[bucketName]; ok {
+		return encoding
+	}
+	return c.FilenameEncoding
+}
+
 // Load loads configuration from disk
 func Load() (*Config, error) {
 	configPath, err := GetConfigPath()
@@ -42,9 +154,27 @@ func Load() (*Config, error) {
 		if os.IsNotExist(err) {
 			// Retornar config por defecto si no existe
 			return &Config{
-				UseSSL:    true,
-				CachePath: filepath.Join(filepath.Dir(configPath), "cache"),
-				MountPath: "",
+				UseSSL:                 true,
+				CachePath:              filepath.Join(filepath.Dir(configPath), "cache"),
+				MountPath:              "",
+				MetadataTimeoutSeconds: 30,
+				DataTimeoutSeconds:     600,
+				LogLevel:               "info",
+				LogMaxSizeMB:           10,
+				LogMaxFiles:            5,
+				MetricsAddress:         "127.0.0.1:9464",
+				BlockCacheChunkSizeKB:  4096,
+				BlockCacheMaxSizeMB:    2048,
+				ReadAheadMaxMB:         64,
+				FileAttrTTLSeconds:     10,
+				DirAttrTTLSeconds:      30,
+				NegativeAttrTTLSeconds: 5,
+				ListingRefreshSeconds:  30,
+				UploadConcurrency:      4,
+				UploadRetries:          5,
+				DirectoryMarkers:       "slash",
+				FilenameEncoding:       "windows",
+				LeaseTTLSeconds:        120,
 			}, nil
 		}
 		return nil, err
@@ -0,0 +1,178 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Options configures the agent logger
+type Options struct {
+	Dir       string            // Directory for log files (empty logs to stderr)
+	Level     string            // Default level: debug, info, warn or error
+	Levels    map[string]string // Per-subsystem level overrides
+	MaxSizeMB int               // Size at which the active log file is rotated
+	MaxFiles  int               // Number of rotated files to keep
+	Secrets   []string          // Literal values to redact (access keys, secrets)
+}
+
+const (
+	defaultMaxSizeMB = 10
+	defaultMaxFiles  = 5
+	logFileName      = "agent.log"
+)
+
+// state is the active logging configuration shared by every subsystem logger
+type state struct {
+	handler      slog.Handler
+	defaultLevel slog.Level
+	levels       map[string]slog.Level
+}
+
+var (
+	current atomic.Pointer[state]
+	closer  io.Closer
+	setupMu sync.Mutex
+)
+
+func init() {
+	current.Store(&state{
+		handler:      slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: newRedactor(nil).replaceAttr}),
+		defaultLevel: slog.LevelInfo,
+		levels:       map[string]slog.Level{},
+	})
+}
+
+// Setup installs the logger described by opts. Loggers obtained from For
+// before Setup is called pick up the new configuration immediately.
+func Setup(opts Options) error {
+	setupMu.Lock()
+	defer setupMu.Unlock()
+
+	defaultLevel, err := ParseLevel(opts.Level)
+	if err != nil {
+		return err
+	}
+	levels := make(map[string]slog.Level, len(opts.Levels))
+	for name, value := range opts.Levels {
+		level, err := ParseLevel(value)
+		if err != nil {
+			return fmt.Errorf("invalid level for subsystem %s: %w", name, err)
+		}
+		levels[name] = level
+	}
+
+	var out io.Writer = os.Stderr
+	var newCloser io.Closer
+	if opts.Dir != "" {
+		if opts.MaxSizeMB <= 0 {
+			opts.MaxSizeMB = defaultMaxSizeMB
+		}
+		if opts.MaxFiles <= 0 {
+			opts.MaxFiles = defaultMaxFiles
+		}
+		w, err := newRotatingWriter(filepath.Join(opts.Dir, logFileName), int64(opts.MaxSizeMB)*1024*1024, opts.MaxFiles)
+		if err != nil {
+			return err
+		}
+		out = w
+		newCloser = w
+	}
+
+	handler := slog.NewTextHandler(out, &slog.HandlerOptions{
+		// Filtering happens per subsystem, the handler itself accepts everything
+		Level:       slog.LevelDebug,
+		ReplaceAttr: newRedactor(opts.Secrets).replaceAttr,
+	})
+
+	current.Store(&state{
+		handler:      handler,
+		defaultLevel: defaultLevel,
+		levels:       levels,
+	})
+	slog.SetDefault(For("agent"))
+
+	if closer != nil {
+		closer.Close()
+	}
+	closer = newCloser
+	return nil
+}
+
+// Close flushes and closes the active log file
+func Close() error {
+	setupMu.Lock()
+	defer setupMu.Unlock()
+	if closer == nil {
+		return nil
+	}
+	err := closer.Close()
+	closer = nil
+	return err
+}
+
+// For returns the logger of a subsystem (storage, vfs, agent...)
+func For(subsystem string) *slog.Logger {
+	return slog.New(&subsystemHandler{subsystem: subsystem})
+}
+
+// ParseLevel converts a level name to a slog.Level (empty means info)
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// subsystemHandler filters records by the subsystem level and forwards them
+// to the active handler. Attributes and groups are replayed on the handler
+// that is current when the record is emitted, so reconfiguration is seamless.
+type subsystemHandler struct {
+	subsystem string
+	wrap      []func(slog.Handler) slog.Handler
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	s := current.Load()
+	min, ok := s.levels[h.subsystem]
+	if !ok {
+		min = s.defaultLevel
+	}
+	return level >= min
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	handler := current.Load().handler.WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	for _, wrap := range h.wrap {
+		handler = wrap(handler)
+	}
+	return handler.Handle(ctx, r)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *subsystemHandler) with(wrap func(slog.Handler) slog.Handler) *subsystemHandler {
+	wraps := make([]func(slog.Handler) slog.Handler, 0, len(h.wrap)+1)
+	wraps = append(wraps, h.wrap...)
+	wraps = append(wraps, wrap)
+	return &subsystemHandler{subsystem: h.subsystem, wrap: wraps}
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute keys whose value is never written to the log
+var sensitiveKeys = map[string]bool{
+	"access_key":        true,
+	"access_key_id":     true,
+	"secret":            true,
+	"secret_access_key": true,
+	"session_token":     true,
+	"password":          true,
+	"authorization":     true,
+}
+
+// presignedParam matches the credential-bearing query parameters of SigV2/SigV4 presigned URLs
+var presignedParam = regexp.MustCompile(`(?i)((?:X-Amz-Signature|X-Amz-Credential|X-Amz-Security-Token|AWSAccessKeyId|Signature)=)[^&\s"']+`)
+
+// redactor scrubs secrets from log attributes before they are formatted
+type redactor struct {
+	secrets []string
+}
+
+func newRedactor(secrets []string) *redactor {
+	r := &redactor{}
+	for _, secret := range secrets {
+		if secret != "" {
+			r.secrets = append(r.secrets, secret)
+		}
+	}
+	return r
+}
+
+func (r *redactor) replaceAttr(_ []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, r.redact(a.Value.String()))
+	case slog.KindAny:
+		// Errors from the SDK may embed request URLs
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, r.redact(err.Error()))
+		}
+	}
+	return a
+}
+
+// redact removes configured secrets and presigned URL credentials from s
+func (r *redactor) redact(s string) string {
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	if strings.Contains(s, "=") {
+		s = presignedParam.ReplaceAllString(s, "${1}"+redacted)
+	}
+	return s
+}
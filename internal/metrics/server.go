@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Server exposes the default registry on a local HTTP endpoint
+type Server struct {
+	httpServer *http.Server
+	listener   net.Listener
+}
+
+// StartServer serves /metrics on addr. Only loopback addresses are accepted
+// so the endpoint is never reachable from the network.
+func StartServer(addr string) (*Server, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics address: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("metrics address must be a loopback address, got %s", host)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error starting metrics endpoint: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Default.WritePrometheus(w)
+	})
+
+	s := &Server{
+		httpServer: &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second},
+		listener:   listener,
+	}
+	go s.httpServer.Serve(listener)
+	return s, nil
+}
+
+// Addr returns the address the endpoint listens on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the endpoint
+func (s *Server) Close() error {
+	return s.httpServer.Close()
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"io"
+	"time"
+
+	"maxiofs-agent/internal/metrics"
+)
+
+// S3 client metrics
+var (
+	RequestsTotal = metrics.NewCounterVec("maxiofs_s3_requests_total",
+		"S3 requests issued, by operation.", "op")
+	RequestErrorsTotal = metrics.NewCounterVec("maxiofs_s3_request_errors_total",
+		"S3 requests that failed, by operation.", "op")
+	RequestDuration = metrics.NewHistogramVec("maxiofs_s3_request_duration_seconds",
+		"Latency of S3 requests, by operation.", metrics.DefaultBuckets, "op")
+	BytesTotal = metrics.NewCounterVec("maxiofs_s3_bytes_total",
+		"Object bytes transferred, by direction (download, upload).", "direction")
+)
+
+// S3 operation labels
+const (
+	opGet    = "GET"
+	opHead   = "HEAD"
+	opPut    = "PUT"
+	opList   = "LIST"
+	opDelete = "DELETE"
+	opCopy   = "COPY"
+	opTags   = "GET_TAGGING"
+	opMPU    = "MULTIPART"
+	opPart   = "UPLOAD_PART"
+	opCopyPt = "UPLOAD_PART_COPY"
+	opCreate = "CREATE_BUCKET"
+	opBucket = "LIST_BUCKETS"
+)
+
+// observe records the outcome and latency of one S3 request
+func observe(op string, start time.Time, err error) {
+	RequestsTotal.Inc(op)
+	RequestDuration.Observe(time.Since(start).Seconds(), op)
+	if err != nil {
+		RequestErrorsTotal.Inc(op)
+	}
+}
+
+// countingReader counts the bytes read from an object body
+type countingReader struct {
+	io.ReadCloser
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	BytesTotal.Add(float64(n), "download")
+	return n, err
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// MultipartUpload is an object being assembled from parts
+type MultipartUpload struct {
+	Bucket   string
+	Key      string
+	UploadID string
+
+	mu    sync.Mutex
+	parts []types.CompletedPart
+}
+
+// CreateMultipartUpload starts a multipart upload of objectName
+func (s *S3Client) CreateMultipartUpload(ctx context.Context, bucketName, objectName string) (*MultipartUpload, error) {
+	start := time.Now()
+	result, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectName),
+	})
+	observe(opMPU, start, err)
+	if err != nil {
+		return nil, fmt.Errorf("error starting multipart upload: %w", err)
+	}
+	return &MultipartUpload{
+		Bucket:   bucketName,
+		Key:      objectName,
+		UploadID: aws.ToString(result.UploadId),
+	}, nil
+}
+
+// UploadPart uploads size bytes from body as part number of u
+func (s *S3Client) UploadPart(ctx context.Context, u *MultipartUpload, number int32, body io.ReadSeeker, size int64) error {
+	start := time.Now()
+	result, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(u.Bucket),
+		Key:           aws.String(u.Key),
+		UploadId:      aws.String(u.UploadID),
+		PartNumber:    aws.Int32(number),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+	})
+	observe(opPart, start, err)
+	if err != nil {
+		return fmt.Errorf("error uploading part %d: %w", number, err)
+	}
+	BytesTotal.Add(float64(size), "upload")
+
+	u.addPart(number, aws.ToString(result.ETag))
+	return nil
+}
+
+// UploadPartCopy fills part number of u server-side with length bytes of
+// sourceKey at offset. When sourceETag is not empty the copy fails unless the
+// source still has that ETag.
+func (s *S3Client) UploadPartCopy(ctx context.Context, u *MultipartUpload, number int32, sourceKey, sourceETag string, offset, length int64) error {
+	input := &s3.UploadPartCopyInput{
+		Bucket:          aws.String(u.Bucket),
+		Key:             aws.String(u.Key),
+		UploadId:        aws.String(u.UploadID),
+		PartNumber:      aws.Int32(number),
+		CopySource:      aws.String(copySource(u.Bucket, sourceKey)),
+		CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	}
+	if sourceETag != "" {
+		input.CopySourceIfMatch = aws.String(sourceETag)
+	}
+
+	start := time.Now()
+	result, err := s.client.UploadPartCopy(ctx, input)
+	observe(opCopyPt, start, err)
+	if err != nil {
+		return fmt.Errorf("error copying part %d: %w", number, err)
+	}
+
+	var etag string
+	if result.CopyPartResult != nil {
+		etag = aws.ToString(result.CopyPartResult.ETag)
+	}
+	u.addPart(number, etag)
+	return nil
+}
+
+// CompleteMultipartUpload assembles the uploaded parts and returns the ETag of the new object
+func (s *S3Client) CompleteMultipartUpload(ctx context.Context, u *MultipartUpload) (string, error) {
+	u.mu.Lock()
+	parts := append([]types.CompletedPart(nil), u.parts...)
+	u.mu.Unlock()
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.ToInt32(parts[i].PartNumber) < aws.ToInt32(parts[j].PartNumber)
+	})
+
+	start := time.Now()
+	result, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.Bucket),
+		Key:             aws.String(u.Key),
+		UploadId:        aws.String(u.UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	observe(opMPU, start, err)
+	if err != nil {
+		return "", fmt.Errorf("error completing multipart upload: %w", err)
+	}
+	return aws.ToString(result.ETag), nil
+}
+
+// AbortMultipartUpload discards u and the parts uploaded so far
+func (s *S3Client) AbortMultipartUpload(ctx context.Context, u *MultipartUpload) error {
+	start := time.Now()
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(u.Bucket),
+		Key:      aws.String(u.Key),
+		UploadId: aws.String(u.UploadID),
+	})
+	observe(opMPU, start, err)
+	if err != nil {
+		return fmt.Errorf("error aborting multipart upload: %w", err)
+	}
+	return nil
+}
+
+func (u *MultipartUpload) addPart(number int32, etag string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.parts = append(u.parts, types.CompletedPart{
+		ETag:       aws.String(etag),
+		PartNumber: aws.Int32(number),
+	})
+}
@@ -4,18 +4,28 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"maxiofs-agent/internal/logging"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
+var logger = logging.For("storage")
+
 // S3Client manages the connection to MaxIOFS
 type S3Client struct {
 	client   *s3.Client
@@ -35,6 +45,39 @@ type ObjectInfo struct {
 	LastModified time.Time
 	IsDir        bool
 	ETag         string
+
+	// Only known from HeadObject, listings do not include them
+	Symlink      bool
+	Metadata     map[string]string // User metadata, without the x-amz-meta- prefix
+	ContentType  string
+	StorageClass string
+	VersionID    string
+
+	// Headers served with the object, kept when its metadata is replaced
+	CacheControl       string
+	ContentDisposition string
+	ContentEncoding    string
+	ContentLanguage    string
+	Expires            string
+	WebsiteRedirect    string
+}
+
+// MaxCopySize is the largest object CopyObject, and with it
+// ReplaceObjectMetadata, can copy in a single request
+const MaxCopySize = 5 * 1024 * 1024 * 1024
+
+// Symbolic links are stored the way s3fs stores them: the object holds the
+// target path, and its "mode" metadata (a decimal st_mode) has the link type bits
+const (
+	modeMetadata = "mode"
+	modeTypeMask = 0170000
+	modeSymlink  = 0120000
+)
+
+// isSymlinkMode reports whether object metadata marks a symbolic link
+func isSymlinkMode(metadata map[string]string) bool {
+	mode, err := strconv.ParseUint(metadata[modeMetadata], 10, 32)
+	return err == nil && mode&modeTypeMask == modeSymlink
 }
 
 // NewS3Client creates a new client to connect to MaxIOFS
@@ -84,15 +127,24 @@ func NewS3Client(endpoint, accessKeyID, secretAccessKey string, useSSL, insecure
 	}, nil
 }
 
+// Endpoint returns the host (and port) of the server the client talks to
+func (s *S3Client) Endpoint() string {
+	return s.endpoint
+}
+
 // TestConnection verifies the connection to MaxIOFS
 func (s *S3Client) TestConnection(ctx context.Context) error {
+	start := time.Now()
 	_, err := s.client.ListBuckets(ctx, &s3.ListBucketsInput{})
+	observe(opBucket, start, err)
 	return err
 }
 
 // ListBuckets lists all available buckets
 func (s *S3Client) ListBuckets(ctx context.Context) ([]BucketInfo, error) {
+	start := time.Now()
 	result, err := s.client.ListBuckets(ctx, &s3.ListBucketsInput{})
+	observe(opBucket, start, err)
 	if err != nil {
 		return nil, fmt.Errorf("error listing buckets: %w", err)
 	}
@@ -110,7 +162,7 @@ func (s *S3Client) ListBuckets(ctx context.Context) ([]BucketInfo, error) {
 
 // ListObjects lists objects in a bucket with a prefix (recursive)
 func (s *S3Client) ListObjects(ctx context.Context, bucketName, prefix string) ([]ObjectInfo, error) {
-	fmt.Printf("[S3Client.ListObjects] bucket=%s prefix='%s' (RECURSIVE)\n", bucketName, prefix)
+	logger.Debug("listing objects", "bucket", bucketName, "prefix", prefix)
 
 	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucketName),
@@ -123,14 +175,14 @@ func (s *S3Client) ListObjects(ctx context.Context, bucketName, prefix string) (
 
 	// Iterate through all pages
 	for paginator.HasMorePages() {
+		start := time.Now()
 		result, err := paginator.NextPage(ctx)
+		observe(opList, start, err)
 		if err != nil {
-			fmt.Printf("[S3Client.ListObjects] Error: %v\n", err)
+			logger.Warn("error listing objects", "bucket", bucketName, "prefix", prefix, "error", err)
 			return nil, fmt.Errorf("error listing objects: %w", err)
 		}
 
-		fmt.Printf("[S3Client.ListObjects] Page Contents count: %d\n", len(result.Contents))
-
 		// Add all files and directories
 		for _, obj := range result.Contents {
 			key := aws.ToString(obj.Key)
@@ -139,12 +191,6 @@ func (s *S3Client) ListObjects(ctx context.Context, bucketName, prefix string) (
 			// Determine if it's a directory (ends with /)
 			isDir := len(key) > 0 && key[len(key)-1] == '/'
 
-			if isDir {
-				fmt.Printf("[S3Client.ListObjects] Adding directory: %s\n", key)
-			} else {
-				fmt.Printf("[S3Client.ListObjects] Adding file: %s (size=%d)\n", key, size)
-			}
-
 			objects = append(objects, ObjectInfo{
 				Key:          key,
 				Size:         size,
@@ -155,50 +201,121 @@ func (s *S3Client) ListObjects(ctx context.Context, bucketName, prefix string) (
 		}
 	}
 
-	fmt.Printf("[S3Client.ListObjects] Total objects returned: %d\n", len(objects))
+	logger.Debug("listed objects", "bucket", bucketName, "prefix", prefix, "objects", len(objects))
 	return objects, nil
 }
 
-// UploadFile uploads a file to the bucket
-func (s *S3Client) UploadFile(ctx context.Context, bucketName, objectName, filePath string) error {
+// UploadFile uploads a file to the bucket and returns the ETag of the new object
+func (s *S3Client) UploadFile(ctx context.Context, bucketName, objectName, filePath string) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("error opening file: %w", err)
+		return "", fmt.Errorf("error opening file: %w", err)
 	}
 	defer file.Close()
 
-	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+	start := time.Now()
+	result, err := s.client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(objectName),
 		Body:   file,
 	})
+	observe(opPut, start, err)
 	if err != nil {
-		return fmt.Errorf("error uploading file: %w", err)
+		return "", fmt.Errorf("error uploading file: %w", err)
+	}
+	if info, statErr := file.Stat(); statErr == nil {
+		BytesTotal.Add(float64(info.Size()), "upload")
 	}
 
-	return nil
+	return aws.ToString(result.ETag), nil
 }
 
-// UploadData uploads data from memory to the bucket
-func (s *S3Client) UploadData(ctx context.Context, bucketName, objectName string, data []byte) error {
-	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+// UploadData uploads data from memory to the bucket and returns the ETag of the new object
+func (s *S3Client) UploadData(ctx context.Context, bucketName, objectName string, data []byte) (string, error) {
+	start := time.Now()
+	result, err := s.client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(objectName),
 		Body:   bytes.NewReader(data),
 	})
+	observe(opPut, start, err)
 	if err != nil {
-		return fmt.Errorf("error uploading data: %w", err)
+		return "", fmt.Errorf("error uploading data: %w", err)
 	}
+	BytesTotal.Add(float64(len(data)), "upload")
 
-	return nil
+	return aws.ToString(result.ETag), nil
+}
+
+// CreateObjectExclusive uploads data only if no object exists at objectName yet
+// and returns the ETag of the new object. It fails with a precondition error
+// (see IsPreconditionFailed) when the object already exists.
+func (s *S3Client) CreateObjectExclusive(ctx context.Context, bucketName, objectName string, data []byte) (string, error) {
+	start := time.Now()
+	result, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(objectName),
+		Body:        bytes.NewReader(data),
+		IfNoneMatch: aws.String("*"),
+	})
+	observe(opPut, start, err)
+	if err != nil {
+		return "", fmt.Errorf("error creating object: %w", err)
+	}
+	BytesTotal.Add(float64(len(data)), "upload")
+
+	return aws.ToString(result.ETag), nil
+}
+
+// CreateSymlink stores a symbolic link to target, only if no object exists at
+// objectName yet, and returns the ETag of the new object. It fails with a
+// precondition error (see IsPreconditionFailed) when the object already exists.
+func (s *S3Client) CreateSymlink(ctx context.Context, bucketName, objectName, target string) (string, error) {
+	start := time.Now()
+	result, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(objectName),
+		Body:        strings.NewReader(target),
+		Metadata:    map[string]string{modeMetadata: strconv.Itoa(modeSymlink | 0777)},
+		IfNoneMatch: aws.String("*"),
+	})
+	observe(opPut, start, err)
+	if err != nil {
+		return "", fmt.Errorf("error creating symbolic link: %w", err)
+	}
+	BytesTotal.Add(float64(len(target)), "upload")
+
+	return aws.ToString(result.ETag), nil
+}
+
+// ReplaceObject overwrites an object only if it still has the given ETag and
+// returns the ETag of the new object. It fails with a precondition error (see
+// IsPreconditionFailed) when the object changed or no longer exists.
+func (s *S3Client) ReplaceObject(ctx context.Context, bucketName, objectName string, data []byte, etag string) (string, error) {
+	start := time.Now()
+	result, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:  aws.String(bucketName),
+		Key:     aws.String(objectName),
+		Body:    bytes.NewReader(data),
+		IfMatch: aws.String(etag),
+	})
+	observe(opPut, start, err)
+	if err != nil {
+		return "", fmt.Errorf("error replacing object: %w", err)
+	}
+	BytesTotal.Add(float64(len(data)), "upload")
+
+	return aws.ToString(result.ETag), nil
 }
 
 // DownloadFile downloads a file from the bucket
 func (s *S3Client) DownloadFile(ctx context.Context, bucketName, objectName, destPath string) error {
+	start := time.Now()
 	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(objectName),
 	})
+	observe(opGet, start, err)
 	if err != nil {
 		return fmt.Errorf("error downloading file: %w", err)
 	}
@@ -212,7 +329,7 @@ func (s *S3Client) DownloadFile(ctx context.Context, bucketName, objectName, des
 	defer file.Close()
 
 	// Copy contents
-	_, err = io.Copy(file, result.Body)
+	_, err = io.Copy(file, countingReader{result.Body})
 	if err != nil {
 		return fmt.Errorf("error writing file: %w", err)
 	}
@@ -222,24 +339,182 @@ func (s *S3Client) DownloadFile(ctx context.Context, bucketName, objectName, des
 
 // GetObject retrieves an object for reading
 func (s *S3Client) GetObject(ctx context.Context, bucketName, objectName string) (io.ReadCloser, int64, error) {
+	start := time.Now()
 	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(objectName),
 	})
+	observe(opGet, start, err)
 	if err != nil {
 		return nil, 0, fmt.Errorf("error getting object: %w", err)
 	}
 
 	size := aws.ToInt64(result.ContentLength)
-	return result.Body, size, nil
+	return countingReader{result.Body}, size, nil
+}
+
+// GetObjectRange reads length bytes of an object starting at offset.
+// When etag is not empty the read fails unless the object still has that ETag.
+func (s *S3Client) GetObjectRange(ctx context.Context, bucketName, objectName, etag string, offset, length int64) ([]byte, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectName),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	}
+	if etag != "" {
+		input.IfMatch = aws.String(etag)
+	}
+
+	start := time.Now()
+	result, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		observe(opGet, start, err)
+		return nil, fmt.Errorf("error getting object range: %w", err)
+	}
+	defer result.Body.Close()
+
+	data, err := io.ReadAll(countingReader{result.Body})
+	observe(opGet, start, err)
+	if err != nil {
+		return nil, fmt.Errorf("error reading object range: %w", err)
+	}
+	return data, nil
+}
+
+// OpenObjectStream opens the body of an object from offset to its end.
+// When etag is not empty the request fails unless the object still has that ETag.
+func (s *S3Client) OpenObjectStream(ctx context.Context, bucketName, objectName, etag string, offset int64) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectName),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-", offset)),
+	}
+	if etag != "" {
+		input.IfMatch = aws.String(etag)
+	}
+
+	start := time.Now()
+	result, err := s.client.GetObject(ctx, input)
+	observe(opGet, start, err)
+	if err != nil {
+		return nil, fmt.Errorf("error opening object stream: %w", err)
+	}
+	return countingReader{result.Body}, nil
+}
+
+// HeadObject retrieves the metadata of an object without its content
+func (s *S3Client) HeadObject(ctx context.Context, bucketName, objectName string) (*ObjectInfo, error) {
+	start := time.Now()
+	result, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectName),
+	})
+	observe(opHead, start, err)
+	if err != nil {
+		return nil, fmt.Errorf("error getting object metadata: %w", err)
+	}
+
+	return &ObjectInfo{
+		Key:          objectName,
+		Size:         aws.ToInt64(result.ContentLength),
+		LastModified: aws.ToTime(result.LastModified),
+		IsDir:        len(objectName) > 0 && objectName[len(objectName)-1] == '/',
+		ETag:         aws.ToString(result.ETag),
+		Symlink:      isSymlinkMode(result.Metadata),
+		Metadata:     result.Metadata,
+		ContentType:  aws.ToString(result.ContentType),
+		StorageClass: string(result.StorageClass),
+		VersionID:    aws.ToString(result.VersionId),
+
+		CacheControl:       aws.ToString(result.CacheControl),
+		ContentDisposition: aws.ToString(result.ContentDisposition),
+		ContentEncoding:    aws.ToString(result.ContentEncoding),
+		ContentLanguage:    aws.ToString(result.ContentLanguage),
+		Expires:            aws.ToString(result.ExpiresString),
+		WebsiteRedirect:    aws.ToString(result.WebsiteRedirectLocation),
+	}, nil
+}
+
+// GetObjectTags returns the tags of an object
+func (s *S3Client) GetObjectTags(ctx context.Context, bucketName, objectName string) (map[string]string, error) {
+	start := time.Now()
+	result, err := s.client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectName),
+	})
+	observe(opTags, start, err)
+	if err != nil {
+		return nil, fmt.Errorf("error getting object tags: %w", err)
+	}
+
+	tags := make(map[string]string, len(result.TagSet))
+	for _, tag := range result.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tags, nil
+}
+
+// ReplaceObjectMetadata replaces the user metadata and tags of an object with
+// a copy onto itself, which does not transfer its data. obj is the object as
+// returned by HeadObject: its headers and storage class are kept, and the copy
+// is only made if the object still has its ETag; it fails with a precondition
+// error (see IsPreconditionFailed) otherwise. Returns the ETag of the new version.
+func (s *S3Client) ReplaceObjectMetadata(ctx context.Context, bucketName, objectName string, obj *ObjectInfo, metadata, tags map[string]string) (string, error) {
+	tagging := make(url.Values, len(tags))
+	for k, v := range tags {
+		tagging.Set(k, v)
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(bucketName),
+		CopySource:        aws.String(copySource(bucketName, objectName)),
+		Key:               aws.String(objectName),
+		CopySourceIfMatch: aws.String(obj.ETag),
+		MetadataDirective: types.MetadataDirectiveReplace,
+		Metadata:          metadata,
+		TaggingDirective:  types.TaggingDirectiveReplace,
+		Tagging:           aws.String(tagging.Encode()),
+		StorageClass:      types.StorageClass(obj.StorageClass),
+	}
+	// Replacing the metadata replaces these headers too, they must be sent again
+	optional := func(v string) *string {
+		if v == "" {
+			return nil
+		}
+		return aws.String(v)
+	}
+	input.ContentType = optional(obj.ContentType)
+	input.CacheControl = optional(obj.CacheControl)
+	input.ContentDisposition = optional(obj.ContentDisposition)
+	input.ContentEncoding = optional(obj.ContentEncoding)
+	input.ContentLanguage = optional(obj.ContentLanguage)
+	input.WebsiteRedirectLocation = optional(obj.WebsiteRedirect)
+	if obj.Expires != "" {
+		if expires, err := http.ParseTime(obj.Expires); err == nil {
+			input.Expires = aws.Time(expires)
+		}
+	}
+
+	start := time.Now()
+	result, err := s.client.CopyObject(ctx, input)
+	observe(opCopy, start, err)
+	if err != nil {
+		return "", fmt.Errorf("error replacing object metadata: %w", err)
+	}
+	if result.CopyObjectResult == nil {
+		return "", nil
+	}
+	return aws.ToString(result.CopyObjectResult.ETag), nil
 }
 
 // DeleteObject deletes an object from the bucket
 func (s *S3Client) DeleteObject(ctx context.Context, bucketName, objectName string) error {
+	start := time.Now()
 	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(objectName),
 	})
+	observe(opDelete, start, err)
 	if err != nil {
 		return fmt.Errorf("error deleting object: %w", err)
 	}
@@ -247,31 +522,77 @@ func (s *S3Client) DeleteObject(ctx context.Context, bucketName, objectName stri
 }
 
 // CopyObject copies an object within the bucket (server-side, without downloading)
-func (s *S3Client) CopyObject(ctx context.Context, bucketName, sourceKey, destKey string) error {
-	copySource := fmt.Sprintf("%s/%s", bucketName, sourceKey)
-
-	_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+// and returns the ETag of the copy. When sourceETag is not empty the copy fails
+// with a precondition error unless the source still has that ETag.
+func (s *S3Client) CopyObject(ctx context.Context, bucketName, sourceKey, sourceETag, destKey string) (string, error) {
+	input := &s3.CopyObjectInput{
 		Bucket:     aws.String(bucketName),
-		CopySource: aws.String(copySource),
+		CopySource: aws.String(copySource(bucketName, sourceKey)),
 		Key:        aws.String(destKey),
-	})
+	}
+	if sourceETag != "" {
+		input.CopySourceIfMatch = aws.String(sourceETag)
+	}
+
+	start := time.Now()
+	result, err := s.client.CopyObject(ctx, input)
+	observe(opCopy, start, err)
 	if err != nil {
-		return fmt.Errorf("error copying object: %w", err)
+		return "", fmt.Errorf("error copying object: %w", err)
 	}
-	return nil
+	if result.CopyObjectResult == nil {
+		return "", nil
+	}
+	return aws.ToString(result.CopyObjectResult.ETag), nil
+}
+
+// copySource returns the x-amz-copy-source value naming key in bucket. It is
+// sent as a URL path, so every segment of the key is escaped.
+func copySource(bucketName, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return bucketName + "/" + strings.Join(segments, "/")
 }
 
 // CreateBucket creates a new bucket
 func (s *S3Client) CreateBucket(ctx context.Context, bucketName string) error {
+	start := time.Now()
 	_, err := s.client.CreateBucket(ctx, &s3.CreateBucketInput{
 		Bucket: aws.String(bucketName),
 	})
+	observe(opCreate, start, err)
 	if err != nil {
 		return fmt.Errorf("error creating bucket: %w", err)
 	}
 	return nil
 }
 
+// IsNotFound reports whether err means the requested object does not exist
+func IsNotFound(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+// IsPreconditionFailed reports whether err means a conditional request did not match
+func IsPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return true
+		}
+	}
+	return false
+}
+
 // GetObjectName extracts the file name from the path
 func GetObjectName(filePath string) string {
 	return filepath.Base(filePath)
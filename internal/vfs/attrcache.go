@@ -0,0 +1,143 @@
+package vfs
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"maxiofs-agent/internal/cgofuse"
+	"maxiofs-agent/internal/storage"
+)
+
+const (
+	defaultFileAttrTTL     = 10 * time.Second
+	defaultDirAttrTTL      = 30 * time.Second
+	defaultNegativeAttrTTL = 5 * time.Second
+)
+
+// FileCache caches file metadata per path, including paths known not to exist
+type FileCache struct {
+	entries map[string]*CacheEntry
+	mu      sync.RWMutex
+
+	fileTTL     time.Duration
+	dirTTL      time.Duration
+	negativeTTL time.Duration
+}
+
+type CacheEntry struct {
+	Info      storage.ObjectInfo
+	Negative  bool // The path does not exist
+	ExpiresAt time.Time
+}
+
+func newFileCache(fileTTL, dirTTL, negativeTTL time.Duration) *FileCache {
+	return &FileCache{
+		entries:     make(map[string]*CacheEntry),
+		fileTTL:     fileTTL,
+		dirTTL:      dirTTL,
+		negativeTTL: negativeTTL,
+	}
+}
+
+// Get returns the unexpired entry of path
+func (c *FileCache) Get(path string) (CacheEntry, bool) {
+	c.mu.RLock()
+	entry, ok := c.entries[path]
+	c.mu.RUnlock()
+	if !ok || time.Now().After(entry.ExpiresAt) {
+		return CacheEntry{}, false
+	}
+	return *entry, true
+}
+
+// Put caches the attributes of an existing file or directory
+func (c *FileCache) Put(path string, info storage.ObjectInfo) {
+	ttl := c.fileTTL
+	if info.IsDir {
+		ttl = c.dirTTL
+	}
+	c.store(path, &CacheEntry{Info: info}, ttl)
+}
+
+// PutNegative caches that path does not exist
+func (c *FileCache) PutNegative(path string) {
+	c.store(path, &CacheEntry{Negative: true}, c.negativeTTL)
+}
+
+func (c *FileCache) store(path string, entry *CacheEntry, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	entry.ExpiresAt = time.Now().Add(ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[path] = entry
+	if len(c.entries)%1024 == 0 {
+		c.sweep()
+	}
+}
+
+// Invalidate drops path and its parent directories, whose existence
+// (for implicit directories) or contents depend on it
+func (c *FileCache) Invalidate(p string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for p != "" && p != "." {
+		delete(c.entries, p)
+		p = path.Dir(p)
+	}
+}
+
+// InvalidatePrefix drops every entry below the directory dir
+func (c *FileCache) InvalidatePrefix(dir string) {
+	prefix := dir + "/"
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for p := range c.entries {
+		if strings.HasPrefix(p, prefix) {
+			delete(c.entries, p)
+		}
+	}
+}
+
+// sweep removes expired entries. Must be called with mu held.
+func (c *FileCache) sweep() {
+	now := time.Now()
+	for p, entry := range c.entries {
+		if now.After(entry.ExpiresAt) {
+			delete(c.entries, p)
+		}
+	}
+}
+
+// invalidatePath drops cached attributes of the given paths and their parents,
+// along with the usage snapshot that includes them
+func (fs *S3FS) invalidatePath(paths ...string) {
+	for _, p := range paths {
+		fs.cache.Invalidate(p)
+		fs.links.forget(p)
+	}
+	fs.invalidateStatfs()
+}
+
+// fillStat fills stat from the attributes of the object at p
+func (fs *S3FS) fillStat(stat *cgofuse.Stat_t, p string, info storage.ObjectInfo) {
+	switch {
+	case info.IsDir:
+		stat.Mode = cgofuse.S_IFDIR | 0777
+	case info.Symlink:
+		stat.Mode = cgofuse.S_IFLNK | 0777
+		stat.Size = info.Size
+		stat.Mtim.Sec = info.LastModified.Unix()
+	default:
+		stat.Mode = cgofuse.S_IFREG | 0666
+		stat.Size = info.Size
+		stat.Mtim.Sec = info.LastModified.Unix()
+	}
+	stat.Ino = fs.inodes.ino(p)
+	stat.Uid = 0
+	stat.Gid = 0
+}
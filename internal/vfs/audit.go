@@ -0,0 +1,90 @@
+package vfs
+
+import (
+	"context"
+
+	"maxiofs-agent/internal/audit"
+	"maxiofs-agent/internal/cgofuse"
+)
+
+// Audited operations
+const (
+	auditCreate      = "create"
+	auditWrite       = "write"
+	auditUnlink      = "unlink"
+	auditMkdir       = "mkdir"
+	auditRmdir       = "rmdir"
+	auditRename      = "rename"
+	auditTruncate    = "truncate"
+	auditSymlink     = "symlink"
+	auditSetxattr    = "setxattr"
+	auditRemovexattr = "removexattr"
+)
+
+// auditCaller identifies the process behind a mutation
+type auditCaller struct {
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+	PID int    `json:"pid"`
+}
+
+// currentCaller returns the process of the FUSE callback running on this
+// thread. It must not be called from any other goroutine.
+func (fs *S3FS) currentCaller() auditCaller {
+	if fs.audit == nil {
+		return auditCaller{}
+	}
+	uid, gid, pid := cgofuse.Getcontext()
+	return auditCaller{UID: uid, GID: gid, PID: pid}
+}
+
+// beginAudit starts the audit record of a mutation. It must be called from the
+// FUSE callback so the caller's uid/pid are captured, and it returns nil when
+// auditing is disabled.
+func (fs *S3FS) beginAudit(op, key string) *audit.Record {
+	return fs.beginAuditAs(fs.currentCaller(), op, key)
+}
+
+// beginAuditAs starts the audit record of a mutation done in the background
+// on behalf of who
+func (fs *S3FS) beginAuditAs(who auditCaller, op, key string) *audit.Record {
+	if fs.audit == nil {
+		return nil
+	}
+	return &audit.Record{
+		UID:    who.UID,
+		GID:    who.GID,
+		PID:    who.PID,
+		Bucket: fs.bucketName,
+		Op:     op,
+		Key:    fs.objectKey(key),
+	}
+}
+
+// auditETag returns the current ETag of key for an audit record ("" if it does not exist)
+func (fs *S3FS) auditETag(ctx context.Context, rec *audit.Record, key string) string {
+	if rec == nil {
+		return ""
+	}
+	info, err := fs.s3Client.HeadObject(ctx, fs.bucketName, fs.objectKey(key))
+	if err != nil {
+		return ""
+	}
+	return info.ETag
+}
+
+// finishAudit completes and writes an audit record
+func (fs *S3FS) finishAudit(rec *audit.Record, etagAfter string, err error) {
+	if rec == nil {
+		return
+	}
+	rec.ETagAfter = etagAfter
+	rec.Outcome = audit.OutcomeSuccess
+	if err != nil {
+		rec.Outcome = audit.OutcomeFailure
+		rec.Error = err.Error()
+	}
+	if err := fs.audit.Log(*rec); err != nil {
+		logger.Error("could not write audit record", "op", rec.Op, "key", rec.Key, "error", err)
+	}
+}
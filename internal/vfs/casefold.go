@@ -0,0 +1,202 @@
+package vfs
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// In case-insensitive mode names are looked up ignoring case, as Windows
+// applications expect. A bucket may still hold keys that differ only in case:
+// in each such group the first name in byte order is shown as is and the
+// others with a numbered suffix ("report (2).pdf"), so every key stays
+// reachable and the same name always leads to the same key.
+
+// foldName returns the form of a name compared when ignoring case
+func foldName(name string) string {
+	return strings.ToLower(name)
+}
+
+// collisionName returns the k-th alias of name, numbered before its extension
+func collisionName(name string, k int) string {
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		base, ext = name[:i], name[i:]
+	}
+	return fmt.Sprintf("%s (%d)%s", base, k, ext)
+}
+
+// setChild adds or replaces the child called name
+func (n *treeNode) setChild(name string, child *treeNode) {
+	if _, exists := n.children[name]; !exists && n.foldCase {
+		n.addFold(name)
+	}
+	n.children[name] = child
+}
+
+// deleteChild removes the child called name
+func (n *treeNode) deleteChild(name string) {
+	if _, exists := n.children[name]; exists && n.foldCase {
+		n.removeFold(name)
+	}
+	delete(n.children, name)
+}
+
+func (n *treeNode) addFold(name string) {
+	if n.folds == nil {
+		n.folds = make(map[string][]string)
+	}
+	key := foldName(name)
+	names := n.folds[key]
+	i, _ := slices.BinarySearch(names, name)
+	n.folds[key] = slices.Insert(names, i, name)
+	if len(names) > 0 {
+		if n.collided == nil {
+			n.collided = make(map[string]bool)
+		}
+		n.collided[key] = true
+	}
+	// The new name may also take the place of an alias
+	if len(n.collided) > 0 {
+		n.renameCollisions()
+	}
+}
+
+func (n *treeNode) removeFold(name string) {
+	key := foldName(name)
+	names := slices.DeleteFunc(n.folds[key], func(s string) bool { return s == name })
+	switch len(names) {
+	case 0:
+		delete(n.folds, key)
+	case 1:
+		n.folds[key] = names
+		delete(n.collided, key)
+	default:
+		n.folds[key] = names
+	}
+	if len(n.collided) > 0 || len(n.aliases) > 0 {
+		n.renameCollisions()
+	}
+}
+
+// renameCollisions assigns the aliases of the names that collide ignoring
+// case, skipping aliases that collide with other names in turn
+func (n *treeNode) renameCollisions() {
+	n.aliases, n.shown = nil, nil
+	if len(n.collided) == 0 {
+		return
+	}
+	n.aliases = make(map[string]string)
+	n.shown = make(map[string]string)
+
+	keys := make([]string, 0, len(n.collided))
+	for key := range n.collided {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, name := range n.folds[key][1:] {
+			for k := 2; ; k++ {
+				alias := collisionName(name, k)
+				folded := foldName(alias)
+				if _, taken := n.folds[folded]; taken {
+					continue
+				}
+				if _, taken := n.aliases[folded]; taken {
+					continue
+				}
+				n.aliases[folded] = name
+				n.shown[name] = alias
+				break
+			}
+		}
+	}
+}
+
+// lookupChild returns the stored name of the child that name refers to
+func (n *treeNode) lookupChild(name string) (string, bool) {
+	if !n.foldCase {
+		_, ok := n.children[name]
+		return name, ok
+	}
+	folded := foldName(name)
+	if names := n.folds[folded]; len(names) > 0 {
+		return names[0], true
+	}
+	stored, ok := n.aliases[folded]
+	return stored, ok
+}
+
+// shownName returns the name a child is listed with
+func (n *treeNode) shownName(name string) string {
+	if alias, ok := n.shown[name]; ok {
+		return alias
+	}
+	return name
+}
+
+func (t *treeIndex) built() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.root != nil
+}
+
+// resolve returns the stored path that p refers to. Names that do not exist,
+// and whatever follows them, are kept as given.
+func (t *treeIndex) resolve(p string) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.root == nil || p == "" {
+		return p
+	}
+	names := strings.Split(p, "/")
+	n := t.root
+	for i, name := range names {
+		if n.children == nil {
+			break
+		}
+		stored, ok := n.lookupChild(name)
+		if !ok {
+			break
+		}
+		names[i] = stored
+		n = n.children[stored]
+	}
+	return strings.Join(names, "/")
+}
+
+// resolvePath turns a path received from the host into the path of the file
+// or directory it refers to: without the leading slash and, when lookups
+// ignore case, with the names stored in the bucket
+func (fs *S3FS) resolvePath(path string) string {
+	path = strings.TrimPrefix(path, "/")
+	if !fs.tree.foldCase || path == "" {
+		return path
+	}
+	// Operations that list refresh the index; only its first build is waited for here
+	if !fs.tree.built() {
+		ctx, cancel := fs.metadataContext()
+		defer cancel()
+		if err := fs.refreshTree(ctx); err != nil {
+			// The operation itself reports the error
+			return path
+		}
+	}
+	return fs.tree.resolve(path)
+}
+
+// resolveNewPath is resolvePath for the target of a rename: a target that
+// refers to the source itself keeps its last name as given, so a rename can
+// change just the case of a name
+func (fs *S3FS) resolveNewPath(newpath, oldpath string) string {
+	resolved := fs.resolvePath(newpath)
+	if resolved != oldpath {
+		return resolved
+	}
+	dir, name := splitPath(strings.TrimPrefix(newpath, "/"))
+	if dir = fs.resolvePath(dir); dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
@@ -0,0 +1,146 @@
+package vfs
+
+import (
+	"maps"
+	"testing"
+
+	"maxiofs-agent/internal/storage"
+)
+
+func newFoldTree(keys ...string) *treeIndex {
+	objects := make([]storage.ObjectInfo, len(keys))
+	for i, key := range keys {
+		objects[i] = storage.ObjectInfo{Key: key}
+	}
+	t := newTreeIndex(0, true)
+	t.root = buildTree(objects, true)
+	return t
+}
+
+// shownNames maps the names listed in directory p to the names they stand for
+func shownNames(t *testing.T, tree *treeIndex, p string) map[string]string {
+	entries, ok := tree.list(p)
+	if !ok {
+		t.Fatalf("directory %q not found", p)
+	}
+	shown := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		shown[entry.Shown] = entry.Name
+	}
+	return shown
+}
+
+func TestCaseFoldCollisions(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []string
+		shown   map[string]string // In the root directory
+		resolve map[string]string
+	}{
+		{
+			name:    "no collision",
+			keys:    []string{"Report.pdf"},
+			shown:   map[string]string{"Report.pdf": "Report.pdf"},
+			resolve: map[string]string{"report.PDF": "Report.pdf", "missing": "missing"},
+		},
+		{
+			name:  "first in byte order keeps its name",
+			keys:  []string{"report.pdf", "Report.pdf"},
+			shown: map[string]string{"Report.pdf": "Report.pdf", "report (2).pdf": "report.pdf"},
+			resolve: map[string]string{
+				"report.pdf":     "Report.pdf",
+				"REPORT.PDF":     "Report.pdf",
+				"report (2).pdf": "report.pdf",
+				"Report (2).PDF": "report.pdf",
+			},
+		},
+		{
+			name:  "three names",
+			keys:  []string{"ab", "Ab", "AB"},
+			shown: map[string]string{"AB": "AB", "Ab (2)": "Ab", "ab (3)": "ab"},
+			resolve: map[string]string{
+				"aB":     "AB",
+				"ab (2)": "Ab",
+				"AB (3)": "ab",
+			},
+		},
+		{
+			name:  "alias taken by a key",
+			keys:  []string{"a", "A", "a (2)"},
+			shown: map[string]string{"A": "A", "a (2)": "a (2)", "a (3)": "a"},
+			resolve: map[string]string{
+				"a (2)": "a (2)",
+				"A (3)": "a",
+			},
+		},
+		{
+			name:  "no extension",
+			keys:  []string{"Makefile", "makefile", ".env", ".ENV"},
+			shown: map[string]string{"Makefile": "Makefile", "makefile (2)": "makefile", ".ENV": ".ENV", ".env (2)": ".env"},
+			resolve: map[string]string{
+				"MAKEFILE (2)": "makefile",
+				".Env (2)":     ".env",
+			},
+		},
+		{
+			name:  "directories",
+			keys:  []string{"Dir/x", "dir/y"},
+			shown: map[string]string{"Dir": "Dir", "dir (2)": "dir"},
+			resolve: map[string]string{
+				"DIR/X":       "Dir/x",
+				"dir (2)/Y":   "dir/y",
+				"dir/y":       "Dir/y",
+				"DIR (2)/z/w": "dir/z/w",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := newFoldTree(tt.keys...)
+			if shown := shownNames(t, tree, ""); !maps.Equal(shown, tt.shown) {
+				t.Errorf("listed %v, want %v", shown, tt.shown)
+			}
+			for p, want := range tt.resolve {
+				if got := tree.resolve(p); got != want {
+					t.Errorf("resolve(%q) = %q, want %q", p, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCaseFoldChanges(t *testing.T) {
+	tree := newFoldTree("a", "A")
+	steps := []struct {
+		name  string
+		apply func()
+		shown map[string]string
+	}{
+		{"collision", func() {}, map[string]string{"A": "A", "a (2)": "a"}},
+		{"key takes the alias", func() { tree.putFile("a (2)", storage.ObjectInfo{}) },
+			map[string]string{"A": "A", "a (2)": "a (2)", "a (3)": "a"}},
+		{"alias freed", func() { tree.remove("a (2)") }, map[string]string{"A": "A", "a (2)": "a"}},
+		{"collision gone", func() { tree.remove("A") }, map[string]string{"a": "a"}},
+		{"renamed into a collision", func() { tree.move("a", "B"); tree.putFile("b", storage.ObjectInfo{}) },
+			map[string]string{"B": "B", "b (2)": "b"}},
+	}
+	for _, step := range steps {
+		step.apply()
+		if shown := shownNames(t, tree, ""); !maps.Equal(shown, step.shown) {
+			t.Errorf("%s: listed %v, want %v", step.name, shown, step.shown)
+		}
+	}
+}
+
+func TestCaseSensitiveTree(t *testing.T) {
+	objects := []storage.ObjectInfo{{Key: "Report.pdf"}, {Key: "report.pdf"}}
+	tree := newTreeIndex(0, false)
+	tree.root = buildTree(objects, false)
+	want := map[string]string{"Report.pdf": "Report.pdf", "report.pdf": "report.pdf"}
+	if shown := shownNames(t, tree, ""); !maps.Equal(shown, want) {
+		t.Errorf("listed %v, want %v", shown, want)
+	}
+	if got := tree.resolve("REPORT.pdf"); got != "REPORT.pdf" {
+		t.Errorf("resolve ignored case: %q", got)
+	}
+}
@@ -0,0 +1,146 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"maxiofs-agent/internal/storage"
+)
+
+// lookupObject finds the indexed object stored at path
+func (fs *S3FS) lookupObject(ctx context.Context, path string) (storage.ObjectInfo, bool, error) {
+	if err := fs.refreshTree(ctx); err != nil {
+		return storage.ObjectInfo{}, false, err
+	}
+	info, found := fs.tree.lookup(path)
+	if !found || info.IsDir {
+		return storage.ObjectInfo{}, false, nil
+	}
+	return info, true, nil
+}
+
+// chunkSize is the unit in which object data is cached and prefetched
+func (fs *S3FS) chunkSize() int64 {
+	if fs.blocks != nil {
+		return fs.blocks.ChunkSize()
+	}
+	return defaultReadChunk
+}
+
+// readObject fills buff from obj at ofst, through the block cache and read-ahead
+// when they are enabled. It returns the bytes read, which is short only at the
+// end of the object.
+// When h is set, foreground downloads continue on its stream.
+func (fs *S3FS) readObject(ctx context.Context, obj storage.ObjectInfo, buff []byte, ofst int64, h *readHandle) (int, error) {
+	if ofst >= obj.Size {
+		return 0, nil
+	}
+	want := int64(len(buff))
+	if ofst+want > obj.Size {
+		want = obj.Size - ofst
+	}
+
+	chunkSize := fs.chunkSize()
+	sequential := fs.readAhead.observe(obj, ofst, want, chunkSize)
+
+	// Random reads without a cache fetch exactly what was asked for
+	if fs.blocks == nil && !sequential {
+		data, err := fs.fetchRange(ctx, obj, ofst, want, h)
+		if err != nil {
+			return 0, err
+		}
+		return copy(buff, data), nil
+	}
+
+	var n int64
+	for n < want {
+		pos := ofst + n
+		index := pos / chunkSize
+		data, err := fs.readChunk(ctx, obj, index, chunkSize, h)
+		if err != nil {
+			return int(n), err
+		}
+		start := pos - index*chunkSize
+		if start >= int64(len(data)) {
+			break
+		}
+		n += int64(copy(buff[n:want], data[start:]))
+	}
+
+	if sequential {
+		fs.prefetch(obj, (ofst+n-1)/chunkSize, chunkSize)
+	}
+	return int(n), nil
+}
+
+// readChunk returns chunk index of obj, preferring prefetched data
+func (fs *S3FS) readChunk(ctx context.Context, obj storage.ObjectInfo, index, chunkSize int64, h *readHandle) ([]byte, error) {
+	if data, ok := fs.readAhead.take(ctx, obj, index, chunkSize); ok {
+		return data, nil
+	}
+	return fs.fetchChunk(ctx, obj, index, chunkSize, h)
+}
+
+// fetchChunk returns chunk index of obj from the block cache, downloading and
+// caching it on a miss
+func (fs *S3FS) fetchChunk(ctx context.Context, obj storage.ObjectInfo, index, chunkSize int64, h *readHandle) ([]byte, error) {
+	if fs.blocks != nil {
+		if data, ok := fs.blocks.Get(fs.bucketName, fs.objectKey(obj.Key), obj.ETag, index); ok {
+			trackCache("block", true)
+			return data, nil
+		}
+		trackCache("block", false)
+	}
+
+	offset := index * chunkSize
+	length := chunkSize
+	if offset+length > obj.Size {
+		length = obj.Size - offset
+	}
+	data, err := fs.fetchRange(ctx, obj, offset, length, h)
+	if err != nil {
+		return nil, err
+	}
+	// A short chunk must not be cached as if it were the whole of it
+	if int64(len(data)) != length {
+		return nil, fmt.Errorf("read %d of %d bytes at offset %d: %w", len(data), length, offset, io.ErrUnexpectedEOF)
+	}
+	if fs.blocks != nil {
+		if err := fs.blocks.Put(fs.bucketName, fs.objectKey(obj.Key), obj.ETag, index, data); err != nil {
+			logger.Warn("block cache: error storing chunk", "key", obj.Key, "chunk", index, "error", err)
+		}
+	}
+	return data, nil
+}
+
+// fetchRange downloads length bytes of obj at offset, on the stream of h when
+// it is not busy with another read
+func (fs *S3FS) fetchRange(ctx context.Context, obj storage.ObjectInfo, offset, length int64, h *readHandle) ([]byte, error) {
+	if h != nil && h.mu.TryLock() {
+		defer h.mu.Unlock()
+		buf := make([]byte, length)
+		n, err := h.readAt(ctx, fs, obj, buf, offset)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			return buf[:n], err
+		}
+		// The stream was cut short: fetch the rest with a request of its own
+		logger.Warn("read stream: truncated, fetching the rest", "path", h.Path, "offset", offset+int64(n), "error", err)
+		rest, err := fs.s3Client.GetObjectRange(ctx, fs.bucketName, fs.objectKey(obj.Key), obj.ETag, offset+int64(n), length-int64(n))
+		if err != nil {
+			return nil, err
+		}
+		return append(buf[:n], rest...), nil
+	}
+	return fs.s3Client.GetObjectRange(ctx, fs.bucketName, fs.objectKey(obj.Key), obj.ETag, offset, length)
+}
+
+// invalidateBlocks drops cached and prefetched chunks of the object at path
+// after it was replaced or removed
+func (fs *S3FS) invalidateBlocks(path string) {
+	fs.readAhead.drop(path)
+	if fs.blocks != nil {
+		fs.blocks.Invalidate(fs.bucketName, fs.objectKey(path))
+	}
+}
@@ -0,0 +1,68 @@
+package vfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DirMarkers is the convention used to store empty directories in the bucket.
+// Markers of every convention are recognized when listing; the setting only
+// chooses which one Mkdir writes.
+type DirMarkers string
+
+const (
+	// DirMarkersSlash stores a directory as an empty "dir/" object
+	DirMarkersSlash DirMarkers = "slash"
+	// DirMarkersFolder stores a directory as an empty "dir_$folder$" object,
+	// as Hadoop and s3fs do
+	DirMarkersFolder DirMarkers = "folder"
+	// DirMarkersNone writes no markers: empty directories only exist on this
+	// mount until a file is created in them
+	DirMarkersNone DirMarkers = "none"
+)
+
+const folderMarkerSuffix = "_$folder$"
+
+// ParseDirMarkers validates a marker convention; empty selects DirMarkersSlash
+func ParseDirMarkers(s string) (DirMarkers, error) {
+	switch m := DirMarkers(strings.ToLower(s)); m {
+	case "":
+		return DirMarkersSlash, nil
+	case DirMarkersSlash, DirMarkersFolder, DirMarkersNone:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown directory marker convention %q", s)
+	}
+}
+
+// key returns the marker object of the directory p, or "" when none is written
+func (m DirMarkers) key(p string) string {
+	switch m {
+	case DirMarkersSlash:
+		return p + "/"
+	case DirMarkersFolder:
+		return p + folderMarkerSuffix
+	default:
+		return ""
+	}
+}
+
+// markerDir returns the directory a marker key stands for
+func markerDir(key string) (string, bool) {
+	if dir, ok := strings.CutSuffix(key, "/"); ok {
+		return dir, true
+	}
+	if dir, ok := strings.CutSuffix(key, folderMarkerSuffix); ok {
+		return dir, true
+	}
+	return "", false
+}
+
+// rekeyMarker returns the key of marker, in its own convention, after its
+// directory moved to p
+func rekeyMarker(marker, p string) string {
+	if strings.HasSuffix(marker, "/") {
+		return DirMarkersSlash.key(p)
+	}
+	return DirMarkersFolder.key(p)
+}
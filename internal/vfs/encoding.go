@@ -0,0 +1,344 @@
+package vfs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"maxiofs-agent/internal/storage"
+)
+
+// NameEncoding is a set of reversible substitutions applied to object keys so
+// every key can be shown as a valid local path. Like rclone, characters the
+// local filesystem rejects are replaced by look-alike Unicode characters, and
+// a look-alike that was already in the key is quoted with '‛' so it survives
+// the round trip.
+type NameEncoding uint32
+
+const (
+	// EncodeSlash shows "//" runs and a leading "/" as '／' at the start of a name
+	EncodeSlash NameEncoding = 1 << iota
+	EncodeColon
+	EncodeAsterisk
+	EncodeQuestion
+	EncodeDoubleQuote
+	EncodeLtGt
+	EncodePipe
+	EncodeBackSlash
+	// EncodeCtl replaces control characters with their Control Pictures (U+2400)
+	EncodeCtl
+	EncodeDel
+	// EncodeRightSpace and EncodeRightPeriod replace the last character of a
+	// name, which Windows strips, when it is a space or a period
+	EncodeRightSpace
+	EncodeRightPeriod
+	// EncodeDot replaces the names "." and ".."
+	EncodeDot
+	// EncodeDevice shows the names Windows reserves for devices, such as "CON"
+	// or "nul.txt", after a '‛'
+	EncodeDevice
+
+	// EncodeWindows is every encoding, the default
+	EncodeWindows = EncodeSlash | EncodeColon | EncodeAsterisk | EncodeQuestion | EncodeDoubleQuote |
+		EncodeLtGt | EncodePipe | EncodeBackSlash | EncodeCtl | EncodeDel | EncodeRightSpace |
+		EncodeRightPeriod | EncodeDot | EncodeDevice
+)
+
+var encodingNames = map[string]NameEncoding{
+	"none":        0,
+	"windows":     EncodeWindows,
+	"slash":       EncodeSlash,
+	"colon":       EncodeColon,
+	"asterisk":    EncodeAsterisk,
+	"question":    EncodeQuestion,
+	"doublequote": EncodeDoubleQuote,
+	"ltgt":        EncodeLtGt,
+	"pipe":        EncodePipe,
+	"backslash":   EncodeBackSlash,
+	"ctl":         EncodeCtl,
+	"del":         EncodeDel,
+	"rightspace":  EncodeRightSpace,
+	"rightperiod": EncodeRightPeriod,
+	"dot":         EncodeDot,
+	"device":      EncodeDevice,
+}
+
+const (
+	quoteRune    = '‛'
+	ctlPictures  = '␀'
+	spaceRune    = '␠'
+	delRune      = '␡'
+	periodRune   = '．'
+	slashRune    = '／'
+	fullwidthOff = '！' - '!' // Offset of the fullwidth forms of ASCII
+)
+
+// ParseNameEncoding parses a comma-separated list of encodings such as
+// "Colon,Question" (case-insensitive); empty selects EncodeWindows
+func ParseNameEncoding(s string) (NameEncoding, error) {
+	if strings.TrimSpace(s) == "" {
+		return EncodeWindows, nil
+	}
+	var e NameEncoding
+	for _, name := range strings.Split(s, ",") {
+		flag, ok := encodingNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return 0, fmt.Errorf("unknown filename encoding %q", name)
+		}
+		e |= flag
+	}
+	return e, nil
+}
+
+// fullwidth maps the characters replaced by their fullwidth form to their flag
+var fullwidth = map[rune]NameEncoding{
+	':':  EncodeColon,
+	'*':  EncodeAsterisk,
+	'?':  EncodeQuestion,
+	'"':  EncodeDoubleQuote,
+	'<':  EncodeLtGt,
+	'>':  EncodeLtGt,
+	'|':  EncodePipe,
+	'\\': EncodeBackSlash,
+}
+
+// encodeRune returns the replacement of c, the last character of its name
+// or not, and following only slashes or not
+func (e NameEncoding) encodeRune(c rune, last, leading bool) (rune, bool) {
+	switch {
+	case c == '/':
+		return slashRune, e&EncodeSlash != 0 && leading
+	case c < 0x20:
+		return ctlPictures + c, e&EncodeCtl != 0
+	case c == 0x7f:
+		return delRune, e&EncodeDel != 0
+	case c == ' ':
+		return spaceRune, e&EncodeRightSpace != 0 && last
+	case c == '.':
+		return periodRune, e&EncodeRightPeriod != 0 && last
+	}
+	if flag, ok := fullwidth[c]; ok && e&flag != 0 {
+		return c + fullwidthOff, true
+	}
+	return c, false
+}
+
+// decodeRune reverses encodeRune for a rune found unquoted at that position
+func (e NameEncoding) decodeRune(r rune, last, leading bool) (rune, bool) {
+	switch {
+	case r == slashRune:
+		return '/', e&EncodeSlash != 0 && leading
+	case r >= ctlPictures && r < ctlPictures+0x20:
+		return r - ctlPictures, e&EncodeCtl != 0
+	case r == delRune:
+		return 0x7f, e&EncodeDel != 0
+	case r == spaceRune:
+		return ' ', e&EncodeRightSpace != 0 && last
+	case r == periodRune:
+		return '.', e&EncodeRightPeriod != 0 && last
+	}
+	if flag, ok := fullwidth[r-fullwidthOff]; ok && e&flag != 0 {
+		return r - fullwidthOff, true
+	}
+	return r, false
+}
+
+// isReplacement reports whether r is produced by one of the encodings in e,
+// in which case a '‛' before it quotes it
+func (e NameEncoding) isReplacement(r rune) bool {
+	switch {
+	case r == periodRune:
+		return e&(EncodeRightPeriod|EncodeDot) != 0
+	case r == slashRune, r == spaceRune, r == delRune, r >= ctlPictures && r < ctlPictures+0x20:
+		_, ok := e.decodeRune(r, true, true)
+		return ok
+	}
+	flag, ok := fullwidth[r-fullwidthOff]
+	return ok && e&flag != 0
+}
+
+// encodeName encodes one name of a key
+func (e NameEncoding) encodeName(name string) string {
+	if e == 0 {
+		return name
+	}
+	if e&EncodeDot != 0 && (name == "." || name == "..") {
+		return strings.Repeat(string(periodRune), len(name))
+	}
+
+	in := []rune(name)
+	out := make([]rune, len(in))
+	quoted := make([]bool, len(in))
+	leading := true
+	for i, c := range in {
+		last := i == len(in)-1
+		if r, ok := e.encodeRune(c, last, leading); ok {
+			out[i] = r
+		} else {
+			out[i] = c
+			// A look-alike already in the key would be decoded here
+			_, quoted[i] = e.decodeRune(c, last, leading)
+		}
+		leading = leading && c == '/'
+	}
+	// A literal quote is itself quoted when the next rune could be quoted by it
+	for i := len(in) - 2; i >= 0; i-- {
+		if in[i] == quoteRune && (quoted[i+1] || out[i+1] == quoteRune || e.isReplacement(out[i+1])) {
+			quoted[i] = true
+		}
+	}
+	// Names that would read back as "." or ".."
+	if e&EncodeDot != 0 && (len(in) == 1 || len(in) == 2 && !quoted[1]) && !quoted[0] &&
+		strings.Trim(string(out), string(periodRune)) == "" {
+		quoted[0] = true
+	}
+
+	var b strings.Builder
+	// A device name, or a '‛' that would read back as the mark of one, gets
+	// a '‛' in front
+	if e&EncodeDevice != 0 && (isDeviceName(name) || len(in) > 0 && in[0] == quoteRune && isDeviceName(string(in[1:]))) {
+		b.WriteRune(quoteRune)
+	}
+	for i, r := range out {
+		if quoted[i] {
+			b.WriteRune(quoteRune)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// decodeName reverses encodeName
+func (e NameEncoding) decodeName(name string) string {
+	if e == 0 {
+		return name
+	}
+	if e&EncodeDot != 0 && (name == "．" || name == "．．") {
+		return strings.Repeat(".", utf8.RuneCountInString(name))
+	}
+	if rest, ok := strings.CutPrefix(name, string(quoteRune)); ok && e&EncodeDevice != 0 {
+		if device := e.decodeRunes(rest); isDeviceName(device) {
+			return device
+		}
+	}
+	return e.decodeRunes(name)
+}
+
+// decodeRunes reverses the substitutions and quotes of encodeName
+func (e NameEncoding) decodeRunes(name string) string {
+	in := []rune(name)
+	var b strings.Builder
+	leading := true
+	for i := 0; i < len(in); i++ {
+		r := in[i]
+		if r == quoteRune && i+1 < len(in) && (in[i+1] == quoteRune || e.isReplacement(in[i+1])) {
+			b.WriteRune(in[i+1])
+			i++
+			leading = false
+			continue
+		}
+		c, ok := e.decodeRune(r, i == len(in)-1, leading)
+		if !ok {
+			c = r
+		}
+		b.WriteRune(c)
+		leading = leading && ok && c == '/'
+	}
+	return b.String()
+}
+
+// isDeviceName reports whether Windows takes name for a device: the part
+// before its extension is one of the reserved names, in any case
+func isDeviceName(name string) bool {
+	stem, _, _ := strings.Cut(name, ".")
+	stem = strings.ToUpper(strings.TrimRight(stem, " "))
+	switch stem {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	return len(stem) == 4 && (strings.HasPrefix(stem, "COM") || strings.HasPrefix(stem, "LPT")) &&
+		stem[3] >= '1' && stem[3] <= '9'
+}
+
+// splitKey splits a key into the names of its path. With EncodeSlash, every
+// slash after the first of a run, and a leading slash, belong to the next name.
+func (e NameEncoding) splitKey(key string) []string {
+	if e&EncodeSlash == 0 {
+		return strings.Split(strings.TrimPrefix(key, "/"), "/")
+	}
+	var names []string
+	start := 0
+	for i := 1; i < len(key); i++ {
+		if key[i] == '/' && key[i-1] != '/' {
+			names = append(names, key[start:i])
+			start = i + 1
+		}
+	}
+	return append(names, key[start:])
+}
+
+// toPath returns the path an object key is shown at, false for keys that
+// cannot be shown (a "//" run at the end of a directory)
+func (e NameEncoding) toPath(key string) (string, bool) {
+	names := e.splitKey(key)
+	for i, name := range names {
+		if name == "" && e&EncodeSlash != 0 {
+			return "", false
+		}
+		names[i] = e.encodeName(name)
+	}
+	return strings.Join(names, "/"), true
+}
+
+// toKey returns the object key of a path
+func (e NameEncoding) toKey(p string) string {
+	if e == 0 {
+		return p
+	}
+	names := strings.Split(p, "/")
+	for i, name := range names {
+		names[i] = e.decodeName(name)
+	}
+	return strings.Join(names, "/")
+}
+
+// objectKey returns the key of the object at path p. Directory markers keep
+// their suffix, which is not part of the directory's name.
+func (fs *S3FS) objectKey(p string) string {
+	if dir, ok := markerDir(p); ok {
+		return fs.names.toKey(dir) + p[len(dir):]
+	}
+	return fs.names.toKey(p)
+}
+
+// objectPath returns the path the object key is shown at
+func (fs *S3FS) objectPath(key string) (string, bool) {
+	if dir, ok := markerDir(key); ok {
+		if dir == "" {
+			return key, true
+		}
+		p, ok := fs.names.toPath(dir)
+		return p + key[len(dir):], ok
+	}
+	return fs.names.toPath(key)
+}
+
+// listObjects lists the objects below the path prefix, keyed by their paths
+func (fs *S3FS) listObjects(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	objects, err := fs.s3Client.ListObjects(ctx, fs.bucketName, fs.objectKey(prefix))
+	if err != nil || fs.names == 0 {
+		return objects, err
+	}
+	shown := objects[:0]
+	for _, obj := range objects {
+		p, ok := fs.objectPath(obj.Key)
+		if !ok {
+			logger.Debug("list: skipping object without a valid path", "key", obj.Key)
+			continue
+		}
+		obj.Key = p
+		shown = append(shown, obj)
+	}
+	return shown, nil
+}
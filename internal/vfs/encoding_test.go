@@ -0,0 +1,125 @@
+package vfs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNameEncodingRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		encoded string
+	}{
+		{"reserved characters", `a:b*c?d"e<f>g|h\i`, "a：b＊c？d＂e＜f＞g｜h＼i"},
+		{"control characters", "ctl\x01\x1f", "ctl␁␟"},
+		{"delete", "del\x7f", "del␡"},
+		{"trailing period", "name.", "name．"},
+		{"trailing space", "name ", "name␠"},
+		{"inner period and space", "mid. dle", "mid. dle"},
+		{"dot", ".", "．"},
+		{"dot dot", "..", "．．"},
+		{"three dots", "...", "..．"},
+		{"device", "CON", "‛CON"},
+		{"device with extension", "nul.txt", "‛nul.txt"},
+		{"numbered device", "Com1.log", "‛Com1.log"},
+		{"device with trailing period", "CON.", "‛CON．"},
+		{"device before spaces", "aux .txt", "‛aux .txt"},
+		{"longer than a device", "CONSOLE", "CONSOLE"},
+		{"device number 0", "COM0", "COM0"},
+		{"look-alike", "a：b", "a‛：b"},
+		{"look-alike period", "．", "‛．"},
+		{"escape character", "a‛b", "a‛b"},
+		{"lone escape character", "‛", "‛"},
+		{"escape before look-alike", "‛：", "‛‛‛："},
+		{"escape before device", "‛CON", "‛‛CON"},
+		{"escapes before device", "‛‛CON", "‛‛‛CON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := EncodeWindows.encodeName(tt.key)
+			if encoded != tt.encoded {
+				t.Errorf("encodeName(%q) = %q, want %q", tt.key, encoded, tt.encoded)
+			}
+			if decoded := EncodeWindows.decodeName(encoded); decoded != tt.key {
+				t.Errorf("decodeName(%q) = %q, want %q", encoded, decoded, tt.key)
+			}
+		})
+	}
+}
+
+func TestKeyEncodingRoundTrip(t *testing.T) {
+	tests := []struct {
+		key  string
+		path string
+	}{
+		{"dir/file", "dir/file"},
+		{"dir//file", "dir/／file"},
+		{"/leading", "／leading"},
+		{"a/b:c", "a/b：c"},
+		{"CON/nul", "‛CON/‛nul"},
+	}
+	for _, tt := range tests {
+		p, ok := EncodeWindows.toPath(tt.key)
+		if !ok || p != tt.path {
+			t.Errorf("toPath(%q) = %q, %v, want %q", tt.key, p, ok, tt.path)
+		}
+		if key := EncodeWindows.toKey(p); key != tt.key {
+			t.Errorf("toKey(%q) = %q, want %q", p, key, tt.key)
+		}
+	}
+}
+
+// TestNameEncodingExhaustive encodes every short name made of characters that
+// interact with the encoding and checks that it reads back unchanged and is a
+// valid Windows name
+func TestNameEncodingExhaustive(t *testing.T) {
+	alphabet := []string{"a", ".", " ", ":", "：", "‛", "\x01", "␁", "．", "␠"}
+	names := []string{""}
+	for length := 1; length <= 4; length++ {
+		var longer []string
+		for _, name := range names {
+			if len([]rune(name)) != length-1 {
+				continue
+			}
+			for _, c := range alphabet {
+				longer = append(longer, name+c)
+			}
+		}
+		names = append(names, longer...)
+	}
+	for _, device := range []string{"CON", "nul", "Com1"} {
+		for _, prefix := range []string{"", "‛", "‛‛", "：", "‛："} {
+			for _, suffix := range []string{"", ".", " ", ".txt", "：", "‛"} {
+				names = append(names, prefix+device+suffix)
+			}
+		}
+	}
+
+	for _, e := range []NameEncoding{EncodeWindows, EncodeColon | EncodeDevice, EncodeRightPeriod | EncodeDot, EncodeCtl} {
+		for _, name := range names[1:] {
+			encoded := e.encodeName(name)
+			if decoded := e.decodeName(encoded); decoded != name {
+				t.Errorf("encoding %#x: %q encodes to %q, which decodes to %q", uint32(e), name, encoded, decoded)
+			}
+			if e == EncodeWindows && !validWindowsName(encoded) {
+				t.Errorf("%q encodes to %q, which Windows rejects", name, encoded)
+			}
+		}
+	}
+}
+
+func validWindowsName(name string) bool {
+	if name == "." || name == ".." || isDeviceName(name) {
+		return false
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return false
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(`:*?"<>|\/`, c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,264 @@
+package vfs
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"maxiofs-agent/internal/storage"
+)
+
+// fakeObject is an object stored by fakeS3
+type fakeObject struct {
+	data     []byte
+	metadata map[string]string
+	tags     map[string]string
+	etag     string
+	modified time.Time
+}
+
+// fakeS3 is an in-memory S3 server with the subset of the API the file system
+// uses outside multipart uploads, one bucket whatever the name
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	refuse  map[string]int // Requests still to refuse, by method and key ("PUT a/b")
+	url     string
+}
+
+// newFakeS3 starts a fake server that lives as long as the test
+func newFakeS3(t *testing.T) *fakeS3 {
+	f := &fakeS3{objects: make(map[string]*fakeObject), refuse: make(map[string]int)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	f.url = srv.URL
+	return f
+}
+
+// mount starts a file system on the server, in a fresh staging directory
+// unless opts names one
+func (f *fakeS3) mount(t *testing.T, opts Options) *S3FS {
+	t.Helper()
+	if opts.StagingDir == "" {
+		opts.StagingDir = t.TempDir()
+	}
+	client, err := storage.NewS3Client(strings.TrimPrefix(f.url, "http://"), "key", "secret", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewS3FS(client, "bucket", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fs.Shutdown)
+	return fs
+}
+
+// put stores an object and returns its ETag
+func (f *fakeS3) put(key, data string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.store(key, []byte(data), nil).etag
+}
+
+// get returns the content of an object
+func (f *fakeS3) get(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[key]
+	if !ok {
+		return "", false
+	}
+	return string(obj.data), true
+}
+
+// remove deletes an object
+func (f *fakeS3) remove(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, key)
+}
+
+// keys lists the stored keys in order
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// refuseNext makes the next n requests of method on key fail with AccessDenied,
+// which the SDK does not retry by itself
+func (f *fakeS3) refuseNext(method, key string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refuse[method+" "+key] = n
+}
+
+// store saves an object. Must be called with mu held.
+func (f *fakeS3) store(key string, data []byte, metadata map[string]string) *fakeObject {
+	sum := md5.Sum(data)
+	obj := &fakeObject{data: data, metadata: metadata, etag: `"` + hex.EncodeToString(sum[:]) + `"`, modified: time.Now()}
+	f.objects[key] = obj
+	return obj
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// requestMetadata returns the user metadata sent with a request
+func requestMetadata(r *http.Request) map[string]string {
+	metadata := make(map[string]string)
+	for name := range r.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-meta-") {
+			metadata[strings.TrimPrefix(lower, "x-amz-meta-")] = r.Header.Get(name)
+		}
+	}
+	return metadata
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	if n := f.refuse[r.Method+" "+key]; n > 0 {
+		f.refuse[r.Method+" "+key] = n - 1
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusForbidden)
+		} else {
+			writeError(w, http.StatusForbidden, "AccessDenied")
+		}
+		return
+	}
+	obj := f.objects[key]
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		f.list(w, query.Get("prefix"))
+
+	case r.Method == http.MethodHead:
+		if obj == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for name, value := range obj.metadata {
+			w.Header().Set("x-amz-meta-"+name, value)
+		}
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("Content-Length", fmt.Sprint(len(obj.data)))
+		w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+
+	case obj == nil && r.Method == http.MethodGet:
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+
+	case r.Method == http.MethodGet && query.Has("tagging"):
+		fmt.Fprint(w, "<Tagging><TagSet>")
+		for name, value := range obj.tags {
+			fmt.Fprintf(w, "<Tag><Key>%s</Key><Value>%s</Value></Tag>", name, value)
+		}
+		fmt.Fprint(w, "</TagSet></Tagging>")
+
+	case r.Method == http.MethodGet:
+		if etag := r.Header.Get("If-Match"); etag != "" && etag != obj.etag {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		data := obj.data
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, end := 0, len(data)-1
+			fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+			data = data[min(start, len(data)):min(end+1, len(data))]
+		}
+		w.Header().Set("ETag", obj.etag)
+		w.Write(data)
+
+	case r.Method == http.MethodPut && r.Header.Get("x-amz-copy-source") != "":
+		f.copy(w, r, key)
+
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		if r.Header.Get("If-None-Match") == "*" && obj != nil {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if etag := r.Header.Get("If-Match"); etag != "" && (obj == nil || obj.etag != etag) {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		w.Header().Set("ETag", f.store(key, data, requestMetadata(r)).etag)
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// list answers a ListObjectsV2 request in a single page
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		Size         int64
+		LastModified string
+		ETag         string
+	}
+	var result struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []content
+	}
+	for key, obj := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{key, int64(len(obj.data)), obj.modified.UTC().Format(time.RFC3339), obj.etag})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	xml.NewEncoder(w).Encode(result)
+}
+
+// copy answers a CopyObject request
+func (f *fakeS3) copy(w http.ResponseWriter, r *http.Request, key string) {
+	source, _ := url.PathUnescape(r.Header.Get("x-amz-copy-source"))
+	_, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	obj := f.objects[sourceKey]
+	if obj == nil {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if etag := r.Header.Get("x-amz-copy-source-if-match"); etag != "" && etag != obj.etag {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	metadata := obj.metadata
+	if r.Header.Get("x-amz-metadata-directive") == "REPLACE" {
+		metadata = requestMetadata(r)
+	}
+	copied := f.store(key, append([]byte(nil), obj.data...), metadata)
+	copied.tags = obj.tags
+	if r.Header.Get("x-amz-tagging-directive") == "REPLACE" {
+		values, _ := url.ParseQuery(r.Header.Get("x-amz-tagging"))
+		copied.tags = make(map[string]string, len(values))
+		for name := range values {
+			copied.tags[name] = values.Get(name)
+		}
+	}
+	fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", copied.etag)
+}
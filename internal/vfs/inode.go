@@ -0,0 +1,210 @@
+package vfs
+
+import (
+	"hash/fnv"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// rootIno is the inode number of the mount's root directory
+const rootIno = 1
+
+// inodeTable assigns inode numbers. The number of a file or directory is a
+// hash of its path, so it is the same on every mount without being stored.
+// A rename carries the number along: the new path keeps the identity (the
+// path hashed) of the old one, and the old path, should something be created
+// there again, takes a new identity so two files never share a number.
+// Renames are remembered for the lifetime of the mount; after a remount a
+// renamed file gets the number of its new path. Looking a number up records
+// nothing, the table only changes on rename and delete.
+type inodeTable struct {
+	mu      sync.Mutex
+	origins map[string]string // Renamed path → identity it brought along
+	taken   map[string]int    // Identities held by renamed paths
+	held    map[uint64]string // Inode numbers of the identities in taken
+}
+
+func newInodeTable() *inodeTable {
+	return &inodeTable{
+		origins: make(map[string]string),
+		taken:   make(map[string]int),
+		held:    make(map[uint64]string),
+	}
+}
+
+// ino returns the inode number of the file or directory at p
+func (t *inodeTable) ino(p string) uint64 {
+	if p == "" {
+		return rootIno
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := t.identity(p)
+	ino := hashIdentity(id)
+	// Two identities hashing alike must not share the number of a renamed file
+	for other, ok := t.held[ino]; ok && other != id; other, ok = t.held[ino] {
+		id += "\x00"
+		ino = hashIdentity(id)
+	}
+	return ino
+}
+
+func hashIdentity(id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	ino := h.Sum64()
+	if ino <= rootIno {
+		ino += rootIno + 1
+	}
+	return ino
+}
+
+// identity returns the string hashed into the inode number of p: the
+// identity of its directory followed by its name, unless it was renamed.
+// Must be called with mu held.
+func (t *inodeTable) identity(p string) string {
+	if len(t.origins) == 0 {
+		return p
+	}
+	if origin, ok := t.origins[p]; ok {
+		return origin
+	}
+	id := p
+	if dir, name := splitPath(p); dir != "" {
+		id = t.identity(dir) + "/" + name
+	}
+	// A path vacated by a rename, also one inside a renamed directory, is
+	// reborn while its identity is held, under a suffix no name has
+	if t.taken[id] > 0 {
+		id = p + "\x00"
+		for t.taken[id] > 0 {
+			id += "\x00"
+		}
+	}
+	return id
+}
+
+// move records that oldPath was renamed to newPath, replacing whatever was there
+func (t *inodeTable) move(oldPath, newPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := t.identity(oldPath)
+
+	t.forgetLocked(newPath)
+	released := []string{id}
+	for p, origin := range t.origins {
+		if isUnder(p, oldPath) {
+			released = append(released, origin)
+		}
+	}
+	reborn := t.rebornBy(released, oldPath, newPath)
+
+	moved := make(map[string]string)
+	for p, origin := range t.origins {
+		if !isUnder(p, oldPath) {
+			continue
+		}
+		if p != oldPath {
+			moved[renamedPath(p, oldPath, newPath)] = origin
+		}
+		t.release(p)
+	}
+	for p, origin := range moved {
+		t.hold(p, origin)
+	}
+	if t.identity(newPath) != id {
+		t.hold(newPath, id)
+	}
+	t.pin(reborn)
+}
+
+// forget drops the renames recorded at or below p once it is deleted
+func (t *inodeTable) forget(p string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.forgetLocked(p)
+}
+
+func (t *inodeTable) forgetLocked(p string) {
+	var released []string
+	for renamed, origin := range t.origins {
+		if isUnder(renamed, p) {
+			released = append(released, origin)
+		}
+	}
+	reborn := t.rebornBy(released, p)
+	for renamed := range t.origins {
+		if isUnder(renamed, p) {
+			t.release(renamed)
+		}
+	}
+	t.pin(reborn)
+}
+
+// rebornBy returns the identities of the paths, outside of the trees at
+// skip, that may have been reborn because one of ids is held
+func (t *inodeTable) rebornBy(ids []string, skip ...string) map[string]string {
+	reborn := make(map[string]string)
+	for _, id := range ids {
+		for _, p := range t.paths(id) {
+			if _, renamed := t.origins[p]; renamed || slices.ContainsFunc(skip, func(dir string) bool { return isUnder(p, dir) }) {
+				continue
+			}
+			reborn[p] = t.identity(p)
+		}
+	}
+	return reborn
+}
+
+// pin records the identities returned by rebornBy that changed since, as
+// something may have been created at those paths meanwhile
+func (t *inodeTable) pin(reborn map[string]string) {
+	// Directories first, their contents derive from them
+	paths := slices.Collect(maps.Keys(reborn))
+	slices.SortFunc(paths, func(a, b string) int { return len(a) - len(b) })
+	for _, p := range paths {
+		if id := reborn[p]; t.identity(p) != id {
+			t.hold(p, id)
+		}
+	}
+}
+
+// paths returns the paths whose identity may be id: the ones renamed with
+// it, and the one it derives from otherwise
+func (t *inodeTable) paths(id string) []string {
+	var paths []string
+	for p, origin := range t.origins {
+		if origin == id {
+			paths = append(paths, p)
+		}
+	}
+	if trimmed := strings.TrimRight(id, "\x00"); trimmed != id {
+		return append(paths, trimmed)
+	}
+	dir, name := splitPath(id)
+	if dir == "" {
+		return append(paths, id)
+	}
+	for _, p := range t.paths(dir) {
+		paths = append(paths, p+"/"+name)
+	}
+	return paths
+}
+
+func (t *inodeTable) hold(p, origin string) {
+	t.origins[p] = origin
+	if t.taken[origin]++; t.taken[origin] == 1 {
+		t.held[hashIdentity(origin)] = origin
+	}
+}
+
+func (t *inodeTable) release(p string) {
+	origin := t.origins[p]
+	delete(t.origins, p)
+	if t.taken[origin]--; t.taken[origin] <= 0 {
+		delete(t.taken, origin)
+		delete(t.held, hashIdentity(origin))
+	}
+}
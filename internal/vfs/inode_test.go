@@ -0,0 +1,163 @@
+package vfs
+
+import "testing"
+
+func TestInodeNumbers(t *testing.T) {
+	inodes := newInodeTable()
+	if ino := inodes.ino(""); ino != rootIno {
+		t.Errorf("root inode = %d, want %d", ino, rootIno)
+	}
+	a, b := inodes.ino("a"), inodes.ino("dir/a")
+	if a == b || a <= rootIno || b <= rootIno {
+		t.Errorf("inodes of a and dir/a = %d and %d", a, b)
+	}
+	// Derived from the path alone, so another mount agrees
+	if other := newInodeTable(); other.ino("dir/a") != b {
+		t.Error("inode differs between tables")
+	}
+}
+
+func TestInodeMoveAndForget(t *testing.T) {
+	// Each step either changes the table or checks the inode of a path against
+	// the one saved under a label
+	type step struct {
+		op   string // "save", "move", "forget", "same", "new" or "recorded"
+		p, q string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"renamed file keeps its inode", []step{
+			{"save", "a", "A"},
+			{"move", "a", "b"},
+			{"same", "b", "A"},
+			{"new", "a", "A"},
+		}},
+		{"renamed twice", []step{
+			{"save", "a", "A"},
+			{"move", "a", "b"},
+			{"move", "b", "c"},
+			{"same", "c", "A"},
+			{"new", "b", "A"},
+		}},
+		{"children of a renamed directory", []step{
+			{"save", "d/x", "X"},
+			{"save", "d/sub/y", "Y"},
+			{"move", "d", "e"},
+			{"same", "e/x", "X"},
+			{"same", "e/sub/y", "Y"},
+			{"new", "d/x", "X"},
+		}},
+		{"file renamed out of a renamed directory", []step{
+			{"save", "d/x", "X"},
+			{"move", "d", "e"},
+			{"move", "e/x", "x"},
+			{"same", "x", "X"},
+			{"new", "e/x", "X"},
+		}},
+		{"swap through a temporary name", []step{
+			{"save", "a", "A"},
+			{"save", "b", "B"},
+			{"move", "a", "tmp"},
+			{"move", "b", "a"},
+			{"move", "tmp", "b"},
+			{"same", "a", "B"},
+			{"same", "b", "A"},
+		}},
+		{"rename over an existing file", []step{
+			{"save", "a", "A"},
+			{"save", "b", "B"},
+			{"move", "a", "b"},
+			{"same", "b", "A"},
+			{"new", "b", "B"},
+		}},
+		{"vacated path stays reborn after the renamed file is deleted", []step{
+			{"save", "a", "A"},
+			{"move", "a", "b"},
+			{"save", "a", "A2"},
+			{"forget", "b", ""},
+			{"same", "a", "A2"},
+			{"save", "b", "B"},
+			{"new", "b", "A"},
+		}},
+		{"file created at a vacated path keeps its inode", []step{
+			{"save", "a", "A"},
+			{"move", "a", "b"},
+			{"save", "a", "A2"},
+			{"forget", "b", ""},
+			{"same", "a", "A2"},
+			{"new", "a", "A"},
+		}},
+		{"deleting a renamed directory", []step{
+			{"save", "d/x", "X"},
+			{"move", "d", "e"},
+			{"save", "d/x", "X2"},
+			{"forget", "e", ""},
+			{"same", "d/x", "X2"},
+			{"new", "d/x", "X"},
+		}},
+		{"deleting the file at a vacated path", []step{
+			{"save", "a", "A"},
+			{"move", "a", "b"},
+			{"forget", "a", ""},
+			{"forget", "b", ""},
+			{"save", "c", "C"},
+			{"move", "c", "a"},
+			{"same", "a", "C"},
+		}},
+		{"looking numbers up records nothing", []step{
+			{"save", "a", "A"},
+			{"move", "a", "b"},
+			{"save", "a", "A2"},
+			{"save", "d/x", "X"},
+			{"same", "a", "A2"},
+			{"recorded", "", ""},
+		}},
+		{"deleting a sibling changes nothing", []step{
+			{"save", "a", "A"},
+			{"move", "a", "b"},
+			{"forget", "c", ""},
+			{"forget", "bb", ""},
+			{"same", "b", "A"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inodes := newInodeTable()
+			saved := make(map[string]uint64)
+			for i, s := range tt.steps {
+				switch s.op {
+				case "save":
+					saved[s.q] = inodes.ino(s.p)
+				case "move":
+					inodes.move(s.p, s.q)
+				case "forget":
+					inodes.forget(s.p)
+				case "same":
+					if ino := inodes.ino(s.p); ino != saved[s.q] {
+						t.Errorf("step %d: inode of %s = %d, want %s's %d", i, s.p, ino, s.q, saved[s.q])
+					}
+				case "new":
+					if ino := inodes.ino(s.p); ino == saved[s.q] {
+						t.Errorf("step %d: %s still has %s's inode %d", i, s.p, s.q, ino)
+					}
+				case "recorded":
+					// Only the rename is recorded
+					if len(inodes.origins) != 1 {
+						t.Errorf("step %d: table holds %v", i, inodes.origins)
+					}
+				}
+			}
+			// Inodes in use are never shared
+			seen := make(map[uint64]string)
+			for _, p := range []string{"a", "b", "c", "tmp", "x", "d/x", "d/sub/y", "e/x", "e/sub/y"} {
+				ino := inodes.ino(p)
+				if other, ok := seen[ino]; ok {
+					t.Errorf("%s and %s share inode %d", p, other, ino)
+				}
+				seen[ino] = p
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+package vfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"maxiofs-agent/internal/storage"
+)
+
+const (
+	journalExt = ".json"
+	// journalDelay is how long after a write its state is journaled, so a
+	// burst of writes costs one journal update
+	journalDelay = 2 * time.Second
+)
+
+// errConflict means the object changed in the bucket after the staged copy was based on it
+var errConflict = errors.New("object changed in the bucket since it was opened")
+
+// journalEntry is the persisted state of a dirty staging file. It is written
+// next to the staging file shortly after the file changes, when a handle is
+// flushed or released, and when the upload state changes, so the upload can be
+// replayed after a crash or restart.
+type journalEntry struct {
+	Path      string      `json:"path"`
+	Staging   string      `json:"staging"` // Staging file name within the staging directory
+	BaseETag  string      `json:"base_etag,omitempty"`
+	BaseSize  int64       `json:"base_size"`
+	Size      int64       `json:"size"`
+	Created   bool        `json:"created,omitempty"`
+	Present   intervalSet `json:"present,omitempty"`
+	Modified  intervalSet `json:"modified,omitempty"`
+	Error     string      `json:"error,omitempty"` // Last upload failure
+	Caller    auditCaller `json:"caller"`          // Process the upload is audited for
+	UpdatedAt time.Time   `json:"updated_at"`
+
+	queued   bool               // Waiting in or running through the upload queue
+	inFlight bool               // Being uploaded
+	of       *OpenFile          // Staged file to upload, nil until a replayed entry is checked
+	prev     *journalEntry      // Earlier queued upload of the same path
+	done     chan struct{}      // Closed when the entry leaves the queue
+	ctx      context.Context    // Cancelled on unmount or when the upload is discarded
+	cancel   context.CancelFunc // Cancels ctx
+}
+
+// PendingUpload describes a change that has not reached the bucket yet
+type PendingUpload struct {
+	Bucket  string
+	Path    string
+	Size    int64
+	State   string // "open", "pending", "uploading" or "failed"
+	Error   string
+	Updated time.Time
+}
+
+// Pending upload states
+const (
+	UploadOpen    = "open"
+	UploadPending = "pending"
+	UploadActive  = "uploading"
+	UploadFailed  = "failed"
+)
+
+func journalPath(stagingFile string) string {
+	return stagingFile + journalExt
+}
+
+// journalSoon persists the state of a dirty open file within journalDelay.
+// Must be called with stageMu held.
+func (fs *S3FS) journalSoon(of *OpenFile) {
+	if of.journalTimer != nil {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(journalDelay, func() {
+		of.stageMu.Lock()
+		defer of.stageMu.Unlock()
+		// Journaled or discarded meanwhile
+		if of.journalTimer == timer {
+			fs.journalLocked(of)
+		}
+	})
+	of.journalTimer = timer
+}
+
+// stopJournalTimer cancels a pending journalSoon. Must be called with stageMu held.
+func (of *OpenFile) stopJournalTimer() {
+	if of.journalTimer != nil {
+		of.journalTimer.Stop()
+		of.journalTimer = nil
+	}
+}
+
+// journalPending journals the open files whose latest changes are not journaled yet
+func (fs *S3FS) journalPending() {
+	fs.mu.RLock()
+	nodes := make([]*OpenFile, 0, len(fs.nodes))
+	for _, node := range fs.nodes {
+		nodes = append(nodes, node)
+	}
+	fs.mu.RUnlock()
+	for _, node := range nodes {
+		node.stageMu.Lock()
+		if node.journalTimer != nil {
+			fs.journalLocked(node)
+		}
+		node.stageMu.Unlock()
+	}
+}
+
+// journalLocked persists the state of a dirty open file. Must be called with stageMu held.
+func (fs *S3FS) journalLocked(of *OpenFile) {
+	of.stopJournalTimer()
+	fs.mu.RLock()
+	if of.removed {
+		// Unlinked while open, nothing to replay
+		fs.mu.RUnlock()
+		return
+	}
+	entry := journalEntry{
+		Path:     of.Path,
+		Staging:  filepath.Base(of.TempFile),
+		BaseETag: of.Base.ETag,
+		BaseSize: of.BaseSize,
+		Size:     of.Size,
+		Created:  of.Created,
+		Present:  of.present,
+		Modified: of.modified,
+		Caller:   of.writer,
+	}
+	fs.mu.RUnlock()
+	if of.uploadErr != nil {
+		entry.Error = of.uploadErr.Error()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if string(data) == string(of.journaled) {
+		return
+	}
+	// The timestamp is left out of the comparison so repeated flushes of the
+	// same changes do not rewrite the journal
+	entry.UpdatedAt = time.Now()
+	stamped, _ := json.Marshal(entry)
+	// The journal must not outlive the data it describes
+	if err := syncFile(of.TempFile); err != nil {
+		logger.Warn("journal: cannot sync staged file", "path", of.Path, "error", err)
+		return
+	}
+	if err := writeJournalFile(journalPath(of.TempFile), stamped); err != nil {
+		logger.Warn("journal: cannot record staged file", "path", of.Path, "error", err)
+		return
+	}
+	of.journaled = data
+}
+
+// unjournalLocked removes the journal of an open file that is clean again.
+// Must be called with stageMu held.
+func (of *OpenFile) unjournalLocked() {
+	of.stopJournalTimer()
+	if of.journaled != nil {
+		os.Remove(journalPath(of.TempFile))
+		of.journaled = nil
+	}
+}
+
+// writeJournalFile replaces a journal file. The new content is synced before
+// it takes the old one's place, so a crash leaves one or the other.
+func writeJournalFile(path string, data []byte) error {
+	tmp := path + ".new"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// loadJournal reads the journal entries left in a staging directory. Journals
+// whose staging file is gone are removed.
+func loadJournal(dir string) map[string]*journalEntry {
+	entries := make(map[string]*journalEntry)
+	paths, _ := filepath.Glob(filepath.Join(dir, stagingPattern+journalExt))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		var entry journalEntry
+		if err == nil {
+			err = json.Unmarshal(data, &entry)
+		}
+		staging := strings.TrimSuffix(path, journalExt)
+		if err == nil && (entry.Staging != filepath.Base(staging) || entry.Path == "") {
+			err = fmt.Errorf("journal does not match its staging file")
+		}
+		if err == nil {
+			if info, statErr := os.Lstat(staging); statErr != nil || !info.Mode().IsRegular() {
+				err = fmt.Errorf("staging file is missing")
+			}
+		}
+		if err != nil {
+			logger.Warn("journal: discarding unusable entry", "journal", path, "error", err)
+			os.Remove(path)
+			continue
+		}
+		entries[staging] = &entry
+	}
+	// Interrupted journal writes
+	partial, _ := filepath.Glob(filepath.Join(dir, stagingPattern+journalExt+".new"))
+	for _, path := range partial {
+		os.Remove(path)
+	}
+	return entries
+}
+
+// replayJournal queues the staged files left by a previous run, oldest first
+// so several versions of the same path are uploaded in order
+func (fs *S3FS) replayJournal() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	stagings := make([]string, 0, len(fs.pending))
+	for staging, entry := range fs.pending {
+		if entry.Error == "" {
+			stagings = append(stagings, staging)
+		}
+	}
+	sort.Slice(stagings, func(i, j int) bool {
+		return fs.pending[stagings[i]].UpdatedAt.Before(fs.pending[stagings[j]].UpdatedAt)
+	})
+	for _, staging := range stagings {
+		logger.Info("journal: replaying pending upload", "path", fs.pending[staging].Path, "size", fs.pending[staging].Size)
+		fs.queueLocked(staging, fs.pending[staging])
+	}
+}
+
+// checkJournaled rebuilds the staged file of a journal entry left by a
+// previous run, unless the object changed in the bucket since the staged copy
+// was based on it
+func (fs *S3FS) checkJournaled(ctx context.Context, staging string, entry *journalEntry) (*OpenFile, error) {
+	current, err := fs.s3Client.HeadObject(ctx, fs.bucketName, fs.objectKey(entry.Path))
+	switch {
+	case err == nil:
+		switch {
+		case entry.BaseETag != "":
+			if current.ETag != entry.BaseETag {
+				return nil, errConflict
+			}
+		case entry.Created:
+			// Created here, and meanwhile by someone else
+			return nil, errConflict
+		default:
+			// Opened with O_TRUNC, which does not look up the object: like
+			// the upload of a live handle, it replaces whatever is there
+		}
+	case storage.IsNotFound(err):
+		if entry.BaseETag != "" {
+			return nil, errConflict
+		}
+	default:
+		return nil, err
+	}
+
+	of := &OpenFile{
+		Path:     entry.Path,
+		TempFile: staging,
+		Size:     entry.Size,
+		Created:  entry.Created,
+		BaseSize: entry.BaseSize,
+		present:  entry.Present,
+		modified: entry.Modified,
+		writer:   entry.Caller,
+	}
+	if entry.BaseETag != "" {
+		of.Base = storage.ObjectInfo{Key: entry.Path, Size: current.Size, ETag: entry.BaseETag}
+	}
+	return of, nil
+}
+
+// entryFor describes the staged state of of. Must be called with stageMu held.
+func entryFor(of *OpenFile) *journalEntry {
+	entry := &journalEntry{
+		Path:      of.Path,
+		Staging:   filepath.Base(of.TempFile),
+		BaseETag:  of.Base.ETag,
+		BaseSize:  of.BaseSize,
+		Size:      of.Size,
+		Created:   of.Created,
+		Present:   of.present,
+		Modified:  of.modified,
+		Caller:    of.writer,
+		UpdatedAt: time.Now(),
+	}
+	if of.uploadErr != nil {
+		entry.Error = of.uploadErr.Error()
+	}
+	return entry
+}
+
+// PendingUploads lists the changes of this mount that are not in the bucket yet
+func (fs *S3FS) PendingUploads() []PendingUpload {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	var uploads []PendingUpload
+	for _, of := range fs.nodes {
+		if of.Dirty {
+			uploads = append(uploads, PendingUpload{Bucket: fs.bucketName, Path: of.Path, Size: of.Size, State: UploadOpen})
+		}
+	}
+	for _, entry := range fs.pending {
+		state := UploadPending
+		switch {
+		case entry.Error != "":
+			state = UploadFailed
+		case entry.inFlight:
+			state = UploadActive
+		}
+		uploads = append(uploads, PendingUpload{
+			Bucket:  fs.bucketName,
+			Path:    entry.Path,
+			Size:    entry.Size,
+			State:   state,
+			Error:   entry.Error,
+			Updated: entry.UpdatedAt,
+		})
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].Path < uploads[j].Path })
+	return uploads
+}
+
+// RetryFailedUploads queues the failed uploads of this mount again
+func (fs *S3FS) RetryFailedUploads() {
+	fs.mu.Lock()
+	for staging, entry := range fs.pending {
+		if entry.Error != "" {
+			fs.queueLocked(staging, entry)
+		}
+	}
+	fs.mu.Unlock()
+	// List the local versions again
+	fs.tree.invalidate()
+}
+
+// DiscardFailedUploads deletes the staged copies of uploads that failed
+func (fs *S3FS) DiscardFailedUploads() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for staging, entry := range fs.pending {
+		if entry.Error == "" || entry.queued {
+			continue
+		}
+		logger.Warn("journal: discarding failed upload", "path", entry.Path, "error", entry.Error)
+		os.Remove(journalPath(staging))
+		os.Remove(staging)
+		delete(fs.pending, staging)
+	}
+}
@@ -0,0 +1,105 @@
+package vfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stageJournaled leaves a staging file holding data, and its journal, in dir
+// as a previous run would have
+func stageJournaled(t *testing.T, dir string, entry journalEntry, data string) string {
+	t.Helper()
+	staging := filepath.Join(dir, "staged-test.tmp")
+	entry.Staging = filepath.Base(staging)
+	entry.Size = int64(len(data))
+	journal, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(staging, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(journalPath(staging), journal, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return staging
+}
+
+func TestCheckJournaled(t *testing.T) {
+	tests := []struct {
+		name     string
+		bucket   string // Content of the object now, "" if there is none
+		base     string // Content the staged copy was based on, "" if none
+		created  bool
+		conflict bool
+	}{
+		{"object unchanged", "old", "old", false, false},
+		{"object changed", "theirs", "old", false, true},
+		{"object deleted", "", "old", false, true},
+		{"created here", "", "", true, false},
+		{"created here and elsewhere", "theirs", "", true, true},
+		{"truncated without a lookup", "theirs", "", false, false},
+		{"truncated, then deleted", "", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeS3(t)
+			fs := f.mount(t, Options{})
+			entry := &journalEntry{Path: "a", Created: tt.created, Size: 3}
+			if tt.base != "" {
+				entry.BaseETag = f.put("a", tt.base)
+			}
+			if tt.bucket != "" {
+				f.put("a", tt.bucket)
+			} else {
+				f.remove("a")
+			}
+			staging := filepath.Join(fs.stagingDir, "staged-test.tmp")
+
+			of, err := fs.checkJournaled(context.Background(), staging, entry)
+			if tt.conflict {
+				if !errors.Is(err, errConflict) {
+					t.Fatalf("checkJournaled() error = %v, want a conflict", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkJournaled() error = %v", err)
+			}
+			if of.Path != "a" || of.TempFile != staging || of.Size != 3 || of.Created != tt.created {
+				t.Errorf("rebuilt %+v from %+v", of, entry)
+			}
+			if of.Base.ETag != entry.BaseETag {
+				t.Errorf("base version = %q, want %q", of.Base.ETag, entry.BaseETag)
+			}
+		})
+	}
+}
+
+func TestLoadJournal(t *testing.T) {
+	dir := t.TempDir()
+	staging := stageJournaled(t, dir, journalEntry{Path: "a"}, "new")
+
+	// Journals of a missing staging file, of another staging file or
+	// half-written are discarded
+	orphan := filepath.Join(dir, "staged-orphan.tmp")
+	os.WriteFile(journalPath(orphan), []byte(`{"path":"b","staging":"staged-orphan.tmp"}`), 0600)
+	mismatched := filepath.Join(dir, "staged-other.tmp")
+	os.WriteFile(mismatched, nil, 0600)
+	os.WriteFile(journalPath(mismatched), []byte(`{"path":"c","staging":"staged-test.tmp"}`), 0600)
+	os.WriteFile(journalPath(staging)+".new", []byte(`{`), 0600)
+
+	entries := loadJournal(dir)
+	if len(entries) != 1 || entries[staging] == nil || entries[staging].Path != "a" {
+		t.Fatalf("loaded %v, want the entry of %s", entries, staging)
+	}
+	for _, path := range []string{journalPath(orphan), journalPath(mismatched), journalPath(staging) + ".new"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s kept", filepath.Base(path))
+		}
+	}
+}
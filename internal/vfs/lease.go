@@ -0,0 +1,222 @@
+package vfs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"maxiofs-agent/internal/storage"
+)
+
+const (
+	leasePrefix     = ".maxiofs-locks/" // Hidden from listings
+	defaultLeaseTTL = 2 * time.Minute
+)
+
+// leaseRecord is the content of a lease object
+type leaseRecord struct {
+	Owner   string    `json:"owner"` // Who is editing, shown to other users
+	Agent   string    `json:"agent"` // Agent instance holding the lease
+	Expires time.Time `json:"expires"`
+}
+
+// leaseManager keeps cooperative cross-machine locks on files being edited.
+// A lease object is created under leasePrefix when a file is first opened for
+// writing and renewed until its changes are uploaded. An agent that finds an
+// unexpired lease of another agent warns its user instead of taking it.
+type leaseManager struct {
+	owner      string
+	agent      string
+	ttl        time.Duration
+	onConflict func(path, holder string)
+
+	mu   sync.Mutex
+	held map[string]*heldLease
+}
+
+type heldLease struct {
+	etag string
+	stop context.CancelFunc
+}
+
+func newLeaseManager(owner string, ttl time.Duration, onConflict func(path, holder string)) *leaseManager {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &leaseManager{
+		owner:      owner,
+		agent:      hex.EncodeToString(id),
+		ttl:        ttl,
+		onConflict: onConflict,
+		held:       make(map[string]*heldLease),
+	}
+}
+
+func (m *leaseManager) record() []byte {
+	data, _ := json.Marshal(leaseRecord{Owner: m.owner, Agent: m.agent, Expires: time.Now().Add(m.ttl)})
+	return data
+}
+
+// acquireLease takes the lease of a file opened for writing, or warns when
+// another agent holds it
+func (fs *S3FS) acquireLease(path string) {
+	m := fs.leases
+	m.mu.Lock()
+	_, held := m.held[path]
+	m.mu.Unlock()
+	if held {
+		return
+	}
+
+	ctx, cancel := fs.metadataContext()
+	defer cancel()
+	etag, holder, err := fs.claimLease(ctx, path)
+	if err != nil {
+		logger.Warn("lease: cannot take lease", "path", path, "error", err)
+		return
+	}
+	if holder != "" {
+		logger.Warn("lease: file is being edited elsewhere", "path", path, "holder", holder)
+		if m.onConflict != nil {
+			m.onConflict(path, holder)
+		}
+		return
+	}
+
+	renewCtx, stop := context.WithCancel(fs.rootCtx)
+	m.mu.Lock()
+	m.held[path] = &heldLease{etag: etag, stop: stop}
+	m.mu.Unlock()
+	logger.Debug("lease: taken", "path", path)
+	go fs.renewLease(renewCtx, path)
+
+	// The file may have been closed while the lease was being taken
+	fs.releaseLease(path)
+}
+
+// claimLease writes our lease record for path unless another agent holds an
+// unexpired lease; its owner is returned then
+func (fs *S3FS) claimLease(ctx context.Context, path string) (string, string, error) {
+	key := leasePrefix + fs.objectKey(path)
+	data := fs.leases.record()
+	etag, err := fs.s3Client.CreateObjectExclusive(ctx, fs.bucketName, key, data)
+	if !storage.IsPreconditionFailed(err) {
+		return etag, "", err
+	}
+
+	current, err := fs.s3Client.HeadObject(ctx, fs.bucketName, key)
+	if err != nil {
+		return "", "", err
+	}
+	raw, err := fs.s3Client.GetObjectRange(ctx, fs.bucketName, key, current.ETag, 0, max(current.Size, 1))
+	if err != nil && !storage.IsPreconditionFailed(err) {
+		return "", "", err
+	}
+	var record leaseRecord
+	if err == nil && json.Unmarshal(raw, &record) == nil &&
+		record.Agent != fs.leases.agent && time.Now().Before(record.Expires) {
+		return "", record.Owner, nil
+	}
+
+	// Expired, unreadable or left by this agent: take it over
+	etag, err = fs.s3Client.ReplaceObject(ctx, fs.bucketName, key, data, current.ETag)
+	if storage.IsPreconditionFailed(err) {
+		return "", "another agent", nil
+	}
+	return etag, "", err
+}
+
+// renewLease extends a held lease until it is released
+func (fs *S3FS) renewLease(ctx context.Context, path string) {
+	m := fs.leases
+	key := leasePrefix + fs.objectKey(path)
+	ticker := time.NewTicker(m.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		m.mu.Lock()
+		held := m.held[path]
+		var current string
+		if held != nil {
+			current = held.etag
+		}
+		m.mu.Unlock()
+		if held == nil {
+			return
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, fs.metadataTimeout)
+		etag, err := fs.s3Client.ReplaceObject(reqCtx, fs.bucketName, key, m.record(), current)
+		cancel()
+		switch {
+		case storage.IsPreconditionFailed(err):
+			// Expired while we could not renew it, and taken over
+			logger.Warn("lease: lost", "path", path)
+			m.mu.Lock()
+			delete(m.held, path)
+			m.mu.Unlock()
+			if m.onConflict != nil {
+				m.onConflict(path, "another agent")
+			}
+			return
+		case err != nil:
+			if ctx.Err() == nil {
+				logger.Warn("lease: cannot renew", "path", path, "error", err)
+			}
+		default:
+			m.mu.Lock()
+			held.etag = etag
+			m.mu.Unlock()
+		}
+	}
+}
+
+// releaseLease deletes the lease of path once it is neither open for writing
+// nor waiting to be uploaded
+func (fs *S3FS) releaseLease(path string) {
+	m := fs.leases
+	if m == nil {
+		return
+	}
+	fs.mu.RLock()
+	_, open := fs.nodes[path]
+	_, queued := fs.uploads.latest[path]
+	fs.mu.RUnlock()
+	if open || queued {
+		return
+	}
+
+	m.mu.Lock()
+	held := m.held[path]
+	delete(m.held, path)
+	var etag string
+	if held != nil {
+		etag = held.etag
+	}
+	m.mu.Unlock()
+	if held == nil {
+		return
+	}
+	held.stop()
+
+	ctx, cancel := fs.metadataContext()
+	defer cancel()
+	key := leasePrefix + fs.objectKey(path)
+	// Only delete our own record
+	current, err := fs.s3Client.HeadObject(ctx, fs.bucketName, key)
+	if err == nil && current.ETag == etag {
+		err = fs.s3Client.DeleteObject(ctx, fs.bucketName, key)
+	}
+	if err != nil && !storage.IsNotFound(err) {
+		logger.Warn("lease: cannot release", "path", path, "error", err)
+		return
+	}
+	logger.Debug("lease: released", "path", path)
+}
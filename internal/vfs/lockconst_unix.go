@@ -0,0 +1,16 @@
+//go:build !windows
+
+package vfs
+
+import "syscall"
+
+// fcntl lock commands and types as passed by the FUSE host
+const (
+	lockGet     = syscall.F_GETLK
+	lockSet     = syscall.F_SETLK
+	lockSetWait = syscall.F_SETLKW
+	lockRead    = syscall.F_RDLCK
+	lockWrite   = syscall.F_WRLCK
+	lockUnlock  = syscall.F_UNLCK
+	seekSet     = 0
+)
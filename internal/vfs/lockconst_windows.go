@@ -0,0 +1,12 @@
+package vfs
+
+// fcntl lock commands and types as passed by the FUSE host (Cygwin values)
+const (
+	lockGet     = 7
+	lockSet     = 8
+	lockSetWait = 9
+	lockRead    = 1
+	lockUnlock  = 2
+	lockWrite   = 3
+	seekSet     = 0
+)
@@ -0,0 +1,234 @@
+package vfs
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"maxiofs-agent/internal/cgofuse"
+)
+
+// byteLock is a byte-range lock on [start, end) held by the handle owner
+type byteLock struct {
+	owner uint64
+	pid   int
+	start int64
+	end   int64 // math.MaxInt64 when the lock extends to end of file and beyond
+	write bool
+}
+
+func (l byteLock) overlaps(start, end int64) bool {
+	return l.start < end && start < l.end
+}
+
+// lockTable holds the POSIX byte-range locks taken through the mount. Locks
+// are owned by the file handle that took them, like Linux open file
+// description locks, and are dropped when that handle is released.
+type lockTable struct {
+	mu      sync.Mutex
+	changed *sync.Cond // Broadcast whenever a lock is removed
+	locks   map[string][]byteLock
+}
+
+func newLockTable() *lockTable {
+	t := &lockTable{locks: make(map[string][]byteLock)}
+	t.changed = sync.NewCond(&t.mu)
+	return t
+}
+
+// conflictLocked returns a lock of another owner that excludes l. Must be called with mu held.
+func (t *lockTable) conflictLocked(path string, l byteLock) (byteLock, bool) {
+	for _, held := range t.locks[path] {
+		if held.owner != l.owner && held.overlaps(l.start, l.end) && (held.write || l.write) {
+			return held, true
+		}
+	}
+	return byteLock{}, false
+}
+
+// setLocked replaces whatever the owner of l holds on its range with l, or
+// only releases the range when unlock is set. Must be called with mu held.
+func (t *lockTable) setLocked(path string, l byteLock, unlock bool) {
+	var out []byteLock
+	removed := false
+	for _, held := range t.locks[path] {
+		if held.owner != l.owner || !held.overlaps(l.start, l.end) {
+			out = append(out, held)
+			continue
+		}
+		removed = true
+		// Keep the parts outside the new range
+		if held.start < l.start {
+			before := held
+			before.end = l.start
+			out = append(out, before)
+		}
+		if held.end > l.end {
+			after := held
+			after.start = l.end
+			out = append(out, after)
+		}
+	}
+
+	if !unlock {
+		// Merge with adjacent locks of the same owner and kind
+		merged := out[:0]
+		for _, held := range out {
+			if held.owner == l.owner && held.write == l.write && held.start <= l.end && l.start <= held.end {
+				l.start = min(l.start, held.start)
+				l.end = max(l.end, held.end)
+				continue
+			}
+			merged = append(merged, held)
+		}
+		out = append(merged, l)
+	}
+
+	if len(out) == 0 {
+		delete(t.locks, path)
+	} else {
+		t.locks[path] = out
+	}
+	if removed || unlock {
+		t.changed.Broadcast()
+	}
+}
+
+// wait takes l, waiting for conflicting locks to go away
+func (t *lockTable) wait(ctx context.Context, path string, l byteLock) error {
+	stop := context.AfterFunc(ctx, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.changed.Broadcast()
+	})
+	defer stop()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		if _, busy := t.conflictLocked(path, l); !busy {
+			t.setLocked(path, l, false)
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		t.changed.Wait()
+	}
+}
+
+// releaseOwner drops every lock held by a handle
+func (t *lockTable) releaseOwner(owner uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	removed := false
+	for path, locks := range t.locks {
+		kept := locks[:0]
+		for _, held := range locks {
+			if held.owner == owner {
+				removed = true
+				continue
+			}
+			kept = append(kept, held)
+		}
+		if len(kept) == 0 {
+			delete(t.locks, path)
+		} else {
+			t.locks[path] = kept
+		}
+	}
+	if removed {
+		t.changed.Broadcast()
+	}
+}
+
+// move re-keys the locks of oldPath, and of everything below it, to newPath
+func (t *lockTable) move(oldPath, newPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for p, locks := range t.locks {
+		if isUnder(p, oldPath) {
+			delete(t.locks, p)
+			t.locks[renamedPath(p, oldPath, newPath)] = locks
+		}
+	}
+}
+
+// Lock tests, takes or releases a POSIX byte-range lock for the handle fh.
+// Locks only exclude other handles on this mount; see leases for exclusion
+// across machines. WinFsp enforces byte-range locks in its kernel driver and
+// does not forward them, so on Windows this serves FUSE hosts that do.
+func (fs *S3FS) Lock(path string, cmd int, lock *cgofuse.Lock_t, fh uint64) (errc int) {
+	defer trackOp("Lock", time.Now(), &errc)
+	path = fs.resolvePath(path)
+	logger.Debug("lock", "path", path, "cmd", cmd, "type", lock.Type, "start", lock.Start, "len", lock.Len, "fh", fh)
+
+	// Hosts pass absolute ranges
+	if lock.Whence != seekSet || lock.Start < 0 {
+		return -cgofuse.EINVAL
+	}
+	if lock.Len > math.MaxInt64-lock.Start {
+		return -cgofuse.EOVERFLOW
+	}
+	l := byteLock{owner: fh, pid: lock.Pid, start: lock.Start, end: math.MaxInt64, write: lock.Type == lockWrite}
+	switch {
+	case lock.Len > 0:
+		l.end = lock.Start + lock.Len
+	case lock.Len < 0:
+		l.start, l.end = lock.Start+lock.Len, lock.Start
+	}
+	if l.start < 0 {
+		return -cgofuse.EINVAL
+	}
+
+	t := fs.locks
+	switch cmd {
+	case lockGet:
+		t.mu.Lock()
+		held, busy := t.conflictLocked(path, l)
+		t.mu.Unlock()
+		if !busy {
+			lock.Type = lockUnlock
+			return 0
+		}
+		lock.Type = lockRead
+		if held.write {
+			lock.Type = lockWrite
+		}
+		lock.Start = held.start
+		lock.Len = 0
+		if held.end != math.MaxInt64 {
+			lock.Len = held.end - held.start
+		}
+		lock.Pid = held.pid
+		return 0
+
+	case lockSet, lockSetWait:
+		if lock.Type == lockUnlock {
+			t.mu.Lock()
+			t.setLocked(path, l, true)
+			t.mu.Unlock()
+			return 0
+		}
+		if lock.Type != lockRead && lock.Type != lockWrite {
+			return -cgofuse.EINVAL
+		}
+		if cmd == lockSetWait {
+			if err := t.wait(fs.rootCtx, path, l); err != nil {
+				return -cgofuse.EINTR
+			}
+			return 0
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if _, busy := t.conflictLocked(path, l); busy {
+			return -cgofuse.EAGAIN
+		}
+		t.setLocked(path, l, false)
+		return 0
+
+	default:
+		return -cgofuse.EINVAL
+	}
+}
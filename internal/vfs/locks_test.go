@@ -0,0 +1,125 @@
+package vfs
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"maxiofs-agent/internal/cgofuse"
+)
+
+func newLockFS() *S3FS {
+	return &S3FS{
+		locks:   newLockTable(),
+		tree:    newTreeIndex(0, false),
+		rootCtx: context.Background(),
+	}
+}
+
+func TestLockConflicts(t *testing.T) {
+	tests := []struct {
+		name  string
+		held  byteLock
+		taken byteLock
+		busy  bool
+	}{
+		{"readers share", byteLock{owner: 1, start: 0, end: 10}, byteLock{owner: 2, start: 5, end: 15}, false},
+		{"writer excludes reader", byteLock{owner: 1, start: 0, end: 10, write: true}, byteLock{owner: 2, start: 5, end: 15}, true},
+		{"reader excludes writer", byteLock{owner: 1, start: 0, end: 10}, byteLock{owner: 2, start: 9, end: 10, write: true}, true},
+		{"adjacent ranges", byteLock{owner: 1, start: 0, end: 10, write: true}, byteLock{owner: 2, start: 10, end: 20, write: true}, false},
+		{"same owner", byteLock{owner: 1, start: 0, end: 10, write: true}, byteLock{owner: 1, start: 0, end: 10, write: true}, false},
+		{"to end of file", byteLock{owner: 1, start: 100, end: math.MaxInt64, write: true}, byteLock{owner: 2, start: 1 << 40, end: 1<<40 + 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lt := newLockTable()
+			lt.setLocked("f", tt.held, false)
+			if _, busy := lt.conflictLocked("f", tt.taken); busy != tt.busy {
+				t.Errorf("conflict = %v, want %v", busy, tt.busy)
+			}
+			if _, busy := lt.conflictLocked("g", tt.taken); busy {
+				t.Error("lock on another path conflicts")
+			}
+		})
+	}
+}
+
+func TestLockSplitAndMerge(t *testing.T) {
+	lt := newLockTable()
+	lt.setLocked("f", byteLock{owner: 1, start: 0, end: 100, write: true}, false)
+
+	// Unlocking the middle leaves both ends
+	lt.setLocked("f", byteLock{owner: 1, start: 40, end: 60}, true)
+	if got := len(lt.locks["f"]); got != 2 {
+		t.Fatalf("%d locks after unlocking the middle, want 2", got)
+	}
+	if _, busy := lt.conflictLocked("f", byteLock{owner: 2, start: 40, end: 60, write: true}); busy {
+		t.Error("unlocked range still conflicts")
+	}
+	if _, busy := lt.conflictLocked("f", byteLock{owner: 2, start: 59, end: 61, write: true}); !busy {
+		t.Error("kept range does not conflict")
+	}
+
+	// Relocking the hole merges the three ranges
+	lt.setLocked("f", byteLock{owner: 1, start: 40, end: 60, write: true}, false)
+	if locks := lt.locks["f"]; len(locks) != 1 || locks[0].start != 0 || locks[0].end != 100 {
+		t.Errorf("locks = %+v, want one lock on [0, 100)", locks)
+	}
+
+	lt.releaseOwner(1)
+	if _, ok := lt.locks["f"]; ok {
+		t.Error("locks left after releasing their owner")
+	}
+}
+
+func TestLockCommands(t *testing.T) {
+	fs := newLockFS()
+
+	set := func(fh uint64, typ int16, start, length int64) int {
+		return fs.Lock("/f", lockSet, &cgofuse.Lock_t{Type: typ, Start: start, Len: length, Pid: int(fh)}, fh)
+	}
+	if errc := set(1, lockWrite, 10, 20); errc != 0 {
+		t.Fatalf("F_SETLK = %d", errc)
+	}
+	if errc := set(2, lockRead, 0, 0); errc != -cgofuse.EAGAIN {
+		t.Errorf("conflicting F_SETLK = %d, want EAGAIN", errc)
+	}
+
+	probe := &cgofuse.Lock_t{Type: lockRead, Start: 0, Len: 0}
+	if errc := fs.Lock("/f", lockGet, probe, 2); errc != 0 {
+		t.Fatalf("F_GETLK = %d", errc)
+	}
+	if probe.Type != lockWrite || probe.Start != 10 || probe.Len != 20 || probe.Pid != 1 {
+		t.Errorf("F_GETLK = %+v, want the write lock of pid 1 on [10, 30)", *probe)
+	}
+
+	// A negative length locks the bytes before start
+	if errc := set(2, lockRead, 10, -10); errc != 0 {
+		t.Errorf("F_SETLK before the held range = %d", errc)
+	}
+	if errc := fs.Lock("/f", lockSet, &cgofuse.Lock_t{Type: lockRead, Whence: 1}, 2); errc != -cgofuse.EINVAL {
+		t.Errorf("relative F_SETLK = %d, want EINVAL", errc)
+	}
+	if errc := set(2, lockRead, -1, 1); errc != -cgofuse.EINVAL {
+		t.Errorf("F_SETLK at a negative start = %d, want EINVAL", errc)
+	}
+	if errc := set(2, lockRead, math.MaxInt64-1, 2); errc != -cgofuse.EOVERFLOW {
+		t.Errorf("F_SETLK past the largest offset = %d, want EOVERFLOW", errc)
+	}
+
+	// F_SETLKW waits until the holder unlocks
+	done := make(chan int)
+	go func() {
+		done <- fs.Lock("/f", lockSetWait, &cgofuse.Lock_t{Type: lockWrite, Start: 15, Len: 1}, 3)
+	}()
+	select {
+	case <-done:
+		t.Fatal("F_SETLKW did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	set(1, lockUnlock, 0, 0)
+	if errc := <-done; errc != 0 {
+		t.Errorf("F_SETLKW = %d", errc)
+	}
+}
@@ -0,0 +1,47 @@
+package vfs
+
+import (
+	"strings"
+	"time"
+
+	"maxiofs-agent/internal/cgofuse"
+	"maxiofs-agent/internal/metrics"
+)
+
+// Filesystem metrics, shared by every mount
+var (
+	OpsTotal = metrics.NewCounterVec("maxiofs_fuse_ops_total",
+		"FUSE callbacks served, by operation.", "op")
+	OpErrorsTotal = metrics.NewCounterVec("maxiofs_fuse_errors_total",
+		"FUSE callbacks that returned an error, by operation and errno.", "op", "errno")
+	OpDuration = metrics.NewHistogramVec("maxiofs_fuse_op_duration_seconds",
+		"Latency of FUSE callbacks, by operation.", metrics.DefaultBuckets, "op")
+	BytesTotal = metrics.NewCounterVec("maxiofs_fuse_bytes_total",
+		"Bytes returned by Read and accepted by Write.", "direction")
+	CacheLookupsTotal = metrics.NewCounterVec("maxiofs_cache_lookups_total",
+		"Cache lookups, by cache and result (hit, miss).", "cache", "result")
+)
+
+// trackOp records the latency and outcome of a FUSE callback. It is deferred
+// with a pointer to the callback's result so failures are counted by errno.
+func trackOp(op string, start time.Time, errc *int) {
+	OpsTotal.Inc(op)
+	OpDuration.Observe(time.Since(start).Seconds(), op)
+	if *errc < 0 {
+		OpErrorsTotal.Inc(op, errnoName(*errc))
+	}
+}
+
+// trackCache records a cache hit or miss
+func trackCache(cache string, hit bool) {
+	if hit {
+		CacheLookupsTotal.Inc(cache, "hit")
+	} else {
+		CacheLookupsTotal.Inc(cache, "miss")
+	}
+}
+
+// errnoName returns the symbolic name of a negative FUSE error code (ENOENT, EIO...)
+func errnoName(errc int) string {
+	return strings.TrimPrefix(cgofuse.Error(errc).Error(), "-fuse.")
+}
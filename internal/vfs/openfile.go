@@ -0,0 +1,136 @@
+package vfs
+
+import (
+	"os"
+	"time"
+
+	"maxiofs-agent/internal/cgofuse"
+)
+
+// writeHandle is one open of a file for writing. All handles on a path share
+// the same OpenFile, so they see the same data, size and mtime.
+type writeHandle struct {
+	*OpenFile
+	Append bool // Opened with O_APPEND, writes go to the end of file
+}
+
+// acquireNode returns the file open for writing at path with one more
+// reference, or nil when the path is not open for writing
+func (fs *S3FS) acquireNode(path string) *OpenFile {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node := fs.nodes[path]
+	if node != nil {
+		node.refs++
+	}
+	return node
+}
+
+// addNode registers candidate as the file open for writing at its path. If
+// another open registered one meanwhile, that one gets a reference instead
+// and the staging file of candidate is removed.
+func (fs *S3FS) addNode(candidate *OpenFile) *OpenFile {
+	fs.mu.Lock()
+	node := fs.nodes[candidate.Path]
+	if node == nil {
+		candidate.refs = 1
+		fs.nodes[candidate.Path] = candidate
+		fs.mu.Unlock()
+		if fs.leases != nil {
+			go fs.acquireLease(candidate.Path)
+		}
+		return candidate
+	}
+	node.refs++
+	fs.mu.Unlock()
+
+	candidate.stageMu.Lock()
+	candidate.unjournalLocked()
+	candidate.stageMu.Unlock()
+	os.Remove(candidate.TempFile)
+	return node
+}
+
+// releaseNode drops a reference on node and reports whether it was the last one
+func (fs *S3FS) releaseNode(node *OpenFile) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node.refs--
+	if node.refs > 0 {
+		return false
+	}
+	if fs.nodes[node.Path] == node {
+		delete(fs.nodes, node.Path)
+	}
+	return true
+}
+
+// openHandle allocates a handle on node, which the caller holds a reference
+// on. With O_TRUNC the shared file is emptied first.
+func (fs *S3FS) openHandle(node *OpenFile, flags int) (int, uint64) {
+	if flags&cgofuse.O_TRUNC != 0 {
+		if err := fs.truncateStaged(node, 0); err != nil {
+			logger.Error("open: error truncating staged file", "path", node.Path, "error", err)
+			fs.closeNode(node)
+			return -cgofuse.EIO, ^uint64(0)
+		}
+	}
+
+	// The upload runs after the last release, away from the FUSE thread
+	writer := fs.currentCaller()
+	fs.mu.Lock()
+	node.writer = writer
+	fh := fs.nextFh
+	fs.nextFh++
+	fs.openFiles[fh] = &writeHandle{OpenFile: node, Append: flags&cgofuse.O_APPEND != 0}
+	fs.mu.Unlock()
+
+	logger.Debug("open: created file handle", "path", node.Path, "fh", fh, "temp", node.TempFile, "truncate", flags&cgofuse.O_TRUNC != 0)
+	return 0, fh
+}
+
+// closeNode drops a reference on node. The last one hands its changes to the
+// upload queue, or removes the staging file when there are none.
+func (fs *S3FS) closeNode(node *OpenFile) {
+	if !fs.releaseNode(node) {
+		return
+	}
+
+	fs.mu.RLock()
+	upload := node.Dirty && !node.removed
+	fs.mu.RUnlock()
+	if upload {
+		logger.Debug("release: queueing upload", "path", node.Path, "size", node.Size)
+		fs.queueReleased(node)
+		return
+	}
+
+	node.stageMu.Lock()
+	node.unjournalLocked()
+	node.stageMu.Unlock()
+	os.Remove(node.TempFile)
+	fs.releaseLease(node.Path)
+}
+
+// truncateStaged changes the size of a file open for writing
+func (fs *S3FS) truncateStaged(of *OpenFile, size int64) error {
+	of.stageMu.Lock()
+	defer of.stageMu.Unlock()
+
+	if err := os.Truncate(of.TempFile, size); err != nil {
+		return err
+	}
+
+	// Bytes cut off the base are gone even if the file grows again
+	of.BaseSize = min(of.BaseSize, size)
+	of.present.truncate(size)
+	of.modified.truncate(size)
+
+	fs.mu.Lock()
+	of.Size = size
+	of.ModTime = time.Now()
+	of.Dirty = true
+	fs.mu.Unlock()
+	fs.journalSoon(of)
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package vfs
+
+import "syscall"
+
+// processAlive reports whether a process with the given pid is running
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,188 @@
+package vfs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"maxiofs-agent/internal/storage"
+)
+
+const (
+	defaultReadAheadMax = 64 * 1024 * 1024 // Largest prefetch window in bytes
+	defaultReadChunk    = 1024 * 1024      // Prefetch unit when there is no block cache
+	readAheadIdle       = time.Minute      // Streams unused for this long are dropped
+	sequentialThreshold = 2                // Contiguous reads before prefetching starts
+)
+
+// readAhead tracks sequential readers and the chunks prefetched for them
+type readAhead struct {
+	mu      sync.Mutex
+	max     int64 // Largest window in bytes, 0 when read-ahead is disabled
+	streams map[string]*readStream
+}
+
+// readStream is the access pattern of one object
+type readStream struct {
+	etag       string
+	next       int64 // Offset a sequential read continues from
+	sequential int   // Consecutive contiguous reads
+	window     int64 // Chunks to keep prefetched ahead of the reader
+	lastUsed   time.Time
+	chunks     map[int64]*prefetchedChunk
+}
+
+// prefetchedChunk is a chunk being fetched (or already fetched) in the background
+type prefetchedChunk struct {
+	done   chan struct{}
+	data   []byte
+	err    error
+	cancel context.CancelFunc
+}
+
+func newReadAhead(max int64) *readAhead {
+	return &readAhead{
+		max:     max,
+		streams: make(map[string]*readStream),
+	}
+}
+
+// observe records a read of length bytes at ofst and reports whether the object
+// is being read sequentially
+func (ra *readAhead) observe(obj storage.ObjectInfo, ofst, length, chunkSize int64) bool {
+	if ra.max <= 0 {
+		return false
+	}
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.sweep()
+
+	s, ok := ra.streams[obj.Key]
+	if !ok || s.etag != obj.ETag {
+		if ok {
+			s.discard()
+		}
+		s = &readStream{etag: obj.ETag, chunks: make(map[int64]*prefetchedChunk)}
+		ra.streams[obj.Key] = s
+	}
+	s.lastUsed = time.Now()
+
+	// Parallel readers may issue requests slightly out of order, anything
+	// within a chunk of the expected offset still counts as sequential
+	if ofst >= s.next-chunkSize && ofst <= s.next+chunkSize {
+		s.sequential++
+		if s.sequential >= sequentialThreshold && s.window == 0 {
+			s.window = 1
+		}
+	} else {
+		logger.Debug("read-ahead: random access, discarding prefetched data", "key", obj.Key, "offset", ofst)
+		s.discard()
+		s.sequential = 0
+		s.window = 0
+	}
+	s.next = ofst + length
+	return s.window > 0
+}
+
+// take returns a prefetched chunk, waiting for it if it is still in flight.
+// Every chunk taken doubles the window, up to the configured maximum.
+func (ra *readAhead) take(ctx context.Context, obj storage.ObjectInfo, index, chunkSize int64) ([]byte, bool) {
+	ra.mu.Lock()
+	s, ok := ra.streams[obj.Key]
+	if !ok || s.etag != obj.ETag || s.window == 0 {
+		ra.mu.Unlock()
+		return nil, false
+	}
+	p, ok := s.chunks[index]
+	if !ok {
+		ra.mu.Unlock()
+		trackCache("readahead", false)
+		return nil, false
+	}
+	delete(s.chunks, index)
+	if maxChunks := ra.max / chunkSize; s.window*2 <= maxChunks {
+		s.window *= 2
+	} else if s.window < maxChunks {
+		s.window = maxChunks
+	}
+	ra.mu.Unlock()
+
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		p.cancel()
+		return nil, false
+	}
+	trackCache("readahead", p.err == nil)
+	return p.data, p.err == nil
+}
+
+// drop forgets the stream of key and cancels its prefetches
+func (ra *readAhead) drop(key string) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if s, ok := ra.streams[key]; ok {
+		s.discard()
+		delete(ra.streams, key)
+	}
+}
+
+// sweep drops idle streams. Must be called with mu held.
+func (ra *readAhead) sweep() {
+	for key, s := range ra.streams {
+		if time.Since(s.lastUsed) > readAheadIdle {
+			s.discard()
+			delete(ra.streams, key)
+		}
+	}
+}
+
+// discard cancels and forgets every prefetched chunk
+func (s *readStream) discard() {
+	for index, p := range s.chunks {
+		p.cancel()
+		delete(s.chunks, index)
+	}
+}
+
+// prefetch starts background fetches for the window of chunks following index
+func (fs *S3FS) prefetch(obj storage.ObjectInfo, index, chunkSize int64) {
+	ra := fs.readAhead
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	s, ok := ra.streams[obj.Key]
+	if !ok || s.etag != obj.ETag || s.window == 0 {
+		return
+	}
+
+	// Chunks the reader has moved past will never be taken
+	for i, p := range s.chunks {
+		if i <= index {
+			p.cancel()
+			delete(s.chunks, i)
+		}
+	}
+
+	for i := index + 1; i <= index+s.window && i*chunkSize < obj.Size; i++ {
+		if _, ok := s.chunks[i]; ok {
+			continue
+		}
+		if fs.blocks != nil && fs.blocks.Contains(fs.bucketName, fs.objectKey(obj.Key), obj.ETag, i) {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(fs.rootCtx, fs.dataTimeout)
+		p := &prefetchedChunk{done: make(chan struct{}), cancel: cancel}
+		s.chunks[i] = p
+		go func(index int64) {
+			defer cancel()
+			p.data, p.err = fs.fetchChunk(ctx, obj, index, chunkSize, nil)
+			if p.err != nil && ctx.Err() == nil {
+				logger.Debug("read-ahead: prefetch failed", "key", obj.Key, "chunk", index, "error", p.err)
+			}
+			close(p.done)
+		}(i)
+	}
+}
@@ -0,0 +1,107 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"maxiofs-agent/internal/storage"
+)
+
+// readHandle is a file opened read-only. It keeps the object body open between
+// reads so contiguous reads continue on the same request; a seek reopens it.
+type readHandle struct {
+	Path string
+
+	ctx    context.Context // Lives until Release
+	cancel context.CancelFunc
+
+	mu       sync.Mutex // Serializes use of the stream
+	obj      storage.ObjectInfo
+	body     io.ReadCloser
+	bodyETag string // Version the body was opened on
+	pos      int64  // Object offset the body continues from
+}
+
+// readHandle returns the read-only handle fh, or nil if fh is not one
+func (fs *S3FS) readHandle(fh uint64) *readHandle {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.readFiles[fh]
+}
+
+// object returns the object version the handle reads, if it is known
+func (h *readHandle) object() (storage.ObjectInfo, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.obj, h.obj.Key != ""
+}
+
+// setObject pins the handle to a (new) version of its object
+func (h *readHandle) setObject(obj storage.ObjectInfo) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.obj = obj
+}
+
+// readAt fills buf from the stream at ofst, reopening the stream if the read
+// does not continue where the previous one stopped. ctx bounds this read only;
+// the stream itself lives as long as the handle. Must be called with mu held.
+func (h *readHandle) readAt(ctx context.Context, fs *S3FS, obj storage.ObjectInfo, buf []byte, ofst int64) (int, error) {
+	if h.body != nil && (h.pos != ofst || h.bodyETag != obj.ETag) {
+		logger.Debug("read stream: seek, reopening", "path", h.Path, "from", h.pos, "to", ofst)
+		h.closeStream()
+	}
+	if h.body == nil {
+		body, err := fs.s3Client.OpenObjectStream(h.ctx, fs.bucketName, fs.objectKey(obj.Key), obj.ETag, ofst)
+		if err != nil {
+			return 0, err
+		}
+		h.body = body
+		h.bodyETag = obj.ETag
+		h.pos = ofst
+	}
+
+	body := h.body
+	stop := context.AfterFunc(ctx, func() { body.Close() })
+	n, err := io.ReadFull(body, buf)
+	if !stop() {
+		// The read timed out or was cancelled and the stream is gone
+		h.body = nil
+		return n, ctx.Err()
+	}
+	h.pos += int64(n)
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		h.closeStream()
+		// Only the end of the object ends the stream cleanly, anywhere else
+		// the connection was cut
+		if h.pos < obj.Size {
+			return n, fmt.Errorf("object stream ended at byte %d of %d: %w", h.pos, obj.Size, io.ErrUnexpectedEOF)
+		}
+		return n, nil
+	}
+	if err != nil {
+		h.closeStream()
+		return n, err
+	}
+	return n, nil
+}
+
+// closeStream closes the open body, if any. Must be called with mu held.
+func (h *readHandle) closeStream() {
+	if h.body != nil {
+		h.body.Close()
+		h.body = nil
+	}
+}
+
+// close releases the stream and cancels any request still using it
+func (h *readHandle) close() {
+	h.cancel()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closeStream()
+}
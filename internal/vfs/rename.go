@@ -0,0 +1,493 @@
+package vfs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"maxiofs-agent/internal/storage"
+)
+
+const (
+	renamePattern     = "rename-*.json"
+	renameConcurrency = 8           // Keys copied or deleted at once
+	renameSaveEvery   = time.Second // Progress is journaled at most this often
+)
+
+// Directory rename phases
+const (
+	renameCopying  = "copying"  // Copying keys to the new prefix; interrupted renames are rolled back
+	renameDeleting = "deleting" // Every key was copied; interrupted renames are completed
+	renameRollback = "rollback" // Deleting the copies after a failed copy
+)
+
+// renameTxn is the journal of a directory rename. S3 has no rename, so every
+// key below the directory is copied to the new prefix and then deleted. The
+// journal is written to the staging directory before anything changes, and
+// once every copy succeeded, so an interrupted rename can be rolled back or
+// completed on the next mount instead of leaving the tree split in two. It
+// records object keys, so it is replayed correctly whatever name encoding the
+// next mount uses.
+type renameTxn struct {
+	ID        string      `json:"id"`
+	From      string      `json:"from"`
+	To        string      `json:"to"`
+	Phase     string      `json:"phase"`
+	Keys      []renameKey `json:"keys"`
+	Caller    auditCaller `json:"caller"` // Process the copies are audited for
+	StartedAt time.Time   `json:"started_at"`
+
+	file     string     // Journal file
+	from, to string     // Paths of From and To
+	mu       sync.Mutex // Guards the progress flags of Keys
+	saved    time.Time
+}
+
+type renameKey struct {
+	Old      string `json:"old"`
+	New      string `json:"new"`
+	oldPath  string // Path of Old
+	newPath  string // Path of New
+	ETag     string `json:"etag,omitempty"`     // Version of Old when listed
+	NewETag  string `json:"new_etag,omitempty"` // Version of the copy
+	Replaces bool   `json:"replaces,omitempty"` // New existed before, a rollback keeps it
+	Copied   bool   `json:"copied,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"`
+	Kept     bool   `json:"kept,omitempty"` // Old changed after it was copied and was left in place
+}
+
+// newRenameTxn plans the rename of the directory from, whose keys are objects.
+// It runs in the Rename callback, which is the one place the caller is known:
+// the copies run on worker goroutines, or in a later run when resumed.
+func (fs *S3FS) newRenameTxn(from, to string, objects []storage.ObjectInfo, existing map[string]bool) *renameTxn {
+	id := make([]byte, 8)
+	rand.Read(id)
+	t := &renameTxn{
+		ID:        hex.EncodeToString(id),
+		From:      fs.objectKey(from) + "/",
+		To:        fs.objectKey(to) + "/",
+		Phase:     renameCopying,
+		Caller:    fs.currentCaller(),
+		StartedAt: time.Now(),
+		from:      from,
+		to:        to,
+	}
+	t.file = filepath.Join(fs.stagingDir, "rename-"+t.ID+journalExt)
+	for _, obj := range objects {
+		newPath := to + "/" + strings.TrimPrefix(obj.Key, from+"/")
+		if dir, ok := markerDir(obj.Key); ok && dir == from {
+			// The directory's own marker, whichever its convention
+			newPath = rekeyMarker(obj.Key, to)
+		}
+		t.Keys = append(t.Keys, renameKey{
+			Old:      fs.objectKey(obj.Key),
+			New:      fs.objectKey(newPath),
+			oldPath:  obj.Key,
+			newPath:  newPath,
+			ETag:     obj.ETag,
+			Replaces: existing[newPath],
+		})
+	}
+	return t
+}
+
+// loadRenameTxn reads the journal of a rename interrupted in a previous run
+func (fs *S3FS) loadRenameTxn(file string) (*renameTxn, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	t := &renameTxn{file: file}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	t.from, _ = fs.objectPath(strings.TrimSuffix(t.From, "/"))
+	t.to, _ = fs.objectPath(strings.TrimSuffix(t.To, "/"))
+	for i, k := range t.Keys {
+		t.Keys[i].oldPath, _ = fs.objectPath(k.Old)
+		t.Keys[i].newPath, _ = fs.objectPath(k.New)
+	}
+	return t, nil
+}
+
+// save journals the rename; progress-only updates are throttled unless force is set
+func (t *renameTxn) save(force bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !force && time.Since(t.saved) < renameSaveEvery {
+		return nil
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	t.saved = time.Now()
+	return writeJournalFile(t.file, data)
+}
+
+// setPhase moves the rename to another phase and journals it
+func (t *renameTxn) setPhase(phase string) error {
+	t.mu.Lock()
+	t.Phase = phase
+	t.mu.Unlock()
+	return t.save(true)
+}
+
+// forEachKey runs fn on the keys for which pending is true, renameConcurrency
+// at a time, and records the progress it returns. It stops starting new keys
+// after the first error and returns it.
+func (fs *S3FS) forEachKey(t *renameTxn, pending func(k renameKey) bool, fn func(ctx context.Context, k renameKey) (renameKey, error)) error {
+	slots := make(chan struct{}, renameConcurrency)
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var firstErr error
+	failed := func() bool {
+		errMu.Lock()
+		defer errMu.Unlock()
+		return firstErr != nil
+	}
+
+	for i := range t.Keys {
+		t.mu.Lock()
+		k := t.Keys[i]
+		t.mu.Unlock()
+		if !pending(k) {
+			continue
+		}
+		slots <- struct{}{}
+		if failed() || fs.rootCtx.Err() != nil {
+			<-slots
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			ctx, cancel := context.WithTimeout(fs.rootCtx, fs.dataTimeout)
+			defer cancel()
+			k, err := fn(ctx, k)
+			if err != nil {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMu.Unlock()
+				return
+			}
+			t.mu.Lock()
+			t.Keys[i] = k
+			t.mu.Unlock()
+			t.save(false)
+		}()
+	}
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = fs.rootCtx.Err()
+	}
+	return firstErr
+}
+
+// copyRenamed copies every key of a rename to its new name
+func (fs *S3FS) copyRenamed(t *renameTxn) error {
+	return fs.forEachKey(t,
+		func(k renameKey) bool { return !k.Copied },
+		func(ctx context.Context, k renameKey) (renameKey, error) {
+			rec := fs.beginAuditAs(t.Caller, auditRename, k.oldPath)
+			if rec != nil {
+				rec.NewKey = k.New
+				rec.ETagBefore = k.ETag
+			}
+			etag, err := fs.s3Client.CopyObject(ctx, fs.bucketName, k.Old, k.ETag, k.New)
+			fs.finishAudit(rec, etag, err)
+			if err != nil {
+				logger.Error("rename: error copying", "from", k.Old, "to", k.New, "error", err)
+				return k, err
+			}
+			logger.Debug("rename: copied", "from", k.Old, "to", k.New)
+			k.Copied = true
+			k.NewETag = etag
+			return k, nil
+		})
+}
+
+// deleteRenamed deletes the old keys of a rename whose copies are complete. A
+// key written again since it was listed is kept: its copy is of an older version.
+func (fs *S3FS) deleteRenamed(t *renameTxn) error {
+	return fs.forEachKey(t,
+		func(k renameKey) bool { return !k.Deleted && !k.Kept },
+		func(ctx context.Context, k renameKey) (renameKey, error) {
+			current, err := fs.s3Client.HeadObject(ctx, fs.bucketName, k.Old)
+			switch {
+			case storage.IsNotFound(err):
+				// Deleted before an interruption
+				k.Deleted = true
+				return k, nil
+			case err != nil:
+				logger.Warn("rename: error checking old key", "key", k.Old, "error", err)
+				return k, err
+			case k.ETag != "" && current.ETag != k.ETag:
+				logger.Warn("rename: old key changed after it was copied, keeping it", "key", k.Old, "copied", k.ETag, "current", current.ETag)
+				k.Kept = true
+				return k, nil
+			}
+			if err := fs.s3Client.DeleteObject(ctx, fs.bucketName, k.Old); err != nil {
+				logger.Warn("rename: error deleting old key", "key", k.Old, "error", err)
+				return k, err
+			}
+			fs.invalidateBlocks(k.oldPath)
+			k.Deleted = true
+			return k, nil
+		})
+}
+
+// rollbackRename deletes the copies made by an incomplete rename. Keys whose
+// copy was not recorded are deleted as well, they may have been copied just
+// before an interruption; keys that existed before the rename are kept.
+func (fs *S3FS) rollbackRename(t *renameTxn) error {
+	return fs.forEachKey(t,
+		func(k renameKey) bool { return !k.Replaces && !k.Deleted },
+		func(ctx context.Context, k renameKey) (renameKey, error) {
+			if err := fs.s3Client.DeleteObject(ctx, fs.bucketName, k.New); err != nil && !storage.IsNotFound(err) {
+				logger.Warn("rename: error deleting copy", "key", k.New, "error", err)
+				return k, err
+			}
+			k.Deleted = true
+			return k, nil
+		})
+}
+
+// finishRename completes a rename after its copies, or rolls it back when
+// they are incomplete, and removes its journal once done. The journal is kept
+// for the next mount if that fails too.
+func (fs *S3FS) finishRename(t *renameTxn) error {
+	var err error
+	if t.Phase == renameDeleting {
+		err = fs.deleteRenamed(t)
+	} else {
+		// A journal left in the copying phase is rolled back as well
+		if err := t.setPhase(renameRollback); err != nil {
+			logger.Warn("rename: cannot journal rollback", "from", t.From, "to", t.To, "error", err)
+		}
+		err = fs.rollbackRename(t)
+	}
+	if err != nil {
+		t.save(true)
+		logger.Warn("rename: incomplete, will be retried at next mount", "from", t.From, "to", t.To, "phase", t.Phase, "error", err)
+		return err
+	}
+	os.Remove(t.file)
+	return nil
+}
+
+// renameDir moves every key below the directory from to the directory to and
+// returns where each key went
+func (fs *S3FS) renameDir(from, to string, objects []storage.ObjectInfo, existing map[string]bool) (map[string]movedKey, error) {
+	t := fs.newRenameTxn(from, to, objects, existing)
+	logger.Debug("rename: moving directory", "from", from, "to", to, "items", len(t.Keys))
+	if err := t.save(true); err != nil {
+		logger.Error("rename: cannot journal rename", "from", from, "to", to, "error", err)
+		return nil, err
+	}
+
+	if err := fs.copyRenamed(t); err != nil {
+		logger.Error("rename: copy failed, rolling back", "from", from, "to", to, "error", err)
+		fs.finishRename(t)
+		return nil, err
+	}
+
+	// Commit point: from here on the rename is completed, not undone
+	if err := t.setPhase(renameDeleting); err != nil {
+		// The journal on disk still says copying, so it must be undone
+		logger.Error("rename: cannot journal rename", "from", from, "to", to, "error", err)
+		t.mu.Lock()
+		t.Phase = renameCopying
+		t.mu.Unlock()
+		fs.finishRename(t)
+		return nil, err
+	}
+	fs.finishRename(t)
+
+	moved := make(map[string]movedKey, len(t.Keys))
+	for _, k := range t.Keys {
+		moved[k.oldPath] = movedKey{Key: k.newPath, From: k.ETag, ETag: k.NewETag}
+	}
+	return moved, nil
+}
+
+// movedKey is where a rename copied a key to
+type movedKey struct {
+	Key  string
+	From string // Version of the old key that was copied
+	ETag string // Version of the copy
+}
+
+// renamedPath returns the name of p after oldpath was renamed to newpath
+func renamedPath(p, oldpath, newpath string) string {
+	return newpath + p[len(oldpath):]
+}
+
+// lockStaged locks the staging files of everything open for writing or
+// waiting for upload below oldpath, so they are neither written nor uploaded
+// while their keys move. The caller unlocks them.
+func (fs *S3FS) lockStaged(oldpath string) []*OpenFile {
+	fs.mu.RLock()
+	seen := make(map[*OpenFile]bool)
+	var staged []*OpenFile
+	for p, node := range fs.nodes {
+		if isUnder(p, oldpath) && !seen[node] {
+			seen[node] = true
+			staged = append(staged, node)
+		}
+	}
+	for _, entry := range fs.pending {
+		if entry.of != nil && isUnder(entry.Path, oldpath) && !seen[entry.of] {
+			seen[entry.of] = true
+			staged = append(staged, entry.of)
+		}
+	}
+	fs.mu.RUnlock()
+
+	for _, of := range staged {
+		of.stageMu.Lock()
+	}
+	return staged
+}
+
+// rebaseMoved points the base of a staged file at the copy of its object.
+// A base that was not the copied version stays a conflict.
+func (of *OpenFile) rebaseMoved(moved map[string]movedKey) {
+	m, ok := moved[of.Base.Key]
+	if !ok {
+		return
+	}
+	of.Base.Key = m.Key
+	if of.Base.ETag == m.From {
+		of.Base.ETag = m.ETag
+	}
+}
+
+// repoint moves whatever is open, queued or locked below oldpath to newpath:
+// open files and their handles, staging files waiting for upload and their
+// journals, read handles, byte-range locks and leases. staged must be the
+// files returned by lockStaged, still locked.
+func (fs *S3FS) repoint(oldpath, newpath string, staged []*OpenFile, moved map[string]movedKey) {
+	var leases [][2]string
+
+	fs.mu.Lock()
+	for _, of := range staged {
+		p := of.Path
+		of.Path = renamedPath(p, oldpath, newpath)
+		of.rebaseMoved(moved)
+		if fs.nodes[p] == of {
+			delete(fs.nodes, p)
+			fs.nodes[of.Path] = of
+		}
+		leases = append(leases, [2]string{p, of.Path})
+	}
+
+	var journals []string
+	for staging, entry := range fs.pending {
+		if !isUnder(entry.Path, oldpath) {
+			continue
+		}
+		p := entry.Path
+		entry.Path = renamedPath(p, oldpath, newpath)
+		if m, ok := moved[p]; ok && entry.BaseETag == m.From {
+			entry.BaseETag = m.ETag
+		}
+		if fs.uploads.latest[p] == entry {
+			delete(fs.uploads.latest, p)
+			fs.uploads.latest[entry.Path] = entry
+		}
+		if entry.of == nil {
+			journals = append(journals, staging)
+		}
+	}
+
+	handles := make([]*readHandle, 0, len(fs.readFiles))
+	for _, h := range fs.readFiles {
+		handles = append(handles, h)
+	}
+	fs.mu.Unlock()
+
+	// Journals are rewritten with the new path
+	for _, of := range staged {
+		if of.journaled != nil {
+			fs.journalLocked(of)
+		}
+	}
+	for _, staging := range journals {
+		fs.mu.RLock()
+		data, err := json.Marshal(fs.pending[staging])
+		fs.mu.RUnlock()
+		if err == nil {
+			err = writeJournalFile(journalPath(staging), data)
+		}
+		if err != nil {
+			logger.Warn("rename: cannot update journal", "staging", staging, "error", err)
+		}
+	}
+
+	for _, h := range handles {
+		h.mu.Lock()
+		if !isUnder(h.Path, oldpath) {
+			h.mu.Unlock()
+			continue
+		}
+		h.Path = renamedPath(h.Path, oldpath, newpath)
+		if m, ok := moved[h.obj.Key]; ok {
+			h.obj.Key = m.Key
+			if h.obj.ETag == m.From {
+				h.obj.ETag = m.ETag
+			}
+		}
+		h.closeStream()
+		h.mu.Unlock()
+	}
+
+	fs.locks.move(oldpath, newpath)
+
+	if fs.leases != nil {
+		for _, l := range leases {
+			go func() {
+				fs.releaseLease(l[0])
+				fs.acquireLease(l[1])
+			}()
+		}
+	}
+}
+
+// resumeRenames completes or rolls back the directory renames interrupted in
+// a previous run. It runs before the mount serves requests, so nothing sees
+// the tree split in two.
+func (fs *S3FS) resumeRenames() {
+	files, _ := filepath.Glob(filepath.Join(fs.stagingDir, renamePattern))
+	for _, file := range files {
+		t, err := fs.loadRenameTxn(file)
+		if err != nil {
+			logger.Warn("rename: discarding unusable journal", "journal", file, "error", err)
+			os.Remove(file)
+			continue
+		}
+		logger.Info("rename: resuming interrupted rename", "from", t.From, "to", t.To, "phase", t.Phase)
+		if fs.finishRename(t) == nil {
+			logger.Info("rename: interrupted rename resolved", "from", t.From, "to", t.To, "phase", t.Phase)
+		}
+		fs.cache.InvalidatePrefix(t.from)
+		fs.cache.InvalidatePrefix(t.to)
+		fs.invalidatePath(t.from, t.to)
+	}
+	partial, _ := filepath.Glob(filepath.Join(fs.stagingDir, renamePattern+".new"))
+	for _, file := range partial {
+		os.Remove(file)
+	}
+	if len(files) > 0 {
+		fs.tree.invalidate()
+	}
+}
@@ -0,0 +1,173 @@
+package vfs
+
+import (
+	"net/http"
+	"os"
+	"slices"
+	"testing"
+
+	"maxiofs-agent/internal/storage"
+)
+
+// planRename plans the rename of directory d to e on a bucket holding d/x,
+// d/y and e/y, the last one replaced by the rename
+func planRename(t *testing.T) (*fakeS3, *S3FS, *renameTxn) {
+	t.Helper()
+	f := newFakeS3(t)
+	objects := []storage.ObjectInfo{
+		{Key: "d/x", ETag: f.put("d/x", "x")},
+		{Key: "d/y", ETag: f.put("d/y", "y")},
+	}
+	f.put("e/y", "theirs")
+	fs := f.mount(t, Options{})
+	txn := fs.newRenameTxn("d", "e", objects, map[string]bool{"e/y": true})
+	if err := txn.save(true); err != nil {
+		t.Fatal(err)
+	}
+	return f, fs, txn
+}
+
+func TestFinishRename(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(f *fakeS3, fs *S3FS, txn *renameTxn) // Runs after the copies
+		phase   string
+		keys    []string
+		kept    []string // Old keys left in place on purpose
+		failed  bool     // The journal stays for the next mount
+	}{
+		{
+			name:  "completed",
+			phase: renameDeleting,
+			keys:  []string{"e/x", "e/y"},
+		},
+		{
+			name:    "old key written after its copy",
+			prepare: func(f *fakeS3, fs *S3FS, txn *renameTxn) { f.put("d/x", "x2") },
+			phase:   renameDeleting,
+			keys:    []string{"d/x", "e/x", "e/y"},
+			kept:    []string{"d/x"},
+		},
+		{
+			name:    "old key deleted before an interruption",
+			prepare: func(f *fakeS3, fs *S3FS, txn *renameTxn) { f.remove("d/y") },
+			phase:   renameDeleting,
+			keys:    []string{"e/x", "e/y"},
+		},
+		{
+			name:    "delete refused",
+			prepare: func(f *fakeS3, fs *S3FS, txn *renameTxn) { f.refuseNext(http.MethodDelete, "d/x", 1) },
+			phase:   renameDeleting,
+			keys:    []string{"d/x", "e/x", "e/y"},
+			failed:  true,
+		},
+		{
+			name:    "old key unreadable",
+			prepare: func(f *fakeS3, fs *S3FS, txn *renameTxn) { f.refuseNext(http.MethodHead, "d/y", 1) },
+			phase:   renameDeleting,
+			keys:    []string{"d/y", "e/x", "e/y"},
+			failed:  true,
+		},
+		{
+			// Keys that existed before the rename stay, with the copy in them
+			name:  "rolled back",
+			phase: renameCopying,
+			keys:  []string{"d/x", "d/y", "e/y"},
+		},
+		{
+			name: "rolled back after an interrupted copy",
+			prepare: func(f *fakeS3, fs *S3FS, txn *renameTxn) {
+				txn.Keys[0].Copied = false
+			},
+			phase: renameCopying,
+			keys:  []string{"d/x", "d/y", "e/y"},
+		},
+		{
+			name:    "rollback refused",
+			prepare: func(f *fakeS3, fs *S3FS, txn *renameTxn) { f.refuseNext(http.MethodDelete, "e/x", 1) },
+			phase:   renameCopying,
+			keys:    []string{"d/x", "d/y", "e/x", "e/y"},
+			failed:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, fs, txn := planRename(t)
+			if err := fs.copyRenamed(txn); err != nil {
+				t.Fatalf("copyRenamed() error = %v", err)
+			}
+			if tt.prepare != nil {
+				tt.prepare(f, fs, txn)
+			}
+			txn.Phase = tt.phase
+
+			err := fs.finishRename(txn)
+			if (err != nil) != tt.failed {
+				t.Errorf("finishRename() error = %v, want failure %v", err, tt.failed)
+			}
+			if keys := f.keys(); !slices.Equal(keys, tt.keys) {
+				t.Errorf("bucket holds %v, want %v", keys, tt.keys)
+			}
+			var kept []string
+			for _, k := range txn.Keys {
+				if k.Kept {
+					kept = append(kept, k.Old)
+				}
+			}
+			if !slices.Equal(kept, tt.kept) {
+				t.Errorf("kept %v, want %v", kept, tt.kept)
+			}
+			if _, err := os.Stat(txn.file); os.IsNotExist(err) == tt.failed {
+				t.Errorf("journal exists: %v, want %v", err == nil, tt.failed)
+			}
+		})
+	}
+}
+
+func TestRenameDirCopyRefused(t *testing.T) {
+	f, fs, txn := planRename(t)
+	os.Remove(txn.file)
+	f.refuseNext(http.MethodPut, "e/y", 1)
+
+	objects := []storage.ObjectInfo{{Key: "d/x"}, {Key: "d/y"}}
+	if _, err := fs.renameDir("d", "e", objects, map[string]bool{"e/y": true}); err == nil {
+		t.Fatal("renameDir() succeeded with a copy refused")
+	}
+	want := []string{"d/x", "d/y", "e/y"}
+	if keys := f.keys(); !slices.Equal(keys, want) {
+		t.Errorf("bucket holds %v, want %v", keys, want)
+	}
+	if content, _ := f.get("e/y"); content != "theirs" {
+		t.Errorf("e/y = %q, want it untouched", content)
+	}
+}
+
+func TestResumeRenames(t *testing.T) {
+	tests := []struct {
+		phase string
+		keys  []string
+	}{
+		{renameCopying, []string{"d/x", "d/y", "e/y"}},
+		{renameDeleting, []string{"e/x", "e/y"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.phase, func(t *testing.T) {
+			f, fs, txn := planRename(t)
+			if err := fs.copyRenamed(txn); err != nil {
+				t.Fatalf("copyRenamed() error = %v", err)
+			}
+			if err := txn.setPhase(tt.phase); err != nil {
+				t.Fatal(err)
+			}
+
+			// The next mount on the same staging directory finishes it
+			f.mount(t, Options{StagingDir: fs.stagingDir})
+			if keys := f.keys(); !slices.Equal(keys, tt.keys) {
+				t.Errorf("bucket holds %v, want %v", keys, tt.keys)
+			}
+			if _, err := os.Stat(txn.file); !os.IsNotExist(err) {
+				t.Error("journal kept after the rename was resolved")
+			}
+		})
+	}
+}
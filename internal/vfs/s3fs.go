@@ -2,25 +2,32 @@ package vfs
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"os"
-	"path/filepath"
-	"strings"
+	"slices"
 	"sync"
 	"time"
 
+	"maxiofs-agent/internal/audit"
+	"maxiofs-agent/internal/cache"
 	"maxiofs-agent/internal/cgofuse"
+	"maxiofs-agent/internal/config"
+	"maxiofs-agent/internal/logging"
 	"maxiofs-agent/internal/storage"
 )
 
+var logger = logging.For("vfs")
+
 // S3FS implements the virtual filesystem for S3
 type S3FS struct {
 	cgofuse.FileSystemBase
 	s3Client   *storage.S3Client
 	bucketName string
 	cache      *FileCache
-	openFiles  map[uint64]*OpenFile
+	openFiles  map[uint64]*writeHandle
+	nodes      map[string]*OpenFile // Files open for writing, shared by their handles
+	readFiles  map[uint64]*readHandle
 	nextFh     uint64
 
 	// Cache for Statfs
@@ -28,107 +35,298 @@ type S3FS struct {
 	statfsCacheTime time.Time
 	statfsCacheTTL  time.Duration
 
-	// Cache for ListObjects
-	listCache     []storage.ObjectInfo
-	listCacheTime time.Time
-	listCacheTTL  time.Duration
+	// Index of the bucket namespace
+	tree *treeIndex
+
+	// Convention for the markers of empty directories
+	dirMarkers DirMarkers
+
+	// Substitutions between object keys and the paths they are shown at
+	names NameEncoding
+
+	// Objects known to be symbolic links
+	links *linkCache
+
+	// Inode numbers, kept across renames
+	inodes *inodeTable
+
+	// Root context for every S3 request issued by this mount.
+	// It is cancelled on Shutdown/Destroy so in-flight transfers are aborted.
+	rootCtx         context.Context
+	cancelRoot      context.CancelFunc
+	metadataTimeout time.Duration
+	dataTimeout     time.Duration
+
+	// Audit log of mutations (nil when auditing is disabled)
+	audit *audit.Logger
+
+	// Persistent cache of object chunks (nil when disabled)
+	blocks *cache.BlockCache
+
+	// Background prefetching for sequential readers
+	readAhead *readAhead
+
+	// Private directory holding the staging files of this mount
+	stagingDir string
+
+	// Journaled uploads of staging files no longer open, keyed by staging file
+	pending map[string]*journalEntry
+
+	// Background uploads of released staging files
+	uploads *uploadQueue
+
+	// Byte-range locks taken through the mount, and leases shared with other
+	// agents (nil when disabled)
+	locks  *lockTable
+	leases *leaseManager
 
 	mu sync.RWMutex
 }
 
-// FileCache caches file metadata
-type FileCache struct {
-	entries map[string]*CacheEntry
-	mu      sync.RWMutex
+// Options configures a mounted S3FS
+type Options struct {
+	// MetadataTimeout bounds listing, stat, delete and copy requests
+	MetadataTimeout time.Duration
+	// DataTimeout bounds object transfers (reads, downloads and uploads)
+	DataTimeout time.Duration
+	// Audit receives a record for every mutation when set
+	Audit *audit.Logger
+	// BlockCache serves reads from disk when set. It may be shared between mounts.
+	BlockCache *cache.BlockCache
+	// ReadAheadMax is the largest prefetch window in bytes for sequential
+	// reads (0 uses the default, negative disables read-ahead)
+	ReadAheadMax int64
+	// Attribute cache lifetimes for files, directories and paths that do not
+	// exist (0 uses the default, negative disables caching that kind)
+	FileAttrTTL     time.Duration
+	DirAttrTTL      time.Duration
+	NegativeAttrTTL time.Duration
+	// ListingRefresh is how often the namespace index is rebuilt from a full
+	// listing to pick up remote changes (0 uses the default)
+	ListingRefresh time.Duration
+	// DirMarkers is how Mkdir stores empty directories (empty uses DirMarkersSlash)
+	DirMarkers DirMarkers
+	// CaseInsensitive looks names up ignoring case. Keys that differ only in
+	// case are listed with a numbered suffix after the first one.
+	CaseInsensitive bool
+	// NameEncoding lists the substitutions applied to keys that are not valid
+	// local paths, as accepted by ParseNameEncoding (empty uses EncodeWindows)
+	NameEncoding string
+	// StagingDir holds the staging files of files open for writing. It must be
+	// private to this mount (empty uses the one config.StagingDir returns
+	// without a cache path, under the system temp dir).
+	StagingDir string
+	// UploadConcurrency is how many released files are uploaded at once and
+	// UploadRetries how often a failed upload is retried (0 uses the default,
+	// negative UploadRetries disables retries)
+	UploadConcurrency int
+	UploadRetries     int
+	// OnUploadFailed is called when a background upload is given up
+	OnUploadFailed func(path string, err error)
+	// Leases enables cooperative locks shared with other agents: files being
+	// edited get a lease object in the bucket, renewed until LeaseTTL (0 uses
+	// the default) after the last renewal. LeaseOwner names this user in the
+	// leases, and OnLeaseConflict is called when another agent holds the lease
+	// of a file opened for writing.
+	Leases          bool
+	LeaseTTL        time.Duration
+	LeaseOwner      string
+	OnLeaseConflict func(path, holder string)
 }
 
-type CacheEntry struct {
-	Info      storage.ObjectInfo
-	ExpiresAt time.Time
-}
+const (
+	defaultMetadataTimeout = 30 * time.Second
+	defaultDataTimeout     = 10 * time.Minute
+)
 
-// OpenFile represents a file opened for writing
+// OpenFile represents a file opened for writing, shared by every handle
+// open on its path. The staging file is sparse: bytes of the base object are
+// only fetched into it when they are read or needed to assemble an upload.
 type OpenFile struct {
 	Path     string
 	TempFile string // Temporary file on disk
 	Size     int64
+	ModTime  time.Time
 	Dirty    bool
+	Created  bool // Created through Create, not yet uploaded
+
+	refs    int  // Open handles, guarded by fs.mu
+	removed bool // Unlinked while open, discarded on the last release
+
+	Base     storage.ObjectInfo // Object version the file started from (empty Key when none)
+	BaseSize int64              // Leading bytes of Base still part of the file
+
+	stageMu      sync.Mutex  // Guards the staging file and the fields below
+	present      intervalSet // Ranges of the staging file holding file data
+	modified     intervalSet // Ranges that no longer match Base
+	journaled    []byte      // Last journal entry written, nil when there is none
+	journalTimer *time.Timer // Pending journalSoon, nil when the journal is up to date
+	writer       auditCaller // Last process that opened the file for writing, guarded by S3FS.mu
+	uploadErr    error       // Last upload failure
+	uploaded     bool        // Released and committed, the staging file is gone
 }
 
 // NewS3FS creates a new S3 filesystem
-func NewS3FS(s3Client *storage.S3Client, bucketName string) *S3FS {
-	return &S3FS{
-		s3Client:   s3Client,
-		bucketName: bucketName,
-		cache: &FileCache{
-			entries: make(map[string]*CacheEntry),
-		},
-		openFiles:      make(map[uint64]*OpenFile),
-		nextFh:         1,
-		statfsCacheTTL: 30 * time.Second, // Cache for 30 seconds
-		listCacheTTL:   2 * time.Second,  // Short cache for listings
-	}
-}
-
-// invalidateCaches invalidates all caches when the filesystem is modified
-func (fs *S3FS) invalidateCaches() {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-	fs.statfsCache = nil
-	fs.listCache = nil
-	fs.listCacheTime = time.Time{}
-	fmt.Printf("[Cache] *** CACHES INVALIDATED ***\n")
-}
+func NewS3FS(s3Client *storage.S3Client, bucketName string, opts Options) (*S3FS, error) {
+	if opts.MetadataTimeout <= 0 {
+		opts.MetadataTimeout = defaultMetadataTimeout
+	}
+	if opts.DataTimeout <= 0 {
+		opts.DataTimeout = defaultDataTimeout
+	}
 
-// getListObjects retrieves list of objects with cache
-func (fs *S3FS) getListObjects(ctx context.Context) ([]storage.ObjectInfo, error) {
-	fs.mu.RLock()
-	if fs.listCache != nil && time.Since(fs.listCacheTime) < fs.listCacheTTL {
-		cached := fs.listCache
-		fs.mu.RUnlock()
-		fmt.Printf("[Cache] Using cached object list (%d objects)\n", len(cached))
-		return cached, nil
+	if opts.ReadAheadMax == 0 {
+		opts.ReadAheadMax = defaultReadAheadMax
+	}
+	if opts.ListingRefresh <= 0 {
+		opts.ListingRefresh = defaultListingRefresh
+	}
+	if opts.FileAttrTTL == 0 {
+		opts.FileAttrTTL = defaultFileAttrTTL
+	}
+	if opts.DirAttrTTL == 0 {
+		opts.DirAttrTTL = defaultDirAttrTTL
+	}
+	if opts.NegativeAttrTTL == 0 {
+		opts.NegativeAttrTTL = defaultNegativeAttrTTL
 	}
-	fs.mu.RUnlock()
 
-	// Fetch from S3
-	objects, err := fs.s3Client.ListObjects(ctx, fs.bucketName, "")
+	dirMarkers, err := ParseDirMarkers(string(opts.DirMarkers))
+	if err != nil {
+		return nil, err
+	}
+	names, err := ParseNameEncoding(opts.NameEncoding)
 	if err != nil {
 		return nil, err
 	}
 
-	// Save to cache
-	fs.mu.Lock()
-	fs.listCache = objects
-	fs.listCacheTime = time.Now()
-	fs.mu.Unlock()
+	if opts.UploadConcurrency <= 0 {
+		opts.UploadConcurrency = defaultUploadConcurrency
+	}
+	if opts.UploadRetries == 0 {
+		opts.UploadRetries = defaultUploadRetries
+	}
+	opts.UploadRetries = max(opts.UploadRetries, 0)
 
-	fmt.Printf("[Cache] Cached new object list (%d objects)\n", len(objects))
-	return objects, nil
+	if opts.StagingDir == "" {
+		opts.StagingDir = config.StagingDir("", s3Client.Endpoint(), bucketName)
+	}
+	journal, err := prepareStagingDir(opts.StagingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	rootCtx, cancelRoot := context.WithCancel(context.Background())
+
+	fs := &S3FS{
+		s3Client:        s3Client,
+		bucketName:      bucketName,
+		cache:           newFileCache(opts.FileAttrTTL, opts.DirAttrTTL, opts.NegativeAttrTTL),
+		openFiles:       make(map[uint64]*writeHandle),
+		nodes:           make(map[string]*OpenFile),
+		readFiles:       make(map[uint64]*readHandle),
+		nextFh:          1,
+		statfsCacheTTL:  30 * time.Second, // Cache for 30 seconds
+		tree:            newTreeIndex(opts.ListingRefresh, opts.CaseInsensitive),
+		dirMarkers:      dirMarkers,
+		names:           names,
+		links:           newLinkCache(),
+		inodes:          newInodeTable(),
+		rootCtx:         rootCtx,
+		cancelRoot:      cancelRoot,
+		metadataTimeout: opts.MetadataTimeout,
+		dataTimeout:     opts.DataTimeout,
+		audit:           opts.Audit,
+		blocks:          opts.BlockCache,
+		readAhead:       newReadAhead(opts.ReadAheadMax),
+		stagingDir:      opts.StagingDir,
+		pending:         journal,
+		uploads:         newUploadQueue(opts.UploadConcurrency, opts.UploadRetries, opts.OnUploadFailed),
+		locks:           newLockTable(),
+	}
+	fs.uploads.idle = sync.NewCond(&fs.mu)
+	if opts.Leases {
+		if opts.LeaseTTL <= 0 {
+			opts.LeaseTTL = defaultLeaseTTL
+		}
+		fs.leases = newLeaseManager(opts.LeaseOwner, opts.LeaseTTL, opts.OnLeaseConflict)
+	}
+
+	if len(journal) > 0 {
+		logger.Info("journal: found pending uploads from a previous run", "bucket", bucketName, "count", len(journal))
+		fs.replayJournal()
+	}
+	fs.resumeRenames()
+	return fs, nil
+}
+
+// Shutdown cancels every in-flight and future S3 request of this mount, after
+// journaling the changes of open files whose journal is behind. It must be
+// called before unmounting so blocked FUSE threads are released.
+func (fs *S3FS) Shutdown() {
+	fs.journalPending()
+	fs.cancelRoot()
+}
+
+// Destroy is called by the FUSE host when the filesystem is unmounted
+func (fs *S3FS) Destroy() {
+	logger.Info("destroy: cancelling in-flight S3 requests", "bucket", fs.bucketName)
+	fs.Shutdown()
+	releaseStagingDir(fs.stagingDir)
+}
+
+// metadataContext returns a context for a metadata request (list, stat, delete, copy)
+func (fs *S3FS) metadataContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(fs.rootCtx, fs.metadataTimeout)
+}
+
+// dataContext returns a context for an object transfer (read, download, upload)
+func (fs *S3FS) dataContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(fs.rootCtx, fs.dataTimeout)
+}
+
+// errnoFromError maps a storage error to the FUSE error reported to the OS.
+// Timeouts and cancellations get their own codes; anything else uses fallback.
+func errnoFromError(err error, fallback int) int {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return -cgofuse.ETIMEDOUT
+	case errors.Is(err, context.Canceled):
+		return -cgofuse.ECANCELED
+	default:
+		return fallback
+	}
+}
+
+// invalidateStatfs drops the bucket usage snapshot
+func (fs *S3FS) invalidateStatfs() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.statfsCache = nil
 }
 
 // Statfs retrieves filesystem information
-func (fs *S3FS) Statfs(path string, stat *cgofuse.Statfs_t) int {
-	fmt.Printf("[Statfs] path='%s'\n", path)
+func (fs *S3FS) Statfs(path string, stat *cgofuse.Statfs_t) (errc int) {
+	defer trackOp("Statfs", time.Now(), &errc)
+	logger.Debug("statfs", "path", path)
 
 	fs.mu.RLock()
 	// Check cache
 	if fs.statfsCache != nil && time.Since(fs.statfsCacheTime) < fs.statfsCacheTTL {
 		*stat = *fs.statfsCache
-		totalBytes := stat.Blocks * stat.Bsize
-		usedBytes := (stat.Blocks - stat.Bfree) * stat.Bsize
 		fs.mu.RUnlock()
-		fmt.Printf("[Statfs] Using cached value: Total=%d GB, Used=%d MB\n",
-			totalBytes/(1024*1024*1024), usedBytes/(1024*1024))
+		trackCache("statfs", true)
 		return 0
 	}
 	fs.mu.RUnlock()
+	trackCache("statfs", false)
 
 	// Calculate total bucket size
-	ctx := context.Background()
+	ctx, cancel := fs.metadataContext()
+	defer cancel()
 	objects, err := fs.s3Client.ListObjects(ctx, fs.bucketName, "")
 	if err != nil {
-		fmt.Printf("[Statfs] Error listing objects: %v\n", err)
+		logger.Warn("statfs: error listing objects", "error", err)
 		// Valores por defecto si hay error
 		stat.Bsize = 4096
 		stat.Frsize = 4096
@@ -148,7 +346,7 @@ func (fs *S3FS) Statfs(path string, stat *cgofuse.Statfs_t) int {
 	var totalSize int64
 	var fileCount int64
 	for _, obj := range objects {
-		if !obj.IsDir {
+		if _, marker := markerDir(obj.Key); !marker {
 			totalSize += obj.Size
 			fileCount++
 		}
@@ -184,241 +382,278 @@ func (fs *S3FS) Statfs(path string, stat *cgofuse.Statfs_t) int {
 	fs.statfsCacheTime = time.Now()
 	fs.mu.Unlock()
 
-	totalBytes := stat.Blocks * stat.Bsize
-	usedBytes := (stat.Blocks - stat.Bfree) * stat.Bsize
-	fmt.Printf("[Statfs] *** NEW CALCULATION ***\n")
-	fmt.Printf("[Statfs] Files in bucket: %d files = %d MB\n", fileCount, totalSize/(1024*1024))
-	fmt.Printf("[Statfs] Total volume size: %d GB\n", totalBytes/(1024*1024*1024))
-	fmt.Printf("[Statfs] Used space: %d MB\n", usedBytes/(1024*1024))
-	fmt.Printf("[Statfs] Free space: %d GB\n", (stat.Bfree*stat.Bsize)/(1024*1024*1024))
+	logger.Debug("statfs: recalculated volume usage",
+		"files", fileCount,
+		"used_bytes", totalSize,
+		"total_bytes", stat.Blocks*stat.Bsize,
+		"free_bytes", stat.Bfree*stat.Bsize)
 	return 0
 }
 
 // Open opens a file
-func (fs *S3FS) Open(path string, flags int) (int, uint64) {
-	path = strings.TrimPrefix(path, "/")
-	fmt.Printf("[Open] path='%s' flags=%d\n", path, flags)
+func (fs *S3FS) Open(path string, flags int) (errc int, _ uint64) {
+	defer trackOp("Open", time.Now(), &errc)
+	path = fs.resolvePath(path)
+	logger.Debug("open", "path", path, "flags", flags)
 
-	// Si es solo lectura, no crear file handle especial
 	isWrite := (flags&cgofuse.O_WRONLY != 0) || (flags&cgofuse.O_RDWR != 0)
 	if !isWrite {
-		fmt.Printf("[Open] Read-only mode\n")
-		return 0, 0
+		return fs.openRead(path)
 	}
 
-	// Modo escritura: crear archivo temporal
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	fh := fs.nextFh
-	fs.nextFh++
-
-	// Create temporary file
-	tempDir := os.TempDir()
-	tempFile := filepath.Join(tempDir, fmt.Sprintf("maxiofs-%d.tmp", fh))
+	return fs.openWrite(path, flags)
+}
 
-	var fileSize int64 = 0
+// openWrite allocates a handle for a write open. Opens of a path that is
+// already open for writing share its staging file. Nothing is downloaded here;
+// with O_TRUNC the existing content is not even looked up.
+func (fs *S3FS) openWrite(path string, flags int) (int, uint64) {
+	if node := fs.acquireNode(path); node != nil {
+		return fs.openHandle(node, flags)
+	}
 
-	// Si el archivo existe en S3, descargarlo al temp
-	ctx := context.Background()
-	reader, size, err := fs.s3Client.GetObject(ctx, fs.bucketName, path)
-	if err == nil && reader != nil {
-		tmpF, err := os.Create(tempFile)
-		if err == nil {
-			io.Copy(tmpF, reader)
-			tmpF.Close()
-			fileSize = size
-			fmt.Printf("[Open] Downloaded existing file to temp, size: %d\n", size)
+	var base storage.ObjectInfo
+	if flags&cgofuse.O_TRUNC == 0 {
+		// The new staging file is based on the bucket's version, so an earlier
+		// change to the same file must reach the bucket first
+		if errc := fs.awaitUploads(path); errc != 0 {
+			return errc, ^uint64(0)
 		}
-		reader.Close()
-	} else {
-		// Create empty temporary file
-		tmpF, err := os.Create(tempFile)
-		if err == nil {
-			tmpF.Close()
+		ctx, cancel := fs.metadataContext()
+		defer cancel()
+		obj, found, err := fs.lookupObject(ctx, path)
+		if err != nil {
+			logger.Error("open: error looking up object", "path", path, "error", err)
+			return errnoFromError(err, -cgofuse.EIO), ^uint64(0)
+		}
+		if found {
+			base = obj
 		}
-		fmt.Printf("[Open] Created empty temp file\n")
 	}
+	return fs.openStaged(path, base, flags)
+}
 
-	fs.openFiles[fh] = &OpenFile{
-		Path:     path,
-		TempFile: tempFile,
-		Size:     fileSize,
-		Dirty:    false,
+// openStaged opens a handle on a new staging file that starts as base
+func (fs *S3FS) openStaged(path string, base storage.ObjectInfo, flags int) (int, uint64) {
+	tempFile, err := fs.newStagingFile()
+	if err != nil {
+		logger.Error("open: cannot create temp file", "path", path, "error", err)
+		return -cgofuse.EIO, ^uint64(0)
 	}
 
-	fmt.Printf("[Open] Created file handle %d with temp file %s\n", fh, tempFile)
-	return 0, fh
+	node := fs.addNode(&OpenFile{
+		Path:     path,
+		TempFile: tempFile,
+		Size:     base.Size,
+		ModTime:  base.LastModified,
+		Base:     base,
+		BaseSize: base.Size,
+	})
+	return fs.openHandle(node, flags)
 }
 
-// Flush synchronizes data to storage
-func (fs *S3FS) Flush(path string, fh uint64) int {
-	path = strings.TrimPrefix(path, "/")
-	fmt.Printf("[Flush] path='%s' fh=%d\n", path, fh)
-
-	fs.mu.Lock()
-	openFile, exists := fs.openFiles[fh]
-	if !exists || !openFile.Dirty {
-		fs.mu.Unlock()
-		fmt.Printf("[Flush] Nothing to flush\n")
-		return 0
+// newStagingFile creates an empty staging file
+func (fs *S3FS) newStagingFile() (string, error) {
+	// Unique within the mount's private directory, created with mode 0600
+	tmpF, err := os.CreateTemp(fs.stagingDir, stagingPattern)
+	if err != nil {
+		return "", err
 	}
+	tmpF.Close()
+	return tmpF.Name(), nil
+}
 
-	tempFile := openFile.TempFile
-	filePath := openFile.Path
-	fs.mu.Unlock()
-
-	// Subir archivo temporal a S3 usando UploadFile del SDK
-	ctx := context.Background()
-	fmt.Printf("[Flush] Uploading temp file %s to S3: %s\n", tempFile, filePath)
-
-	err := fs.s3Client.UploadFile(ctx, fs.bucketName, filePath, tempFile)
+// openRead allocates a handle for a read-only open
+func (fs *S3FS) openRead(path string) (int, uint64) {
+	ctx, cancel := fs.metadataContext()
+	defer cancel()
+	obj, found, err := fs.lookupObject(ctx, path)
 	if err != nil {
-		fmt.Printf("[Flush] Error uploading: %v\n", err)
-		return -cgofuse.EIO
+		logger.Error("open: error looking up object", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.EIO), ^uint64(0)
 	}
 
-	// Marcar como no dirty
-	fs.mu.Lock()
-	if openFile, exists := fs.openFiles[fh]; exists {
-		openFile.Dirty = false
+	handleCtx, cancelHandle := context.WithCancel(fs.rootCtx)
+	h := &readHandle{Path: path, ctx: handleCtx, cancel: cancelHandle}
+	if found {
+		// Otherwise the object is not listed yet and Read looks it up again
+		h.obj = obj
 	}
-	fs.mu.Unlock()
 
-	// Invalidar TODOS los caches para forzar refresh
-	fs.invalidateCaches()
+	fs.mu.Lock()
+	fh := fs.nextFh
+	fs.nextFh++
+	fs.readFiles[fh] = h
+	fs.mu.Unlock()
 
-	fmt.Printf("[Flush] Successfully uploaded to S3 and invalidated caches\n")
-	return 0
+	logger.Debug("open: created read handle", "path", path, "fh", fh)
+	return 0, fh
 }
 
-// Release closes a file
-func (fs *S3FS) Release(path string, fh uint64) int {
-	fmt.Printf("[Release] *** CLOSING FILE *** path='%s' fh=%d\n", path, fh)
+// Flush is called on every close of a handle. Nothing is uploaded here: the
+// staged data is journaled, so it survives a restart, and uploaded in the
+// background once the handle is released.
+func (fs *S3FS) Flush(path string, fh uint64) (errc int) {
+	defer trackOp("Flush", time.Now(), &errc)
+	logger.Debug("flush", "path", path, "fh", fh)
 
-	// Check for pending data
 	fs.mu.RLock()
-	openFile, exists := fs.openFiles[fh]
-	var tempFile string
-	if exists {
-		fmt.Printf("[Release] File size: %d bytes, dirty=%v\n", openFile.Size, openFile.Dirty)
-		tempFile = openFile.TempFile
-	}
+	handle, exists := fs.openFiles[fh]
+	dirty := exists && handle.Dirty
 	fs.mu.RUnlock()
-
-	// Flush antes de cerrar
-	result := fs.Flush(path, fh)
-	if result != 0 {
-		fmt.Printf("[Release] *** ERROR *** Flush failed with code %d\n", result)
+	if dirty {
+		handle.stageMu.Lock()
+		fs.journalLocked(handle.OpenFile)
+		handle.stageMu.Unlock()
 	}
+	return 0
+}
 
-	// Eliminar archivo temporal
-	if tempFile != "" {
-		os.Remove(tempFile)
-		fmt.Printf("[Release] Deleted temp file: %s\n", tempFile)
-	}
+// Release closes a file. When the last handle on a file with changes is
+// closed, the file is handed to the upload queue, so closing a large file does
+// not wait for its upload.
+func (fs *S3FS) Release(path string, fh uint64) (errc int) {
+	defer trackOp("Release", time.Now(), &errc)
+	logger.Debug("release", "path", path, "fh", fh)
 
-	// Limpiar file handle
 	fs.mu.Lock()
+	h, isRead := fs.readFiles[fh]
+	delete(fs.readFiles, fh)
+	handle, exists := fs.openFiles[fh]
 	delete(fs.openFiles, fh)
 	fs.mu.Unlock()
+	fs.locks.releaseOwner(fh)
+	if isRead {
+		h.close()
+	}
+	if exists {
+		fs.closeNode(handle.OpenFile)
+	}
+	return 0
+}
+
+// Fsync returns once the changes made to path are in the bucket: those of fh
+// when it is open for writing, and those of handles already released
+func (fs *S3FS) Fsync(path string, datasync bool, fh uint64) (errc int) {
+	defer trackOp("Fsync", time.Now(), &errc)
+	path = fs.resolvePath(path)
+	logger.Debug("fsync", "path", path, "fh", fh)
 
-	fmt.Printf("[Release] *** FILE CLOSED *** handle %d\n", fh)
+	ctx, cancel := fs.dataContext()
+	defer cancel()
+
+	err := fs.syncUploads(ctx, path)
+	if err == nil {
+		err = fs.failedUpload(path)
+	}
+	if err == nil {
+		fs.mu.RLock()
+		openFile, exists := fs.openFiles[fh]
+		fs.mu.RUnlock()
+		if exists {
+			err = fs.commitOpen(ctx, openFile.OpenFile)
+		}
+	}
+	if err != nil {
+		logger.Error("fsync: upload failed", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.EIO)
+	}
+	return 0
+}
+
+// Fsyncdir returns once the released files below path are in the bucket
+func (fs *S3FS) Fsyncdir(path string, datasync bool, fh uint64) (errc int) {
+	defer trackOp("Fsyncdir", time.Now(), &errc)
+	path = fs.resolvePath(path)
+	logger.Debug("fsyncdir", "path", path)
+
+	ctx, cancel := fs.dataContext()
+	defer cancel()
+	if err := fs.syncUploads(ctx, path); err != nil {
+		logger.Error("fsyncdir: upload failed", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.EIO)
+	}
 	return 0
 }
 
 // Opendir opens a directory for reading
 func (fs *S3FS) Opendir(path string) (int, uint64) {
-	fmt.Printf("[Opendir] path='%s'\n", path)
+	logger.Debug("opendir", "path", path)
 	return 0, 0
 }
 
 // Releasedir closes a directory
 func (fs *S3FS) Releasedir(path string, fh uint64) int {
-	fmt.Printf("[Releasedir] path='%s' fh=%d\n", path, fh)
+	logger.Debug("releasedir", "path", path, "fh", fh)
 	return 0
 }
 
 // Getattr retrieves attributes of a file/directory
-func (fs *S3FS) Getattr(path string, stat *cgofuse.Stat_t, fh uint64) int {
-	path = strings.TrimPrefix(path, "/")
-	fmt.Printf("[Getattr] path='%s' fh=%d\n", path, fh)
+func (fs *S3FS) Getattr(path string, stat *cgofuse.Stat_t, fh uint64) (errc int) {
+	defer trackOp("Getattr", time.Now(), &errc)
+	path = fs.resolvePath(path)
+	logger.Debug("getattr", "path", path, "fh", fh)
 
 	// Root
 	if path == "" {
 		stat.Mode = cgofuse.S_IFDIR | 0777 // Todos los permisos
 		stat.Nlink = 2
+		stat.Ino = rootIno
 		stat.Uid = 0
 		stat.Gid = 0
 		now := time.Now().Unix()
 		stat.Atim.Sec = now
 		stat.Mtim.Sec = now
 		stat.Ctim.Sec = now
-		fmt.Printf("[Getattr] Returning root directory (mode=0777)\n")
 		return 0
 	}
 
-	// PRIMERO: Verificar si existe un archivo abierto en escritura
+	// Files open for writing show their staged size and mtime
 	fs.mu.RLock()
-	for _, openFile := range fs.openFiles {
-		if openFile.Path == path {
-			fmt.Printf("[Getattr] *** FOUND OPEN FILE *** path='%s' size=%d\n", path, openFile.Size)
-			stat.Mode = cgofuse.S_IFREG | 0666
-			stat.Size = openFile.Size
-			stat.Uid = 0
-			stat.Gid = 0
-			now := time.Now().Unix()
-			stat.Atim.Sec = now
-			stat.Mtim.Sec = now
-			stat.Ctim.Sec = now
-			fs.mu.RUnlock()
-			return 0
-		}
+	if node, open := fs.nodes[path]; open {
+		logger.Debug("getattr: found open file", "path", path, "size", node.Size)
+		fs.fillStat(stat, path, storage.ObjectInfo{Key: path, Size: node.Size, LastModified: node.ModTime})
+		fs.mu.RUnlock()
+		return 0
 	}
 	fs.mu.RUnlock()
 
-	ctx := context.Background()
-
-	// Buscar coincidencia exacta en S3
-	objects, err := fs.getListObjects(ctx)
-	if err != nil {
-		fmt.Printf("[Getattr] Error listing objects: %v\n", err)
-		return -cgofuse.ENOENT
+	// Released files show their local version until the upload commits
+	if entry, queued := fs.queuedFile(path); queued {
+		fs.mu.RLock()
+		info := entry.localInfo()
+		fs.mu.RUnlock()
+		fs.fillStat(stat, path, info)
+		return 0
 	}
 
-	fmt.Printf("[Getattr] Checking %d objects in S3\n", len(objects))
+	ctx, cancel := fs.metadataContext()
+	defer cancel()
 
-	// Buscar coincidencia exacta
-	for _, obj := range objects {
-		objPath := strings.TrimPrefix(obj.Key, "/")
-		if objPath == path || objPath == path+"/" {
-			fmt.Printf("[Getattr] Found exact match: %s (IsDir=%v, Size=%d)\n", obj.Key, obj.IsDir, obj.Size)
-			if obj.IsDir {
-				stat.Mode = cgofuse.S_IFDIR | 0777
-			} else {
-				stat.Mode = cgofuse.S_IFREG | 0666
-				stat.Size = obj.Size
-				stat.Mtim.Sec = obj.LastModified.Unix()
-			}
-			stat.Uid = 0
-			stat.Gid = 0
-			return 0
+	if entry, ok := fs.cache.Get(path); ok {
+		trackCache("attr", true)
+		if entry.Negative {
+			return -cgofuse.ENOENT
 		}
+		fs.fillStat(stat, path, fs.resolveLink(ctx, path, entry.Info))
+		return 0
 	}
+	trackCache("attr", false)
 
-	// Check if it's an implicit directory (has children)
-	pathPrefix := path + "/"
-	for _, obj := range objects {
-		if strings.HasPrefix(obj.Key, pathPrefix) {
-			fmt.Printf("[Getattr] Found implicit directory: %s\n", path)
-			stat.Mode = cgofuse.S_IFDIR | 0777
-			stat.Uid = 0
-			stat.Gid = 0
-			return 0
-		}
+	if err := fs.refreshTree(ctx); err != nil {
+		logger.Warn("getattr: error listing objects", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.ENOENT)
 	}
 
-	fmt.Printf("[Getattr] Not found: %s\n", path)
+	if info, found := fs.tree.lookup(path); found {
+		info = fs.resolveLink(ctx, path, info)
+		fs.cache.Put(path, info)
+		fs.fillStat(stat, path, info)
+		return 0
+	}
+
+	logger.Debug("getattr: not found", "path", path)
+	fs.cache.PutNegative(path)
 	return -cgofuse.ENOENT
 }
 
@@ -426,418 +661,679 @@ func (fs *S3FS) Getattr(path string, stat *cgofuse.Stat_t, fh uint64) int {
 func (fs *S3FS) Readdir(path string,
 	fill func(name string, stat *cgofuse.Stat_t, ofst int64) bool,
 	ofst int64,
-	fh uint64) int {
+	fh uint64) (errc int) {
+	defer trackOp("Readdir", time.Now(), &errc)
 
-	path = strings.TrimPrefix(path, "/")
-	fmt.Printf("[Readdir] path=%s\n", path)
+	path = fs.resolvePath(path)
+	logger.Debug("readdir", "path", path)
 
-	ctx := context.Background()
-	objects, err := fs.getListObjects(ctx)
-	if err != nil {
-		fmt.Printf("[Readdir] Error listing objects: %v\n", err)
+	ctx, cancel := fs.metadataContext()
+	defer cancel()
+	if err := fs.refreshTree(ctx); err != nil {
+		logger.Warn("readdir: error listing objects", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.ENOENT)
+	}
+	entries, found := fs.tree.list(path)
+	if !found {
 		return -cgofuse.ENOENT
 	}
 
-	fmt.Printf("[Readdir] Processing %d objects\n", len(objects))
-
 	fill(".", nil, 0)
 	fill("..", nil, 0)
 
-	// Mapa para evitar duplicados
-	seen := make(map[string]bool)
-
-	// Prefijo del directorio actual
 	var prefix string
 	if path != "" {
 		prefix = path + "/"
 	}
 
-	for _, obj := range objects {
-		objKey := strings.TrimPrefix(obj.Key, "/")
-
-		// Si estamos en root, mostrar todo
-		// Si no, solo mostrar items que empiecen con el prefijo
-		if prefix != "" && !strings.HasPrefix(objKey, prefix) {
-			continue
-		}
-
-		// Obtener la parte relativa
-		relativePath := objKey
-		if prefix != "" {
-			relativePath = strings.TrimPrefix(objKey, prefix)
-		}
-
-		// If empty or same directory, skip
-		if relativePath == "" || relativePath == "/" {
-			continue
-		}
-
-		// Si contiene /, es un subdirectorio
-		var name string
-		isDir := false
-		if idx := strings.Index(relativePath, "/"); idx > 0 {
-			name = relativePath[:idx]
-			isDir = true
-		} else {
-			name = relativePath
-			isDir = obj.IsDir
-		}
-
-		// Evitar duplicados
-		if seen[name] {
-			continue
-		}
-		seen[name] = true
-
-		fmt.Printf("[Readdir] Adding: %s (isDir=%v)\n", name, isDir)
+	// Explorer stats every entry right after listing, answer those from the cache
+	infos := fs.resolveLinks(ctx, prefix, entries)
+	for i, entry := range entries {
+		info := infos[i]
+		fs.cache.Put(prefix+entry.Name, info)
 
 		var stat cgofuse.Stat_t
-		if isDir {
-			stat.Mode = cgofuse.S_IFDIR | 0777
-		} else {
-			stat.Mode = cgofuse.S_IFREG | 0666
-			stat.Size = obj.Size
-			stat.Mtim.Sec = obj.LastModified.Unix()
+		fs.fillStat(&stat, prefix+entry.Name, info)
+		if !fill(entry.Shown, &stat, 0) {
+			break
 		}
-		stat.Uid = 0
-		stat.Gid = 0
-
-		fill(name, &stat, 0)
 	}
 
 	return 0
 }
 
 // Read reads data from a file
-func (fs *S3FS) Read(path string, buff []byte, ofst int64, fh uint64) int {
-	path = strings.TrimPrefix(path, "/")
-	fmt.Printf("[Read] path=%s offset=%d len=%d\n", path, ofst, len(buff))
-
-	ctx := context.Background()
-	reader, size, err := fs.s3Client.GetObject(ctx, fs.bucketName, path)
-	if err != nil {
-		fmt.Printf("[Read] Error getting object: %v\n", err)
-		return -cgofuse.EIO
-	}
-	defer reader.Close()
+func (fs *S3FS) Read(path string, buff []byte, ofst int64, fh uint64) (n int) {
+	defer trackOp("Read", time.Now(), &n)
+	path = fs.resolvePath(path)
+	logger.Debug("read", "path", path, "offset", ofst, "len", len(buff))
 
-	fmt.Printf("[Read] Object size: %d\n", size)
+	ctx, cancel := fs.dataContext()
+	defer cancel()
 
-	// Check if offset is out of range
-	if ofst >= size {
-		return 0
+	// Files open for writing are read from their staging file, through any handle
+	fs.mu.RLock()
+	openFile, staged := fs.nodes[path]
+	if handle, ok := fs.openFiles[fh]; ok {
+		openFile, staged = handle.OpenFile, true
 	}
-
-	// Seek al offset descartando bytes
-	if ofst > 0 {
-		discarded, err := io.CopyN(io.Discard, reader, ofst)
+	fs.mu.RUnlock()
+	if staged {
+		n, err := fs.readStaged(ctx, openFile, buff, ofst)
 		if err != nil {
-			fmt.Printf("[Read] Error seeking to offset: %v\n", err)
-			return -cgofuse.EIO
+			logger.Error("read: error reading staged file", "path", path, "offset", ofst, "error", err)
+			return errnoFromError(err, -cgofuse.EIO)
+		}
+		BytesTotal.Add(float64(n), "read")
+		return n
+	}
+	if entry, queued := fs.queuedFile(path); queued {
+		n, ok, err := fs.readQueued(ctx, entry, buff, ofst)
+		if err != nil {
+			logger.Error("read: error reading staged file", "path", path, "offset", ofst, "error", err)
+			return errnoFromError(err, -cgofuse.EIO)
+		}
+		if ok {
+			BytesTotal.Add(float64(n), "read")
+			return n
 		}
-		fmt.Printf("[Read] Discarded %d bytes to reach offset\n", discarded)
 	}
 
-	// Leer datos
-	n, err := io.ReadFull(reader, buff)
-	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-		fmt.Printf("[Read] Error reading: %v\n", err)
-		return -cgofuse.EIO
+	// Reads are pinned to one ETag (the one seen at open for handles); if the
+	// object changed meanwhile, refresh the listing once and read the new version
+	h := fs.readHandle(fh)
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		obj, found := storage.ObjectInfo{}, false
+		if h != nil && attempt == 0 {
+			obj, found = h.object()
+		}
+		if !found {
+			var lookupErr error
+			obj, found, lookupErr = fs.lookupObject(ctx, path)
+			if lookupErr != nil {
+				logger.Error("read: error looking up object", "path", path, "error", lookupErr)
+				return errnoFromError(lookupErr, -cgofuse.EIO)
+			}
+			if !found {
+				logger.Warn("read: object not found", "path", path)
+				return -cgofuse.ENOENT
+			}
+			if h != nil {
+				h.setObject(obj)
+			}
+		}
+
+		n, err = fs.readObject(ctx, obj, buff, ofst, h)
+		if err == nil || !storage.IsPreconditionFailed(err) {
+			break
+		}
+		logger.Debug("read: object changed, refreshing listing", "path", path)
+		fs.invalidateBlocks(path)
+		fs.invalidatePath(path)
+		fs.tree.invalidate()
+	}
+	if err != nil {
+		logger.Error("read: error reading", "path", path, "offset", ofst, "error", err)
+		return errnoFromError(err, -cgofuse.EIO)
 	}
 
-	fmt.Printf("[Read] Read %d bytes\n", n)
+	BytesTotal.Add(float64(n), "read")
 	return n
 }
 
 // Write writes data to a file
-func (fs *S3FS) Write(path string, buff []byte, ofst int64, fh uint64) int {
-	path = strings.TrimPrefix(path, "/")
-	fmt.Printf("[Write] *** WRITING DATA *** path='%s' offset=%d len=%d fh=%d\n", path, ofst, len(buff), fh)
+func (fs *S3FS) Write(path string, buff []byte, ofst int64, fh uint64) (n int) {
+	defer trackOp("Write", time.Now(), &n)
+	path = fs.resolvePath(path)
+	logger.Debug("write", "path", path, "offset", ofst, "len", len(buff), "fh", fh)
 
 	fs.mu.RLock()
 	openFile, exists := fs.openFiles[fh]
 	if !exists {
 		fs.mu.RUnlock()
-		fmt.Printf("[Write] *** ERROR *** File handle not found: %d\n", fh)
+		logger.Warn("write: file handle not found", "path", path, "fh", fh)
 		return -cgofuse.EBADF
 	}
 	tempFile := openFile.TempFile
 	fs.mu.RUnlock()
 
+	openFile.stageMu.Lock()
+	defer openFile.stageMu.Unlock()
+
 	// Abrir archivo temporal para escribir
 	f, err := os.OpenFile(tempFile, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
-		fmt.Printf("[Write] *** ERROR *** Cannot open temp file: %v\n", err)
+		logger.Error("write: cannot open temp file", "path", path, "error", err)
 		return -cgofuse.EIO
 	}
 	defer f.Close()
 
+	if openFile.Append {
+		fs.mu.RLock()
+		ofst = openFile.Size
+		fs.mu.RUnlock()
+	}
+
 	// Escribir en el offset correcto
 	_, err = f.WriteAt(buff, ofst)
 	if err != nil {
-		fmt.Printf("[Write] *** ERROR *** Cannot write to temp file: %v\n", err)
+		logger.Error("write: cannot write to temp file", "path", path, "error", err)
 		return -cgofuse.EIO
 	}
 
 	// Update size
 	newSize := ofst + int64(len(buff))
+	openFile.present.add(ofst, newSize)
+	openFile.modified.add(ofst, newSize)
 	fs.mu.Lock()
-	if openFile, exists := fs.openFiles[fh]; exists {
-		if newSize > openFile.Size {
-			openFile.Size = newSize
-		}
-		openFile.Dirty = true
+	if newSize > openFile.Size {
+		openFile.Size = newSize
 	}
+	openFile.ModTime = time.Now()
+	openFile.Dirty = true
 	fs.mu.Unlock()
+	fs.journalSoon(openFile.OpenFile)
 
-	fmt.Printf("[Write] *** SUCCESS *** Written %d bytes to temp file at offset %d\n", len(buff), ofst)
+	BytesTotal.Add(float64(len(buff)), "write")
 	return len(buff)
 }
 
 // Create creates a file
-func (fs *S3FS) Create(path string, flags int, mode uint32) (int, uint64) {
-	path = strings.TrimPrefix(path, "/")
-	fmt.Printf("[Create] *** CREATING FILE ***\n")
-	fmt.Printf("[Create] path='%s' flags=%d mode=%o\n", path, flags, mode)
-
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+func (fs *S3FS) Create(path string, flags int, mode uint32) (errc int, _ uint64) {
+	defer trackOp("Create", time.Now(), &errc)
+	path = fs.resolvePath(path)
+	logger.Debug("create", "path", path, "flags", flags, "mode", fmt.Sprintf("%o", mode))
+
+	// The file is open for writing already: it exists
+	if node := fs.acquireNode(path); node != nil {
+		if flags&cgofuse.O_EXCL != 0 {
+			fs.closeNode(node)
+			return -cgofuse.EEXIST, ^uint64(0)
+		}
+		return fs.openHandle(node, flags)
+	}
 
-	// Crear nuevo file handle
-	fh := fs.nextFh
-	fs.nextFh++
+	if errc := fs.awaitUploads(path); errc != 0 {
+		return errc, ^uint64(0)
+	}
+	ctx, cancel := fs.metadataContext()
+	defer cancel()
+
+	// Create is also called for files that already exist; it must not replace them
+	existing, err := fs.s3Client.HeadObject(ctx, fs.bucketName, fs.objectKey(path))
+	if err == nil {
+		if flags&cgofuse.O_EXCL != 0 {
+			logger.Debug("create: file exists", "path", path)
+			return -cgofuse.EEXIST, ^uint64(0)
+		}
+		// The base is keyed by path like the ones from the listing
+		existing.Key = path
+		return fs.openStaged(path, *existing, flags)
+	}
+	if !storage.IsNotFound(err) {
+		logger.Error("create: error checking for existing file", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.EIO), ^uint64(0)
+	}
 
-	// Create temporary file
-	tempDir := os.TempDir()
-	tempFile := filepath.Join(tempDir, fmt.Sprintf("maxiofs-%d.tmp", fh))
+	// An exclusive create claims the key right away with a conditional put, so
+	// two machines racing for the same lock file cannot both succeed
+	var base storage.ObjectInfo
+	exclusive := flags&cgofuse.O_EXCL != 0
+	if exclusive {
+		rec := fs.beginAudit(auditCreate, path)
+		etag, err := fs.s3Client.CreateObjectExclusive(ctx, fs.bucketName, fs.objectKey(path), []byte{})
+		fs.finishAudit(rec, etag, err)
+		if storage.IsPreconditionFailed(err) {
+			logger.Debug("create: file created concurrently", "path", path)
+			fs.tree.invalidate()
+			return -cgofuse.EEXIST, ^uint64(0)
+		}
+		if err != nil {
+			logger.Error("create: error creating file", "path", path, "error", err)
+			return errnoFromError(err, -cgofuse.EIO), ^uint64(0)
+		}
+		base = storage.ObjectInfo{Key: path, LastModified: time.Now(), ETag: etag}
+	}
 
-	// Create empty file
-	tmpF, err := os.Create(tempFile)
+	tempFile, err := fs.newStagingFile()
 	if err != nil {
-		fmt.Printf("[Create] *** ERROR *** Cannot create temp file: %v\n", err)
+		logger.Error("create: cannot create temp file", "path", path, "error", err)
 		return -cgofuse.EIO, ^uint64(0)
 	}
-	tmpF.Close()
 
-	fs.openFiles[fh] = &OpenFile{
+	// A new file is uploaded on release even if nothing is written to it
+	openFile := &OpenFile{
 		Path:     path,
 		TempFile: tempFile,
 		Size:     0,
-		Dirty:    false,
+		ModTime:  time.Now(),
+		Dirty:    !exclusive,
+		Created:  !exclusive,
+		Base:     base,
+	}
+	if openFile.Dirty {
+		openFile.stageMu.Lock()
+		fs.journalLocked(openFile)
+		openFile.stageMu.Unlock()
 	}
+	node := fs.addNode(openFile)
 
-	fmt.Printf("[Create] *** SUCCESS *** File handle %d created with temp file %s\n", fh, tempFile)
-	return 0, fh
+	// List the new file while it is open, the upload records its version
+	fs.tree.putFile(path, storage.ObjectInfo{LastModified: time.Now(), ETag: base.ETag})
+	fs.cache.Invalidate(path)
+
+	logger.Debug("create: created file", "path", path, "exclusive", exclusive)
+	return fs.openHandle(node, flags)
 }
 
 // Unlink deletes a file
-func (fs *S3FS) Unlink(path string) int {
-	path = strings.TrimPrefix(path, "/")
-	fmt.Printf("[Unlink] path='%s'\n", path)
-
-	ctx := context.Background()
-	err := fs.s3Client.DeleteObject(ctx, fs.bucketName, path)
+func (fs *S3FS) Unlink(path string) (errc int) {
+	defer trackOp("Unlink", time.Now(), &errc)
+	path = fs.resolvePath(path)
+	logger.Debug("unlink", "path", path)
+
+	// Changes not uploaded yet would bring the file back
+	fs.dropStaged(path)
+
+	ctx, cancel := fs.metadataContext()
+	defer cancel()
+	rec := fs.beginAudit(auditUnlink, path)
+	if rec != nil {
+		rec.ETagBefore = fs.auditETag(ctx, rec, path)
+	}
+	err := fs.s3Client.DeleteObject(ctx, fs.bucketName, fs.objectKey(path))
+	fs.finishAudit(rec, "", err)
 	if err != nil {
-		fmt.Printf("[Unlink] Error deleting: %v\n", err)
-		return -cgofuse.EIO
+		logger.Error("unlink: error deleting", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.EIO)
 	}
 
-	// Invalidar TODOS los caches
-	fs.invalidateCaches()
+	fs.tree.remove(path)
+	fs.inodes.forget(path)
+	fs.invalidateBlocks(path)
+	fs.invalidatePath(path)
 
-	fmt.Printf("[Unlink] Successfully deleted: %s\n", path)
+	logger.Info("deleted file", "path", path)
 	return 0
 }
 
+// dropStaged discards the changes to path that have not been uploaded. Handles
+// still open keep working on their staging file, which is dropped when they close.
+func (fs *S3FS) dropStaged(path string) {
+	fs.mu.Lock()
+	node, open := fs.nodes[path]
+	if open {
+		node.removed = true
+		delete(fs.nodes, path)
+	}
+	fs.mu.Unlock()
+	if open {
+		node.stageMu.Lock()
+		node.unjournalLocked()
+		node.stageMu.Unlock()
+	}
+	fs.discardUploads(path)
+}
+
 // Mkdir creates a directory
-func (fs *S3FS) Mkdir(path string, mode uint32) int {
-	path = strings.TrimPrefix(path, "/")
-	fmt.Printf("[Mkdir] path='%s' mode=%o\n", path, mode)
-
-	// In S3, directories are implicit when files are created inside
-	// But some clients expect to be able to create empty directories
-	// Create a directory marker (object ending in /)
-	ctx := context.Background()
-	err := fs.s3Client.UploadData(ctx, fs.bucketName, path+"/", []byte{})
-	if err != nil {
-		fmt.Printf("[Mkdir] Error creating directory marker: %v\n", err)
-		return -cgofuse.EIO
+func (fs *S3FS) Mkdir(path string, mode uint32) (errc int) {
+	defer trackOp("Mkdir", time.Now(), &errc)
+	path = fs.resolvePath(path)
+	logger.Debug("mkdir", "path", path, "mode", fmt.Sprintf("%o", mode))
+
+	ctx, cancel := fs.metadataContext()
+	defer cancel()
+	if err := fs.refreshTree(ctx); err != nil {
+		logger.Error("mkdir: error listing objects", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.EIO)
+	}
+	if _, found := fs.tree.lookup(path); found {
+		return -cgofuse.EEXIST
+	}
+
+	// In S3, directories are implicit when files are created inside. Empty
+	// ones are kept with a marker object, or only locally without markers.
+	marker := fs.dirMarkers.key(path)
+	if marker != "" {
+		rec := fs.beginAudit(auditMkdir, marker)
+		etag, err := fs.s3Client.UploadData(ctx, fs.bucketName, fs.objectKey(marker), []byte{})
+		fs.finishAudit(rec, etag, err)
+		if err != nil {
+			logger.Error("mkdir: error creating directory marker", "path", path, "marker", marker, "error", err)
+			return errnoFromError(err, -cgofuse.EIO)
+		}
 	}
 
-	// Invalidar TODOS los caches
-	fs.invalidateCaches()
+	fs.tree.putDir(path, marker)
+	fs.invalidatePath(path)
 
-	fmt.Printf("[Mkdir] Directory created: %s\n", path)
+	logger.Info("created directory", "path", path)
 	return 0
 }
 
 // Rmdir deletes a directory
-func (fs *S3FS) Rmdir(path string) int {
-	path = strings.TrimPrefix(path, "/")
-	fmt.Printf("[Rmdir] path='%s'\n", path)
+func (fs *S3FS) Rmdir(path string) (errc int) {
+	defer trackOp("Rmdir", time.Now(), &errc)
+	path = fs.resolvePath(path)
+	logger.Debug("rmdir", "path", path)
+
+	ctx, cancel := fs.metadataContext()
+	defer cancel()
+	if err := fs.refreshTree(ctx); err != nil {
+		logger.Error("rmdir: error listing objects", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.EIO)
+	}
+	info, found := fs.tree.lookup(path)
+	if !found {
+		return -cgofuse.ENOENT
+	}
+	if !info.IsDir {
+		return -cgofuse.ENOTDIR
+	}
 
-	// Verify that the directory is empty
-	ctx := context.Background()
-	objects, err := fs.s3Client.ListObjects(ctx, fs.bucketName, path+"/")
+	// Verify that the directory is empty: its own marker does not count, while
+	// the markers of subdirectories do
+	objects, err := fs.listObjects(ctx, path+"/")
 	if err != nil {
-		fmt.Printf("[Rmdir] Error listing: %v\n", err)
-		return -cgofuse.EIO
+		logger.Error("rmdir: error listing", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.EIO)
 	}
-
-	if len(objects) > 0 {
-		fmt.Printf("[Rmdir] Directory not empty\n")
+	// Markers of any convention are removed, whichever this mount writes
+	markers := fs.tree.markers(path)
+	for _, obj := range objects {
+		if obj.Key != path+"/" {
+			logger.Debug("rmdir: directory not empty", "path", path, "first", obj.Key)
+			return -cgofuse.ENOTEMPTY
+		}
+		if !slices.Contains(markers, obj.Key) {
+			markers = append(markers, obj.Key)
+		}
+	}
+	// Files and folders not in the bucket yet
+	for p := range fs.localInfo() {
+		if p != path && isUnder(p, path) {
+			return -cgofuse.ENOTEMPTY
+		}
+	}
+	if fs.tree.hasLocalBelow(path) {
 		return -cgofuse.ENOTEMPTY
 	}
 
-	// Eliminar marcador de directorio si existe
-	fs.s3Client.DeleteObject(ctx, fs.bucketName, path+"/")
+	for _, marker := range markers {
+		rec := fs.beginAudit(auditRmdir, marker)
+		if rec != nil {
+			rec.ETagBefore = fs.auditETag(ctx, rec, marker)
+		}
+		err := fs.s3Client.DeleteObject(ctx, fs.bucketName, fs.objectKey(marker))
+		fs.finishAudit(rec, "", err)
+		if err != nil && !storage.IsNotFound(err) {
+			logger.Error("rmdir: error deleting directory marker", "path", path, "marker", marker, "error", err)
+			return errnoFromError(err, -cgofuse.EIO)
+		}
+	}
 
-	// Invalidar TODOS los caches
-	fs.invalidateCaches()
+	fs.tree.remove(path)
+	fs.inodes.forget(path)
+	fs.invalidatePath(path)
 
-	fmt.Printf("[Rmdir] Directory removed\n")
+	logger.Info("removed directory", "path", path)
 	return 0
 }
 
 // Access verifies access permissions
 func (fs *S3FS) Access(path string, mask uint32) int {
-	fmt.Printf("[Access] path='%s' mask=%d\n", path, mask)
+	logger.Debug("access", "path", path, "mask", mask)
 	// Always allow access
 	return 0
 }
 
 // Rename renames a file or directory
 func (fs *S3FS) Rename(oldpath string, newpath string) int {
-	oldpath = strings.TrimPrefix(oldpath, "/")
-	newpath = strings.TrimPrefix(newpath, "/")
-	fmt.Printf("[Rename] from='%s' to='%s'\n", oldpath, newpath)
-
-	ctx := context.Background()
+	return fs.Rename3(oldpath, newpath, 0)
+}
 
-	// Verificar si es un directorio
-	objects, err := fs.s3Client.ListObjects(ctx, fs.bucketName, "")
-	if err != nil {
-		fmt.Printf("[Rename] Error listing: %v\n", err)
-		return -cgofuse.EIO
+// Rename3 renames a file or directory. RENAME_NOREPLACE fails with EEXIST
+// when newpath exists; exchanging two paths is not supported. Files open for
+// writing or waiting for upload below oldpath move along, so they are
+// uploaded to their new keys.
+func (fs *S3FS) Rename3(oldpath string, newpath string, flags uint32) (errc int) {
+	defer trackOp("Rename", time.Now(), &errc)
+	oldpath = fs.resolvePath(oldpath)
+	newpath = fs.resolveNewPath(newpath, oldpath)
+	logger.Debug("rename", "from", oldpath, "to", newpath, "flags", flags)
+
+	if flags&^cgofuse.RENAME_NOREPLACE != 0 {
+		return -cgofuse.EINVAL
+	}
+	if oldpath == newpath {
+		return 0
+	}
+	// A directory cannot be moved below itself
+	if oldpath == "" || isUnder(newpath, oldpath) {
+		return -cgofuse.EINVAL
 	}
 
-	isDir := false
-	var filesToMove []string
+	// Server-side copies of a file move object data, so it is bounded by the data timeout
+	ctx, cancel := fs.dataContext()
+	defer cancel()
 
-	// Verificar si oldpath es un directorio mirando si existe oldpath/
-	for _, obj := range objects {
-		if obj.Key == oldpath+"/" {
-			isDir = true
-		}
-		// Recoger todos los archivos que empiezan con oldpath/
-		if strings.HasPrefix(obj.Key, oldpath+"/") {
-			filesToMove = append(filesToMove, obj.Key)
+	if err := fs.refreshTree(ctx); err != nil {
+		logger.Error("rename: error listing objects", "from", oldpath, "error", err)
+		return errnoFromError(err, -cgofuse.EIO)
+	}
+	src, found := fs.tree.lookup(oldpath)
+	if !found {
+		return -cgofuse.ENOENT
+	}
+	dst, replaces := fs.tree.lookup(newpath)
+	if replaces {
+		switch {
+		case flags&cgofuse.RENAME_NOREPLACE != 0:
+			return -cgofuse.EEXIST
+		case src.IsDir && !dst.IsDir:
+			return -cgofuse.ENOTDIR
+		case !src.IsDir && dst.IsDir:
+			return -cgofuse.EISDIR
+		case dst.IsDir:
+			if entries, _ := fs.tree.list(newpath); len(entries) > 0 {
+				return -cgofuse.ENOTEMPTY
+			}
 		}
 	}
 
-	// Si es directorio, mover todos los archivos
-	if isDir || len(filesToMove) > 0 {
-		fmt.Printf("[Rename] Moving directory with %d items using S3 CopyObject\n", len(filesToMove))
-		for _, oldKey := range filesToMove {
-			// Reemplazar prefijo
-			newKey := strings.Replace(oldKey, oldpath+"/", newpath+"/", 1)
+	// Uploads to either name wait, and staged files below oldpath are neither
+	// written nor uploaded, until their keys have moved
+	resume := fs.pauseUploads(oldpath, newpath)
+	defer resume()
+	staged := fs.lockStaged(oldpath)
+	defer func() {
+		for _, of := range staged {
+			of.stageMu.Unlock()
+		}
+	}()
 
-			// Copiar usando S3 CopyObject (server-side, eficiente)
-			err = fs.s3Client.CopyObject(ctx, fs.bucketName, oldKey, newKey)
+	moved := make(map[string]movedKey)
+	if src.IsDir {
+		objects, err := fs.listObjects(ctx, oldpath+"/")
+		if err != nil {
+			logger.Error("rename: error listing", "from", oldpath, "error", err)
+			return errnoFromError(err, -cgofuse.EIO)
+		}
+		// A "_$folder$" marker sits next to the directory rather than below it
+		targets := []string{DirMarkersSlash.key(newpath)}
+		for _, marker := range fs.tree.markers(oldpath) {
+			if marker != DirMarkersFolder.key(oldpath) {
+				continue
+			}
+			obj, err := fs.s3Client.HeadObject(ctx, fs.bucketName, fs.objectKey(marker))
+			if storage.IsNotFound(err) {
+				continue
+			}
 			if err != nil {
-				fmt.Printf("[Rename] Error copying %s to %s: %v\n", oldKey, newKey, err)
-				return -cgofuse.EIO
+				logger.Error("rename: error checking directory marker", "marker", marker, "error", err)
+				return errnoFromError(err, -cgofuse.EIO)
 			}
-
-			// Eliminar original
-			fs.s3Client.DeleteObject(ctx, fs.bucketName, oldKey)
-			fmt.Printf("[Rename] Moved %s -> %s\n", oldKey, newKey)
+			obj.Key = marker
+			objects = append(objects, *obj)
+			targets = append(targets, DirMarkersFolder.key(newpath))
 		}
-
-		// Crear marcador de directorio nuevo si no hay archivos
-		if len(filesToMove) == 0 {
-			err = fs.s3Client.UploadData(ctx, fs.bucketName, newpath+"/", []byte{})
-			if err != nil {
-				fmt.Printf("[Rename] Error creating new dir marker: %v\n", err)
-				return -cgofuse.EIO
+		// An empty target directory may have a marker, which is overwritten
+		existing := make(map[string]bool)
+		for _, target := range targets {
+			if _, err := fs.s3Client.HeadObject(ctx, fs.bucketName, fs.objectKey(target)); err == nil {
+				existing[target] = true
 			}
-			// Eliminar marcador viejo
-			fs.s3Client.DeleteObject(ctx, fs.bucketName, oldpath+"/")
 		}
-	} else {
-		// Es un archivo simple
-		fmt.Printf("[Rename] Moving single file using S3 CopyObject\n")
-
-		// Copiar usando S3 CopyObject (server-side)
-		err = fs.s3Client.CopyObject(ctx, fs.bucketName, oldpath, newpath)
-		if err != nil {
-			fmt.Printf("[Rename] Error copying file: %v\n", err)
-			return -cgofuse.EIO
+		// Directories without any key are only known locally
+		if len(objects) > 0 {
+			if moved, err = fs.renameDir(oldpath, newpath, objects, existing); err != nil {
+				fs.tree.invalidate()
+				fs.cache.InvalidatePrefix(oldpath)
+				fs.cache.InvalidatePrefix(newpath)
+				fs.invalidatePath(oldpath, newpath)
+				return errnoFromError(err, -cgofuse.EIO)
+			}
 		}
+	} else {
+		current, err := fs.s3Client.HeadObject(ctx, fs.bucketName, fs.objectKey(oldpath))
+		switch {
+		case storage.IsNotFound(err):
+			// Created locally and not uploaded yet: only the local state moves
+		case err != nil:
+			logger.Error("rename: error checking file", "from", oldpath, "error", err)
+			return errnoFromError(err, -cgofuse.EIO)
+		default:
+			rec := fs.beginAudit(auditRename, oldpath)
+			if rec != nil {
+				rec.NewKey = fs.objectKey(newpath)
+				rec.ETagBefore = current.ETag
+			}
 
-		// Eliminar original
-		err = fs.s3Client.DeleteObject(ctx, fs.bucketName, oldpath)
-		if err != nil {
-			fmt.Printf("[Rename] Error deleting old file: %v\n", err)
-			// Don't return error here, the file was already copied
+			// Server-side copy of the version looked up, so a change made
+			// meanwhile by another client is neither copied nor deleted unseen
+			etag, err := fs.s3Client.CopyObject(ctx, fs.bucketName, fs.objectKey(oldpath), current.ETag, fs.objectKey(newpath))
+			fs.finishAudit(rec, etag, err)
+			if storage.IsPreconditionFailed(err) {
+				logger.Warn("rename: file changed concurrently", "from", oldpath)
+				fs.tree.invalidate()
+				fs.invalidatePath(oldpath)
+				return -cgofuse.EBUSY
+			}
+			if err != nil {
+				logger.Error("rename: error copying file", "from", oldpath, "to", newpath, "error", err)
+				return errnoFromError(err, -cgofuse.EIO)
+			}
+			moved[oldpath] = movedKey{Key: newpath, From: current.ETag, ETag: etag}
+
+			// S3 has no conditional delete: the old key is checked again and
+			// kept if it was written after the copy. Errors are not returned
+			// from here on, the file was already copied.
+			after, err := fs.s3Client.HeadObject(ctx, fs.bucketName, fs.objectKey(oldpath))
+			switch {
+			case storage.IsNotFound(err):
+			case err != nil:
+				logger.Warn("rename: error checking old file", "from", oldpath, "error", err)
+			case after.ETag != current.ETag:
+				logger.Warn("rename: old file changed after it was copied, keeping it", "from", oldpath, "copied", current.ETag, "current", after.ETag)
+			default:
+				if err := fs.s3Client.DeleteObject(ctx, fs.bucketName, fs.objectKey(oldpath)); err != nil {
+					logger.Warn("rename: error deleting old file", "from", oldpath, "error", err)
+				}
+			}
+			fs.invalidateBlocks(oldpath)
 		}
-		fmt.Printf("[Rename] Moved %s -> %s\n", oldpath, newpath)
 	}
 
-	// Invalidar TODOS los caches
-	fs.invalidateCaches()
+	// The replaced file's pending changes must not land on the new one
+	if replaces && !dst.IsDir {
+		fs.dropStaged(newpath)
+	}
+	fs.repoint(oldpath, newpath, staged, moved)
+
+	fs.tree.move(oldpath, newpath)
+	fs.inodes.move(oldpath, newpath)
+	fs.cache.InvalidatePrefix(oldpath)
+	fs.cache.InvalidatePrefix(newpath)
+	fs.invalidatePath(oldpath, newpath)
+	if info, found := fs.tree.lookup(newpath); found {
+		fs.cache.Put(newpath, info)
+	}
+	fs.cache.PutNegative(oldpath)
 
-	fmt.Printf("[Rename] Rename completed successfully\n")
+	logger.Info("renamed", "from", oldpath, "to", newpath)
 	return 0
 }
 
 // Truncate changes the size of a file
-func (fs *S3FS) Truncate(path string, size int64, fh uint64) int {
-	path = strings.TrimPrefix(path, "/")
-	fmt.Printf("[Truncate] *** TRUNCATE CALLED *** path='%s' size=%d fh=%d\n", path, size, fh)
+func (fs *S3FS) Truncate(path string, size int64, fh uint64) (errc int) {
+	defer trackOp("Truncate", time.Now(), &errc)
+	path = fs.resolvePath(path)
+	logger.Debug("truncate", "path", path, "size", size, "fh", fh)
 
-	// Si tenemos file handle, truncar el archivo temporal
+	// Files open for writing are truncated in their staging file, through
+	// the handle or, without one, through the path
+	fs.mu.RLock()
+	openFile := fs.nodes[path]
 	if fh != ^uint64(0) {
-		fs.mu.RLock()
-		openFile, exists := fs.openFiles[fh]
+		handle, exists := fs.openFiles[fh]
 		if !exists {
 			fs.mu.RUnlock()
 			return -cgofuse.EBADF
 		}
-		tempFile := openFile.TempFile
-		fs.mu.RUnlock()
-
-		// Truncar archivo temporal
-		err := os.Truncate(tempFile, size)
-		if err != nil {
-			fmt.Printf("[Truncate] Error truncating temp file: %v\n", err)
+		openFile = handle.OpenFile
+	}
+	fs.mu.RUnlock()
+	if openFile != nil {
+		if err := fs.truncateStaged(openFile, size); err != nil {
+			logger.Error("truncate: error truncating temp file", "path", path, "error", err)
 			return -cgofuse.EIO
 		}
-
-		fs.mu.Lock()
-		if openFile, exists := fs.openFiles[fh]; exists {
-			openFile.Size = size
-			openFile.Dirty = true
-		}
-		fs.mu.Unlock()
-
-		fmt.Printf("[Truncate] Temp file truncated to %d bytes\n", size)
 		return 0
 	}
 
 	// Without file handle: truncate file in S3
 	if size == 0 {
-		// Truncate to 0: create empty file
-		ctx := context.Background()
-		err := fs.s3Client.UploadData(ctx, fs.bucketName, path, []byte{})
+		// Queued changes must land first, or their upload would bring the old
+		// content back after the truncation
+		if errc := fs.awaitUploads(path); errc != 0 {
+			return errc
+		}
+		ctx, cancel := fs.dataContext()
+		defer cancel()
+
+		// The empty object replaces only the version looked up here, so a change
+		// made meanwhile by another client is not lost
+		current, err := fs.s3Client.HeadObject(ctx, fs.bucketName, fs.objectKey(path))
+		if storage.IsNotFound(err) {
+			return -cgofuse.ENOENT
+		}
 		if err != nil {
-			fmt.Printf("[Truncate] Error creating empty file: %v\n", err)
-			return -cgofuse.EIO
+			logger.Error("truncate: error getting object metadata", "path", path, "error", err)
+			return errnoFromError(err, -cgofuse.EIO)
+		}
+		rec := fs.beginAudit(auditTruncate, path)
+		if rec != nil {
+			rec.ETagBefore = current.ETag
+		}
+		etag, err := fs.s3Client.ReplaceObject(ctx, fs.bucketName, fs.objectKey(path), []byte{}, current.ETag)
+		fs.finishAudit(rec, etag, err)
+		if storage.IsPreconditionFailed(err) {
+			logger.Warn("truncate: object changed concurrently", "path", path)
+			fs.tree.invalidate()
+			fs.invalidatePath(path)
+			return -cgofuse.EBUSY
+		}
+		if err != nil {
+			logger.Error("truncate: error creating empty file", "path", path, "error", err)
+			return errnoFromError(err, -cgofuse.EIO)
 		}
-		fmt.Printf("[Truncate] Created empty file in S3\n")
+		fs.tree.putFile(path, storage.ObjectInfo{LastModified: time.Now(), ETag: etag})
+		fs.invalidateBlocks(path)
+		fs.invalidatePath(path)
 		return 0
 	}
 
-	fmt.Printf("[Truncate] Non-zero truncate without fh not supported\n")
+	logger.Warn("truncate: non-zero truncate without fh not supported", "path", path, "size", size)
 	return -cgofuse.ENOSYS
 }
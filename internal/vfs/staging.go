@@ -0,0 +1,273 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"maxiofs-agent/internal/storage"
+)
+
+const (
+	stagingPartSize = 8 * 1024 * 1024 // Multipart part size when reassembling a staged file
+	maxParts        = 10000           // S3 limit on parts per upload
+)
+
+// byteRange is the half-open range [Start, End)
+type byteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// intervalSet is a sorted set of disjoint, non-adjacent byte ranges
+type intervalSet []byteRange
+
+// add inserts [start, end), merging it with the ranges it touches
+func (s *intervalSet) add(start, end int64) {
+	if start >= end {
+		return
+	}
+	var out intervalSet
+	inserted := false
+	for _, r := range *s {
+		switch {
+		case r.End < start:
+			out = append(out, r)
+		case r.Start > end:
+			if !inserted {
+				out = append(out, byteRange{start, end})
+				inserted = true
+			}
+			out = append(out, r)
+		default:
+			start = min(start, r.Start)
+			end = max(end, r.End)
+		}
+	}
+	if !inserted {
+		out = append(out, byteRange{start, end})
+	}
+	*s = out
+}
+
+// truncate drops everything at or beyond size
+func (s *intervalSet) truncate(size int64) {
+	out := (*s)[:0]
+	for _, r := range *s {
+		if r.Start >= size {
+			break
+		}
+		r.End = min(r.End, size)
+		out = append(out, r)
+	}
+	*s = out
+}
+
+// missing returns the parts of [start, end) not in the set
+func (s intervalSet) missing(start, end int64) []byteRange {
+	var gaps []byteRange
+	for _, r := range s {
+		if start >= end {
+			break
+		}
+		if r.End <= start {
+			continue
+		}
+		if r.Start >= end {
+			break
+		}
+		if r.Start > start {
+			gaps = append(gaps, byteRange{start, r.Start})
+		}
+		start = r.End
+	}
+	if start < end {
+		gaps = append(gaps, byteRange{start, end})
+	}
+	return gaps
+}
+
+// overlaps reports whether any of [start, end) is in the set
+func (s intervalSet) overlaps(start, end int64) bool {
+	gaps := s.missing(start, end)
+	return len(gaps) != 1 || gaps[0] != byteRange{start, end}
+}
+
+// fetchStaged copies the bytes of [start, end) that still come from the base
+// object and are not in the staging file yet. Must be called with stageMu held.
+func (fs *S3FS) fetchStaged(ctx context.Context, of *OpenFile, start, end int64) error {
+	end = min(end, of.BaseSize)
+	gaps := of.present.missing(start, end)
+	if len(gaps) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(of.TempFile, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	chunkSize := fs.chunkSize()
+	for _, gap := range gaps {
+		for index := gap.Start / chunkSize; index*chunkSize < gap.End; index++ {
+			data, err := fs.fetchChunk(ctx, of.Base, index, chunkSize, nil)
+			if err != nil {
+				return err
+			}
+			chunkStart := index * chunkSize
+			from := max(gap.Start, chunkStart)
+			to := min(gap.End, chunkStart+int64(len(data)))
+			if from >= to {
+				return io.ErrUnexpectedEOF
+			}
+			if _, err := f.WriteAt(data[from-chunkStart:to-chunkStart], from); err != nil {
+				return err
+			}
+			of.present.add(from, to)
+		}
+	}
+	logger.Debug("staging: fetched base ranges", "path", of.Path, "ranges", len(gaps))
+	return nil
+}
+
+// readStaged reads a file opened for writing from its staging file, fetching
+// the base ranges it needs first
+func (fs *S3FS) readStaged(ctx context.Context, of *OpenFile, buff []byte, ofst int64) (int, error) {
+	of.stageMu.Lock()
+	defer of.stageMu.Unlock()
+	if of.uploaded {
+		return 0, errStagingGone
+	}
+
+	fs.mu.RLock()
+	size := of.Size
+	fs.mu.RUnlock()
+	if ofst >= size {
+		return 0, nil
+	}
+	end := min(ofst+int64(len(buff)), size)
+
+	if err := fs.fetchStaged(ctx, of, ofst, end); err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(of.TempFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := f.ReadAt(buff[:end-ofst], ofst)
+	if errors.Is(err, io.EOF) {
+		// Extended by a write past the end but never written: zeros
+		clear(buff[n : end-ofst])
+		n, err = int(end-ofst), nil
+	}
+	return n, err
+}
+
+// uploadStaged uploads the staging file of of and returns the ETag of the new
+// object. Regions that still match the base object are copied server-side
+// when the file is large enough for a multipart upload. Must be called with
+// stageMu held; for a released file the lock is let go during the transfers.
+func (fs *S3FS) uploadStaged(ctx context.Context, of *OpenFile, size int64, released bool) (string, error) {
+	partSize := max(int64(stagingPartSize), (size+maxParts-1)/maxParts)
+
+	unchanged := 0
+	if of.Base.Key != "" && size > partSize {
+		for off := int64(0); off < size; off += partSize {
+			if fs.partUnchanged(of, off, min(off+partSize, size)) {
+				unchanged++
+			}
+		}
+	}
+	if unchanged == 0 {
+		if err := fs.fetchStaged(ctx, of, 0, size); err != nil {
+			return "", err
+		}
+		var etag string
+		err := of.transfer(released, func() (err error) {
+			etag, err = fs.s3Client.UploadFile(ctx, fs.bucketName, fs.objectKey(of.Path), of.TempFile)
+			return err
+		})
+		return etag, err
+	}
+
+	logger.Debug("staging: multipart upload", "path", of.Path, "size", size, "copied_parts", unchanged)
+	f, err := os.Open(of.TempFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	upload, err := fs.s3Client.CreateMultipartUpload(ctx, fs.bucketName, fs.objectKey(of.Path))
+	if err != nil {
+		return "", err
+	}
+	var number int32
+	for off := int64(0); off < size; off += partSize {
+		number++
+		end := min(off+partSize, size)
+		if fs.partUnchanged(of, off, end) {
+			base := of.Base
+			err = of.transfer(released, func() error {
+				return fs.s3Client.UploadPartCopy(ctx, upload, number, fs.objectKey(base.Key), base.ETag, off, end-off)
+			})
+		} else if err = fs.fetchStaged(ctx, of, off, end); err == nil {
+			err = of.transfer(released, func() error {
+				return fs.s3Client.UploadPart(ctx, upload, number, io.NewSectionReader(f, off, end-off), end-off)
+			})
+		}
+		if err != nil {
+			fs.abortUpload(ctx, upload)
+			return "", err
+		}
+	}
+
+	var etag string
+	err = of.transfer(released, func() (err error) {
+		etag, err = fs.s3Client.CompleteMultipartUpload(ctx, upload)
+		return err
+	})
+	if err != nil {
+		fs.abortUpload(ctx, upload)
+		return "", err
+	}
+	return etag, nil
+}
+
+// transfer runs fn, which sends staged data to the bucket. Nothing writes to
+// a released file anymore, only reads fill in base bytes elsewhere, so its
+// stageMu is let go meanwhile and reads of the queued file do not wait for
+// the upload. Must be called with stageMu held.
+func (of *OpenFile) transfer(released bool, fn func() error) error {
+	if released {
+		of.stageMu.Unlock()
+		defer of.stageMu.Lock()
+	}
+	return fn()
+}
+
+// abortUpload discards a failed multipart upload, even if ctx already expired
+func (fs *S3FS) abortUpload(ctx context.Context, upload *storage.MultipartUpload) {
+	abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), fs.metadataTimeout)
+	defer cancel()
+	if err := fs.s3Client.AbortMultipartUpload(abortCtx, upload); err != nil {
+		logger.Warn("staging: error aborting multipart upload", "key", upload.Key, "error", err)
+	}
+}
+
+// partUnchanged reports whether [start, end) still holds the base object's bytes
+func (fs *S3FS) partUnchanged(of *OpenFile, start, end int64) bool {
+	return end <= of.BaseSize && !of.modified.overlaps(start, end)
+}
+
+// rebase makes the object just uploaded the base of of. Must be called with stageMu held.
+func (of *OpenFile) rebase(etag string, size int64) {
+	of.Base = storage.ObjectInfo{Key: of.Path, Size: size, ETag: etag}
+	of.BaseSize = size
+	of.modified = nil
+	// Everything the staging file holds now matches the new object
+	of.present.truncate(size)
+}
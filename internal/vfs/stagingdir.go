@@ -0,0 +1,74 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	stagingOwnerFile = "owner.pid"
+	stagingPattern   = "staged-*.tmp"
+)
+
+// prepareStagingDir creates the private staging directory of a mount and
+// claims it for this process, unless another running process still owns it.
+// Staging files left by a previous run are removed, except those with a
+// journal entry; those entries are returned keyed by staging file.
+func prepareStagingDir(dir string) (map[string]*journalEntry, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating staging directory: %w", err)
+	}
+	// A link planted at the path would make the chmod below, and every
+	// staging file, land wherever it points
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading staging directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("staging path %s is not a directory", dir)
+	}
+	// MkdirAll leaves an existing directory as it was
+	if err := os.Chmod(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error securing staging directory: %w", err)
+	}
+
+	ownerPath := filepath.Join(dir, stagingOwnerFile)
+	if data, err := os.ReadFile(ownerPath); err == nil {
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		if pid > 0 && pid != os.Getpid() && processAlive(pid) {
+			return nil, fmt.Errorf("staging directory %s is in use by process %d", dir, pid)
+		}
+	}
+	if err := os.WriteFile(ownerPath, []byte(strconv.Itoa(os.Getpid())), 0600); err != nil {
+		return nil, fmt.Errorf("error claiming staging directory: %w", err)
+	}
+
+	journal := loadJournal(dir)
+	leftovers, err := filepath.Glob(filepath.Join(dir, stagingPattern))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range leftovers {
+		if _, pending := journal[path]; pending {
+			continue
+		}
+		// Only plain files we created; never follow a link out of the directory
+		if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			logger.Warn("staging: cannot remove leftover file", "path", path, "error", err)
+			continue
+		}
+		logger.Info("staging: removed leftover file", "path", path)
+	}
+	return journal, nil
+}
+
+// releaseStagingDir gives up the claim on the staging directory
+func releaseStagingDir(dir string) {
+	os.Remove(filepath.Join(dir, stagingOwnerFile))
+}
@@ -0,0 +1,208 @@
+package vfs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"maxiofs-agent/internal/cgofuse"
+	"maxiofs-agent/internal/storage"
+)
+
+const (
+	// maxSymlinkSize bounds link targets (PATH_MAX). Larger objects are never
+	// probed for being a link.
+	maxSymlinkSize = 4096
+	// linkProbes is how many objects of a listed directory are probed at once
+	linkProbes = 8
+)
+
+// linkCache remembers which small objects are symbolic links, and which are
+// not. Listings do not include metadata, so each version of a small object is
+// probed with a HEAD request once, by whichever of Readdir and Getattr sees it
+// first, and both answer from here afterwards. Entries are keyed by path and
+// only valid for their ETag.
+type linkCache struct {
+	mu    sync.Mutex
+	links map[string]linkEntry
+}
+
+type linkEntry struct {
+	etag   string
+	link   bool
+	target string // Fetched on the first Readlink
+}
+
+func newLinkCache() *linkCache {
+	return &linkCache{links: make(map[string]linkEntry)}
+}
+
+func (c *linkCache) get(p, etag string) (linkEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.links[p]
+	return entry, ok && entry.etag == etag
+}
+
+func (c *linkCache) put(p string, entry linkEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.links[p] = entry
+}
+
+func (c *linkCache) forget(p string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.links, p)
+}
+
+// mayBeLink reports whether the object at info could hold a link target
+func mayBeLink(info storage.ObjectInfo) bool {
+	return !info.IsDir && info.ETag != "" && info.Size > 0 && info.Size <= maxSymlinkSize
+}
+
+// resolveLink marks info as a link when the object is one, probing it with a
+// HEAD request the first time this version is seen
+func (fs *S3FS) resolveLink(ctx context.Context, p string, info storage.ObjectInfo) storage.ObjectInfo {
+	if info.Symlink || !mayBeLink(info) {
+		return info
+	}
+	if entry, ok := fs.links.get(p, info.ETag); ok {
+		info.Symlink = entry.link
+		return info
+	}
+
+	head, err := fs.s3Client.HeadObject(ctx, fs.bucketName, fs.objectKey(p))
+	if err != nil {
+		// Shown as a regular file this time, probed again on the next lookup
+		logger.Debug("symlink: cannot probe object", "path", p, "error", err)
+		return info
+	}
+	fs.links.put(p, linkEntry{etag: head.ETag, link: head.Symlink})
+	if head.ETag == info.ETag {
+		info.Symlink = head.Symlink
+	}
+	return info
+}
+
+// resolveLinks resolves listed entries, whose paths are prefix followed by
+// their names, like resolveLink, probing the small objects not seen yet
+// linkProbes at a time
+func (fs *S3FS) resolveLinks(ctx context.Context, prefix string, entries []treeEntry) []storage.ObjectInfo {
+	infos := make([]storage.ObjectInfo, len(entries))
+	slots := make(chan struct{}, linkProbes)
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		p := prefix + entry.Name
+		if _, known := fs.links.get(p, entry.Info.ETag); known || !mayBeLink(entry.Info) {
+			infos[i] = fs.resolveLink(ctx, p, entry.Info)
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			infos[i] = fs.resolveLink(ctx, p, entry.Info)
+		}()
+	}
+	wg.Wait()
+	return infos
+}
+
+// Symlink creates a symbolic link at newpath pointing to target. The link is
+// stored as a small object holding the target, tagged with its file type in
+// the object metadata like s3fs does, so other tools see the same link.
+func (fs *S3FS) Symlink(target string, newpath string) (errc int) {
+	defer trackOp("Symlink", time.Now(), &errc)
+	path := fs.resolvePath(newpath)
+	logger.Debug("symlink", "path", path, "target", target)
+
+	if target == "" {
+		return -cgofuse.ENOENT
+	}
+	if len(target) > maxSymlinkSize {
+		return -cgofuse.ENAMETOOLONG
+	}
+
+	// Files open for writing or waiting for upload are not listed remotely yet
+	fs.mu.RLock()
+	_, open := fs.nodes[path]
+	fs.mu.RUnlock()
+	if _, queued := fs.queuedFile(path); open || queued {
+		return -cgofuse.EEXIST
+	}
+
+	ctx, cancel := fs.metadataContext()
+	defer cancel()
+	if err := fs.refreshTree(ctx); err != nil {
+		logger.Warn("symlink: error listing objects", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.EIO)
+	}
+	if _, found := fs.tree.lookup(path); found {
+		return -cgofuse.EEXIST
+	}
+
+	rec := fs.beginAudit(auditSymlink, path)
+	etag, err := fs.s3Client.CreateSymlink(ctx, fs.bucketName, fs.objectKey(path), target)
+	fs.finishAudit(rec, etag, err)
+	if storage.IsPreconditionFailed(err) {
+		logger.Debug("symlink: path created concurrently", "path", path)
+		fs.tree.invalidate()
+		return -cgofuse.EEXIST
+	}
+	if err != nil {
+		logger.Error("symlink: error creating link", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.EIO)
+	}
+
+	fs.invalidatePath(path)
+	fs.links.put(path, linkEntry{etag: etag, link: true, target: target})
+	fs.tree.putFile(path, storage.ObjectInfo{
+		Size:         int64(len(target)),
+		LastModified: time.Now(),
+		ETag:         etag,
+		Symlink:      true,
+	})
+
+	logger.Info("created symbolic link", "path", path, "target", target)
+	return 0
+}
+
+// Readlink returns the target of a symbolic link
+func (fs *S3FS) Readlink(path string) (errc int, target string) {
+	defer trackOp("Readlink", time.Now(), &errc)
+	path = fs.resolvePath(path)
+	logger.Debug("readlink", "path", path)
+
+	ctx, cancel := fs.metadataContext()
+	defer cancel()
+	if err := fs.refreshTree(ctx); err != nil {
+		logger.Warn("readlink: error listing objects", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.EIO), ""
+	}
+	info, found := fs.tree.lookup(path)
+	if !found {
+		return -cgofuse.ENOENT, ""
+	}
+	if info = fs.resolveLink(ctx, path, info); !info.Symlink {
+		return -cgofuse.EINVAL, ""
+	}
+	if entry, ok := fs.links.get(path, info.ETag); ok && entry.target != "" {
+		return 0, entry.target
+	}
+
+	data, err := fs.s3Client.GetObjectRange(ctx, fs.bucketName, fs.objectKey(path), info.ETag, 0, info.Size)
+	if storage.IsPreconditionFailed(err) {
+		// Replaced since it was listed
+		fs.tree.invalidate()
+		fs.invalidatePath(path)
+		return -cgofuse.EAGAIN, ""
+	}
+	if err != nil {
+		logger.Error("readlink: error reading link", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.EIO), ""
+	}
+	fs.links.put(path, linkEntry{etag: info.ETag, link: true, target: string(data)})
+	return 0, string(data)
+}
@@ -0,0 +1,390 @@
+package vfs
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"maxiofs-agent/internal/storage"
+)
+
+const defaultListingRefresh = 30 * time.Second
+
+// treeIndex is an in-memory index of the bucket namespace. It is built from a
+// full listing and kept current by local mutations until the next refresh, so
+// lookups cost the depth of the path and enumeration the size of the directory.
+type treeIndex struct {
+	mu       sync.RWMutex
+	root     *treeNode
+	builtAt  time.Time
+	ttl      time.Duration
+	building bool
+	replay   []func(root *treeNode) // Mutations made while a rebuild is in flight
+	local    map[string]time.Time   // Directories created without a marker, kept across rebuilds
+	foldCase bool                   // Names are looked up ignoring case
+
+	buildMu sync.Mutex // Serializes rebuilds
+}
+
+// treeNode is a file or a directory of the namespace
+type treeNode struct {
+	info     storage.ObjectInfo   // Key ends with "/" for directories
+	explicit bool                 // Directory backed by a marker object or created locally
+	markers  []string             // Keys of the marker objects of a directory
+	children map[string]*treeNode // nil for files
+
+	// Case-insensitive lookups (see casefold.go): children by folded name,
+	// folded names shared by several children, and the aliases of those
+	foldCase bool
+	folds    map[string][]string
+	collided map[string]bool
+	aliases  map[string]string // Folded alias → name
+	shown    map[string]string // Name → alias
+}
+
+// treeEntry is a copy of a node handed out of the index
+type treeEntry struct {
+	Name  string
+	Shown string // Name listed to the host, an alias when it collides ignoring case
+	Info  storage.ObjectInfo
+}
+
+func newTreeIndex(ttl time.Duration, foldCase bool) *treeIndex {
+	return &treeIndex{ttl: ttl, local: make(map[string]time.Time), foldCase: foldCase}
+}
+
+func newDirNode(p string, foldCase bool) *treeNode {
+	return &treeNode{
+		info:     storage.ObjectInfo{Key: p + "/", IsDir: true},
+		children: make(map[string]*treeNode),
+		foldCase: foldCase,
+	}
+}
+
+// buildTree indexes a recursive listing
+func buildTree(objects []storage.ObjectInfo, foldCase bool) *treeNode {
+	root := newDirNode("", foldCase)
+	for _, obj := range objects {
+		key := strings.TrimPrefix(obj.Key, "/")
+		if strings.HasPrefix(key, leasePrefix) {
+			continue
+		}
+		if p, ok := markerDir(key); ok {
+			if p != "" {
+				root.putDir(p, obj)
+			}
+			continue
+		}
+		root.putFile(key, obj)
+	}
+	return root
+}
+
+// splitPath returns the parent directory ("" for the root) and the name of p
+func splitPath(p string) (string, string) {
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return "", p
+}
+
+// walk returns the node at p, or nil
+func (n *treeNode) walk(p string) *treeNode {
+	if p == "" {
+		return n
+	}
+	for _, name := range strings.Split(p, "/") {
+		if n.children == nil {
+			return nil
+		}
+		if n = n.children[name]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// mkdirAll returns the directory at p, creating it and its parents as implicit
+// directories. A directory replaces a file of the same name, whose key then
+// cannot be reached through the filesystem anyway.
+func (n *treeNode) mkdirAll(p string) *treeNode {
+	if p == "" {
+		return n
+	}
+	var walked string
+	for _, name := range strings.Split(p, "/") {
+		if walked == "" {
+			walked = name
+		} else {
+			walked += "/" + name
+		}
+		child := n.children[name]
+		if child == nil || child.children == nil {
+			child = newDirNode(walked, n.foldCase)
+			n.setChild(name, child)
+		}
+		n = child
+	}
+	return n
+}
+
+// putFile adds or replaces the file at p
+func (n *treeNode) putFile(p string, info storage.ObjectInfo) {
+	dir, name := splitPath(p)
+	parent := n.mkdirAll(dir)
+	if existing := parent.children[name]; existing != nil && existing.children != nil {
+		return
+	}
+	info.Key = p
+	info.IsDir = false
+	parent.setChild(name, &treeNode{info: info})
+}
+
+// putDir adds the directory at p as backed by the marker info, or as created
+// locally when info has no key
+func (n *treeNode) putDir(p string, info storage.ObjectInfo) {
+	dir := n.mkdirAll(p)
+	dir.explicit = true
+	if info.Key != "" && !slices.Contains(dir.markers, info.Key) {
+		dir.markers = append(dir.markers, info.Key)
+	}
+	if !info.LastModified.IsZero() {
+		dir.info.LastModified = info.LastModified
+	}
+}
+
+// remove deletes the node at p and any implicit parents left empty
+func (n *treeNode) remove(p string) *treeNode {
+	dir, name := splitPath(p)
+	parent := n.walk(dir)
+	if parent == nil || parent.children == nil {
+		return nil
+	}
+	node := parent.children[name]
+	parent.deleteChild(name)
+	n.prune(dir)
+	return node
+}
+
+// prune removes the implicit directory at p and its implicit parents while they are empty
+func (n *treeNode) prune(p string) {
+	for p != "" {
+		dir, name := splitPath(p)
+		parent := n.walk(dir)
+		if parent == nil {
+			return
+		}
+		node := parent.children[name]
+		if node == nil || node.children == nil || node.explicit || len(node.children) > 0 {
+			return
+		}
+		parent.deleteChild(name)
+		p = dir
+	}
+}
+
+// move re-attaches the node at oldPath, with everything below it, at newPath
+func (n *treeNode) move(oldPath, newPath string) {
+	node := n.remove(oldPath)
+	if node == nil {
+		return
+	}
+	dir, name := splitPath(newPath)
+	parent := n.mkdirAll(dir)
+	node.rekey(newPath)
+	parent.setChild(name, node)
+}
+
+// rekey updates the keys of a moved subtree
+func (n *treeNode) rekey(p string) {
+	if n.children == nil {
+		n.info.Key = p
+		return
+	}
+	n.info.Key = p + "/"
+	for i, marker := range n.markers {
+		n.markers[i] = rekeyMarker(marker, p)
+	}
+	for name, child := range n.children {
+		child.rekey(p + "/" + name)
+	}
+}
+
+// refreshTree rebuilds the index from a full listing when it is older than its TTL
+func (fs *S3FS) refreshTree(ctx context.Context) error {
+	t := fs.tree
+	if t.fresh() {
+		trackCache("list", true)
+		return nil
+	}
+
+	t.buildMu.Lock()
+	defer t.buildMu.Unlock()
+	if t.fresh() {
+		// Rebuilt by the caller we were waiting for
+		trackCache("list", true)
+		return nil
+	}
+	trackCache("list", false)
+
+	t.mu.Lock()
+	t.building = true
+	t.replay = nil
+	t.mu.Unlock()
+
+	objects, err := fs.listObjects(ctx, "")
+	// Files open for writing or still waiting in the upload queue are not listed yet
+	local := fs.localInfo()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.building = false
+	replay := t.replay
+	t.replay = nil
+	if err != nil {
+		return err
+	}
+
+	root := buildTree(objects, t.foldCase)
+	for p, info := range local {
+		root.putFile(p, info)
+	}
+	for p, mod := range t.local {
+		root.putDir(p, storage.ObjectInfo{LastModified: mod})
+	}
+	for _, apply := range replay {
+		apply(root)
+	}
+	t.root = root
+	t.builtAt = time.Now()
+	logger.Debug("rebuilt namespace index", "objects", len(objects), "replayed", len(replay))
+	return nil
+}
+
+func (t *treeIndex) fresh() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.root != nil && time.Since(t.builtAt) < t.ttl
+}
+
+// invalidate forces a rebuild on the next lookup
+func (t *treeIndex) invalidate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.builtAt = time.Time{}
+}
+
+// update applies a local mutation to the index, and again to an index being rebuilt
+func (t *treeIndex) update(apply func(root *treeNode)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.root != nil {
+		apply(t.root)
+	}
+	if t.building {
+		t.replay = append(t.replay, apply)
+	}
+}
+
+// lookup returns the file or directory at p
+func (t *treeIndex) lookup(p string) (storage.ObjectInfo, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.root == nil {
+		return storage.ObjectInfo{}, false
+	}
+	node := t.root.walk(p)
+	if node == nil {
+		return storage.ObjectInfo{}, false
+	}
+	return node.info, true
+}
+
+// list returns the entries of the directory at p sorted by name
+func (t *treeIndex) list(p string) ([]treeEntry, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.root == nil {
+		return nil, false
+	}
+	dir := t.root.walk(p)
+	if dir == nil || dir.children == nil {
+		return nil, false
+	}
+	entries := make([]treeEntry, 0, len(dir.children))
+	for name, child := range dir.children {
+		entries = append(entries, treeEntry{Name: name, Shown: dir.shownName(name), Info: child.info})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, true
+}
+
+func (t *treeIndex) putFile(p string, info storage.ObjectInfo) {
+	t.update(func(root *treeNode) { root.putFile(p, info) })
+}
+
+// markers returns the keys of the marker objects of the directory at p
+func (t *treeIndex) markers(p string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.root == nil {
+		return nil
+	}
+	if node := t.root.walk(p); node != nil {
+		return slices.Clone(node.markers)
+	}
+	return nil
+}
+
+// hasLocalBelow reports whether a directory created without a marker exists below p
+func (t *treeIndex) hasLocalBelow(p string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for dir := range t.local {
+		if dir != p && isUnder(dir, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// putDir adds the directory at p backed by the object marker, or only known
+// locally when marker is empty
+func (t *treeIndex) putDir(p, marker string) {
+	info := storage.ObjectInfo{Key: marker, LastModified: time.Now()}
+	t.mu.Lock()
+	if marker == "" {
+		t.local[p] = info.LastModified
+	}
+	t.mu.Unlock()
+	t.update(func(root *treeNode) { root.putDir(p, info) })
+}
+
+func (t *treeIndex) remove(p string) {
+	t.mu.Lock()
+	for dir := range t.local {
+		if isUnder(dir, p) {
+			delete(t.local, dir)
+		}
+	}
+	t.mu.Unlock()
+	t.update(func(root *treeNode) { root.remove(p) })
+}
+
+func (t *treeIndex) move(oldPath, newPath string) {
+	t.mu.Lock()
+	moved := make(map[string]time.Time)
+	for dir, mod := range t.local {
+		if isUnder(dir, oldPath) {
+			delete(t.local, dir)
+			moved[renamedPath(dir, oldPath, newPath)] = mod
+		}
+	}
+	maps.Copy(t.local, moved)
+	t.mu.Unlock()
+	t.update(func(root *treeNode) { root.move(oldPath, newPath) })
+}
@@ -0,0 +1,513 @@
+package vfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"maxiofs-agent/internal/cgofuse"
+	"maxiofs-agent/internal/storage"
+)
+
+const (
+	defaultUploadConcurrency = 4
+	defaultUploadRetries     = 5
+	uploadRetryDelay         = 2 * time.Second
+	maxUploadRetryDelay      = time.Minute
+)
+
+// errStagingGone means the staging file was uploaded and removed while waiting for it
+var errStagingGone = errors.New("staging file already uploaded")
+
+// uploadQueue commits the staging files of released handles in the background.
+// Uploads of the same path run in the order they were queued.
+type uploadQueue struct {
+	slots    chan struct{}            // One token per upload in progress
+	retries  int                      // Attempts after the first one
+	latest   map[string]*journalEntry // Newest queued upload per path, guarded by fs.mu
+	onFailed func(path string, err error)
+
+	// Paths being renamed, whose uploads wait until the rename is done, and a
+	// signal on fs.mu for each attempt that ends. Guarded by fs.mu.
+	paused []*uploadPause
+	idle   *sync.Cond
+}
+
+// uploadPause holds back the uploads of paths until resumed is closed
+type uploadPause struct {
+	paths   []string
+	resumed chan struct{}
+}
+
+func newUploadQueue(concurrency, retries int, onFailed func(path string, err error)) *uploadQueue {
+	return &uploadQueue{
+		slots:    make(chan struct{}, concurrency),
+		retries:  retries,
+		latest:   make(map[string]*journalEntry),
+		onFailed: onFailed,
+	}
+}
+
+// pauseUploads holds back the uploads of paths, and of anything below them,
+// and waits for the attempts in progress to end. The returned function resumes them.
+func (fs *S3FS) pauseUploads(paths ...string) func() {
+	pause := &uploadPause{paths: paths, resumed: make(chan struct{})}
+	fs.mu.Lock()
+	fs.uploads.paused = append(fs.uploads.paused, pause)
+	for fs.uploadingLocked(paths) {
+		fs.uploads.idle.Wait()
+	}
+	fs.mu.Unlock()
+
+	return func() {
+		fs.mu.Lock()
+		fs.uploads.paused = slices.DeleteFunc(fs.uploads.paused, func(p *uploadPause) bool { return p == pause })
+		fs.mu.Unlock()
+		close(pause.resumed)
+	}
+}
+
+// uploadingLocked reports whether an upload of one of paths is in progress. Must be called with fs.mu held.
+func (fs *S3FS) uploadingLocked(paths []string) bool {
+	for _, entry := range fs.pending {
+		if !entry.inFlight {
+			continue
+		}
+		for _, p := range paths {
+			if isUnder(entry.Path, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startAttempt waits until the uploads of the entry's path are not paused and
+// marks it in flight; false means the entry was cancelled meanwhile
+func (fs *S3FS) startAttempt(entry *journalEntry) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for {
+		var resumed chan struct{}
+		for _, pause := range fs.uploads.paused {
+			for _, p := range pause.paths {
+				if isUnder(entry.Path, p) {
+					resumed = pause.resumed
+				}
+			}
+		}
+		if resumed == nil {
+			entry.inFlight = true
+			return true
+		}
+		fs.mu.Unlock()
+		select {
+		case <-resumed:
+		case <-entry.ctx.Done():
+			fs.mu.Lock()
+			return false
+		}
+		fs.mu.Lock()
+	}
+}
+
+// endAttempt marks an entry as no longer in flight
+func (fs *S3FS) endAttempt(entry *journalEntry) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	entry.inFlight = false
+	fs.uploads.idle.Broadcast()
+}
+
+// queueReleased hands the dirty staging file of a released handle to the
+// upload queue. The file stays listed with its local size until it commits.
+func (fs *S3FS) queueReleased(of *OpenFile) {
+	of.stageMu.Lock()
+	fs.journalLocked(of)
+	entry := entryFor(of)
+	of.stageMu.Unlock()
+	entry.of = of
+
+	fs.mu.Lock()
+	fs.pending[of.TempFile] = entry
+	fs.queueLocked(of.TempFile, entry)
+	fs.mu.Unlock()
+
+	fs.tree.putFile(of.Path, entry.localInfo())
+	fs.invalidatePath(of.Path)
+}
+
+// queueLocked starts the upload of a pending entry. Must be called with fs.mu held.
+func (fs *S3FS) queueLocked(staging string, entry *journalEntry) {
+	if entry.queued {
+		return
+	}
+	entry.queued = true
+	entry.Error = ""
+	entry.done = make(chan struct{})
+	entry.ctx, entry.cancel = context.WithCancel(fs.rootCtx)
+	entry.prev = fs.uploads.latest[entry.Path]
+	fs.uploads.latest[entry.Path] = entry
+	go fs.runUpload(staging, entry)
+}
+
+// runUpload uploads one queued entry, retrying transient failures with backoff
+func (fs *S3FS) runUpload(staging string, entry *journalEntry) {
+	// A rename may move the entry to another path while it waits
+	defer func() {
+		fs.mu.RLock()
+		path := entry.Path
+		fs.mu.RUnlock()
+		fs.releaseLease(path)
+	}()
+	defer fs.dequeue(entry)
+
+	if prev := entry.prev; prev != nil {
+		select {
+		case <-prev.done:
+		case <-entry.ctx.Done():
+			return
+		}
+	}
+	select {
+	case fs.uploads.slots <- struct{}{}:
+	case <-entry.ctx.Done():
+		return
+	}
+	defer func() { <-fs.uploads.slots }()
+
+	delay := uploadRetryDelay
+	for attempt := 0; ; attempt++ {
+		// The entry keeps its path until the attempt ends
+		if !fs.startAttempt(entry) {
+			return
+		}
+		etag, err := fs.uploadEntry(staging, entry)
+		switch {
+		case err == nil:
+			fs.uploadCommitted(staging, entry, etag)
+		case entry.ctx.Err() != nil:
+			// Unmounted or discarded; an unmount leaves the journal for the next start
+			logger.Debug("upload: stopped", "path", entry.Path, "error", err)
+		case errors.Is(err, errConflict) || attempt >= fs.uploads.retries:
+			fs.uploadFailed(staging, entry, err)
+		default:
+			logger.Warn("upload: failed, retrying", "path", entry.Path, "attempt", attempt+1, "delay", delay, "error", err)
+			fs.endAttempt(entry)
+			select {
+			case <-time.After(delay):
+			case <-entry.ctx.Done():
+				return
+			}
+			delay = min(delay*2, maxUploadRetryDelay)
+			continue
+		}
+		fs.endAttempt(entry)
+		return
+	}
+}
+
+// uploadEntry makes one attempt at uploading a queued entry
+func (fs *S3FS) uploadEntry(staging string, entry *journalEntry) (string, error) {
+	ctx, cancel := context.WithTimeout(entry.ctx, fs.dataTimeout)
+	defer cancel()
+
+	of := entry.of
+	if of == nil {
+		// Left by a previous run: the object must still be the version it was based on
+		var err error
+		if of, err = fs.checkJournaled(ctx, staging, entry); err != nil {
+			return "", err
+		}
+		fs.mu.Lock()
+		entry.of = of
+		fs.mu.Unlock()
+	}
+
+	op := auditWrite
+	if entry.Created {
+		op = auditCreate
+	}
+	rec := fs.beginAuditAs(entry.Caller, op, entry.Path)
+	if rec != nil {
+		rec.ETagBefore = entry.BaseETag
+	}
+	of.stageMu.Lock()
+	defer of.stageMu.Unlock()
+	etag, err := fs.uploadStaged(ctx, of, entry.Size, true)
+	fs.finishAudit(rec, etag, err)
+	if storage.IsPreconditionFailed(err) {
+		return "", errConflict
+	}
+	if err != nil {
+		return "", err
+	}
+	// Readers waiting on the staging file go to the bucket from now on
+	of.uploaded = true
+	return etag, nil
+}
+
+// uploadCommitted removes the staging file of an entry that reached the bucket
+func (fs *S3FS) uploadCommitted(staging string, entry *journalEntry, etag string) {
+	fs.mu.Lock()
+	delete(fs.pending, staging)
+	fs.mu.Unlock()
+	os.Remove(journalPath(staging))
+	os.Remove(staging)
+
+	fs.tree.putFile(entry.Path, storage.ObjectInfo{Size: entry.Size, LastModified: time.Now(), ETag: etag})
+	fs.invalidateBlocks(entry.Path)
+	fs.invalidatePath(entry.Path)
+	logger.Info("uploaded file", "path", entry.Path, "size", entry.Size)
+}
+
+// uploadFailed keeps the staging file of an entry that could not be uploaded
+// and reports the failure
+func (fs *S3FS) uploadFailed(staging string, entry *journalEntry, err error) {
+	logger.Error("upload: giving up", "path", entry.Path, "error", err)
+	fs.mu.Lock()
+	entry.Error = err.Error()
+	entry.UpdatedAt = time.Now()
+	of := entry.of
+	data, _ := json.Marshal(entry)
+	fs.mu.Unlock()
+
+	// Record the failure so it is listed again after a restart
+	if of != nil {
+		of.stageMu.Lock()
+		of.uploadErr = err
+		fs.journalLocked(of)
+		of.stageMu.Unlock()
+	} else if data != nil {
+		writeJournalFile(journalPath(staging), data)
+	}
+
+	// Show the bucket's version again
+	if entry.Created {
+		fs.tree.remove(entry.Path)
+	} else {
+		fs.tree.invalidate()
+	}
+	fs.invalidatePath(entry.Path)
+
+	if fs.uploads.onFailed != nil {
+		fs.uploads.onFailed(entry.Path, err)
+	}
+}
+
+// dequeue marks an entry as no longer queued
+func (fs *S3FS) dequeue(entry *journalEntry) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	entry.queued = false
+	entry.prev = nil
+	entry.cancel()
+	if fs.uploads.latest[entry.Path] == entry {
+		delete(fs.uploads.latest, entry.Path)
+	}
+	close(entry.done)
+}
+
+// queuedFile returns the released file waiting to be uploaded to path, if any
+func (fs *S3FS) queuedFile(path string) (*journalEntry, bool) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	entry, ok := fs.uploads.latest[path]
+	return entry, ok && entry.Error == ""
+}
+
+// localInfo lists the files open for writing or waiting to be uploaded with
+// their local attributes
+func (fs *S3FS) localInfo() map[string]storage.ObjectInfo {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	infos := make(map[string]storage.ObjectInfo, len(fs.uploads.latest)+len(fs.nodes))
+	for path, entry := range fs.uploads.latest {
+		if entry.Error == "" {
+			infos[path] = entry.localInfo()
+		}
+	}
+	for path, node := range fs.nodes {
+		infos[path] = storage.ObjectInfo{Key: path, Size: node.Size, LastModified: node.ModTime}
+	}
+	return infos
+}
+
+// readQueued reads a file waiting to be uploaded from its staging file. It
+// reports false once the upload committed and the bucket has the data.
+func (fs *S3FS) readQueued(ctx context.Context, entry *journalEntry, buff []byte, ofst int64) (int, bool, error) {
+	fs.mu.RLock()
+	of := entry.of
+	fs.mu.RUnlock()
+	if of == nil {
+		return 0, false, nil
+	}
+	n, err := fs.readStaged(ctx, of, buff, ofst)
+	if errors.Is(err, errStagingGone) {
+		return 0, false, nil
+	}
+	return n, true, err
+}
+
+// waitUploads blocks until the queued uploads of path, or of anything below
+// it when it is a directory, have finished
+func (fs *S3FS) waitUploads(ctx context.Context, path string) error {
+	for _, entry := range fs.queuedUnder(path) {
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// awaitUploads waits, for at most the data timeout, until the queued uploads
+// of path have finished. It returns EBUSY when they are still running.
+func (fs *S3FS) awaitUploads(path string) int {
+	ctx, cancel := fs.dataContext()
+	defer cancel()
+	err := fs.waitUploads(ctx, path)
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.Warn("open: earlier upload still running", "path", path)
+		return -cgofuse.EBUSY
+	}
+	if err != nil {
+		return errnoFromError(err, -cgofuse.EIO)
+	}
+	return 0
+}
+
+// syncUploads waits for the queued uploads of path, or of anything below it,
+// and returns the first failure among them
+func (fs *S3FS) syncUploads(ctx context.Context, path string) error {
+	entries := fs.queuedUnder(path)
+	if err := fs.waitUploads(ctx, path); err != nil {
+		return err
+	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	for _, entry := range entries {
+		if entry.Error != "" {
+			return errors.New(entry.Error)
+		}
+	}
+	return nil
+}
+
+// failedUpload returns the error of a failed upload of path kept in the journal
+func (fs *S3FS) failedUpload(path string) error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	for _, entry := range fs.pending {
+		if entry.Path == path && entry.Error != "" && !entry.queued {
+			return errors.New(entry.Error)
+		}
+	}
+	return nil
+}
+
+// commitOpen uploads the staged changes of a handle that is still open and
+// makes the new object its base. Writes to the handle wait for the upload.
+func (fs *S3FS) commitOpen(ctx context.Context, of *OpenFile) error {
+	of.stageMu.Lock()
+	defer of.stageMu.Unlock()
+
+	fs.mu.RLock()
+	dirty := of.Dirty
+	path := of.Path
+	size := of.Size
+	op := auditWrite
+	if of.Created {
+		op = auditCreate
+	}
+	fs.mu.RUnlock()
+	if !dirty {
+		return nil
+	}
+
+	rec := fs.beginAudit(op, path)
+	if rec != nil {
+		rec.ETagBefore = fs.auditETag(ctx, rec, path)
+	}
+	etag, err := fs.uploadStaged(ctx, of, size, false)
+	fs.finishAudit(rec, etag, err)
+	if err != nil {
+		of.uploadErr = err
+		fs.journalLocked(of)
+		return err
+	}
+	of.rebase(etag, size)
+	of.uploadErr = nil
+	of.unjournalLocked()
+
+	fs.mu.Lock()
+	of.Dirty = false
+	of.Created = false
+	fs.mu.Unlock()
+
+	fs.tree.putFile(path, storage.ObjectInfo{Size: size, LastModified: time.Now(), ETag: etag})
+	fs.invalidateBlocks(path)
+	fs.invalidatePath(path)
+	logger.Info("uploaded file", "path", path, "size", size)
+	return nil
+}
+
+// discardUploads cancels the queued and failed uploads of path and deletes
+// their staging files
+func (fs *S3FS) discardUploads(path string) {
+	fs.mu.Lock()
+	var discarded []string
+	var entries []*journalEntry
+	for staging, entry := range fs.pending {
+		if entry.Path != path {
+			continue
+		}
+		if entry.queued {
+			entry.cancel()
+		}
+		discarded = append(discarded, staging)
+		entries = append(entries, entry)
+	}
+	fs.mu.Unlock()
+
+	for i, entry := range entries {
+		if entry.done != nil {
+			<-entry.done
+		}
+		fs.mu.Lock()
+		delete(fs.pending, discarded[i])
+		fs.mu.Unlock()
+		os.Remove(journalPath(discarded[i]))
+		os.Remove(discarded[i])
+		logger.Debug("upload: discarded", "path", path)
+	}
+}
+
+func (fs *S3FS) queuedUnder(path string) []*journalEntry {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	var entries []*journalEntry
+	for _, entry := range fs.pending {
+		if entry.queued && isUnder(entry.Path, path) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+// isUnder reports whether p is dir or inside it
+func isUnder(p, dir string) bool {
+	return dir == "" || p == dir || len(p) > len(dir) && p[len(dir)] == '/' && p[:len(dir)] == dir
+}
+
+// localInfo is the listing of a file that has not reached the bucket yet
+func (entry *journalEntry) localInfo() storage.ObjectInfo {
+	return storage.ObjectInfo{Key: entry.Path, Size: entry.Size, LastModified: entry.UpdatedAt}
+}
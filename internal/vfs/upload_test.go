@@ -0,0 +1,92 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUploadReplayed(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int  // UploadRetries, -1 for none
+		refused  int  // PUT requests refused before the upload goes through
+		stale    bool // The object changed since the staged copy was based on it
+		uploaded bool
+		conflict bool
+	}{
+		{"uploaded", 1, 0, false, true, false},
+		{"refused once, then retried", 1, 1, false, true, false},
+		{"refused with no retries left", -1, 1, false, false, false},
+		{"refused more often than retried", 1, 2, false, false, false},
+		{"conflict is not retried", 5, 0, true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeS3(t)
+			base := f.put("a", "old")
+			if tt.stale {
+				f.put("a", "theirs")
+			}
+			bucketBefore, _ := f.get("a")
+			f.refuseNext(http.MethodPut, "a", tt.refused)
+			dir := t.TempDir()
+			staging := stageJournaled(t, dir, journalEntry{Path: "a", BaseETag: base, UpdatedAt: time.Now()}, "new")
+
+			failed := make(chan error, 1)
+			start := time.Now()
+			fs := f.mount(t, Options{
+				StagingDir:     dir,
+				UploadRetries:  tt.retries,
+				OnUploadFailed: func(path string, err error) { failed <- err },
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			err := fs.syncUploads(ctx, "a")
+
+			content, _ := f.get("a")
+			_, stagingErr := os.Stat(staging)
+			_, journalErr := os.Stat(journalPath(staging))
+			if tt.uploaded {
+				if err != nil {
+					t.Fatalf("upload failed: %v", err)
+				}
+				if content != "new" {
+					t.Errorf("object = %q, want the staged copy", content)
+				}
+				if !os.IsNotExist(stagingErr) || !os.IsNotExist(journalErr) {
+					t.Error("staging file or journal kept after the upload")
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("upload succeeded, want it to fail")
+			}
+			select {
+			case reported := <-failed:
+				if errors.Is(reported, errConflict) != tt.conflict {
+					t.Errorf("reported %v, conflict %v", reported, tt.conflict)
+				}
+			default:
+				t.Error("failure not reported")
+			}
+			if tt.conflict && time.Since(start) >= uploadRetryDelay {
+				t.Error("conflict retried")
+			}
+			if content != bucketBefore {
+				t.Errorf("object = %q, want %q left in place", content, bucketBefore)
+			}
+			// Kept, and listed as failed after a restart
+			if stagingErr != nil {
+				t.Errorf("staging file removed: %v", stagingErr)
+			}
+			if entry := loadJournal(dir)[staging]; entry == nil || entry.Error == "" {
+				t.Errorf("journal = %+v, want the failure recorded", entry)
+			}
+		})
+	}
+}
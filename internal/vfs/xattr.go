@@ -0,0 +1,362 @@
+package vfs
+
+import (
+	"context"
+	"maps"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"maxiofs-agent/internal/cgofuse"
+	"maxiofs-agent/internal/storage"
+)
+
+// Extended attributes of the user namespace map onto the object: user.s3tag.*
+// onto its tags, user.s3.* onto read-only properties, and every other user.*
+// name onto its x-amz-meta-* user metadata. S3 stores metadata keys in lower
+// case, so names are too. Other namespaces are not supported.
+const (
+	xattrUser   = "user."
+	xattrTag    = "user.s3tag."
+	xattrSystem = "user.s3."
+
+	xattrETag         = xattrSystem + "etag"
+	xattrStorageClass = xattrSystem + "storage_class"
+	xattrVersionID    = xattrSystem + "version_id"
+
+	// The metadata marking symbolic links, which is not user-settable
+	xattrMode = xattrUser + "mode"
+)
+
+// S3 limits on object tags
+const (
+	maxTags        = 10
+	maxTagKeyLen   = 128
+	maxTagValueLen = 256
+)
+
+// xattrObject returns the object holding the attributes of path, or nil for
+// a directory. Uploads of path are waited for so their version is described.
+func (fs *S3FS) xattrObject(ctx context.Context, path string) (*storage.ObjectInfo, int) {
+	if path == "" {
+		return nil, 0
+	}
+	if err := fs.refreshTree(ctx); err != nil {
+		logger.Warn("xattr: error listing objects", "path", path, "error", err)
+		return nil, errnoFromError(err, -cgofuse.EIO)
+	}
+	info, found := fs.tree.lookup(path)
+	if !found {
+		return nil, -cgofuse.ENOENT
+	}
+	if info.IsDir {
+		return nil, 0
+	}
+
+	if err := fs.waitUploads(ctx, path); err != nil {
+		return nil, errnoFromError(err, -cgofuse.EIO)
+	}
+	obj, err := fs.s3Client.HeadObject(ctx, fs.bucketName, fs.objectKey(path))
+	if storage.IsNotFound(err) {
+		// Created locally and never uploaded
+		return nil, -cgofuse.ENODATA
+	}
+	if err != nil {
+		logger.Error("xattr: error getting object metadata", "path", path, "error", err)
+		return nil, errnoFromError(err, -cgofuse.EIO)
+	}
+	return obj, 0
+}
+
+// Getxattr returns the value of an extended attribute
+func (fs *S3FS) Getxattr(path string, name string) (errc int, value []byte) {
+	defer trackOp("Getxattr", time.Now(), &errc)
+	path = fs.resolvePath(path)
+	logger.Debug("getxattr", "path", path, "name", name)
+
+	// Tools probe security.* and system.* on every file, answer without a request
+	if !strings.HasPrefix(name, xattrUser) {
+		return -cgofuse.ENODATA, nil
+	}
+
+	ctx, cancel := fs.metadataContext()
+	defer cancel()
+	obj, errc := fs.xattrObject(ctx, path)
+	if errc != 0 {
+		return errc, nil
+	}
+	if obj == nil {
+		return -cgofuse.ENODATA, nil
+	}
+
+	var v string
+	switch {
+	case name == xattrETag:
+		v = strings.Trim(obj.ETag, `"`)
+	case name == xattrStorageClass:
+		v = obj.StorageClass
+		if v == "" {
+			v = "STANDARD"
+		}
+	case name == xattrVersionID:
+		v = obj.VersionID
+	case strings.HasPrefix(name, xattrTag):
+		tags, err := fs.s3Client.GetObjectTags(ctx, fs.bucketName, fs.objectKey(path))
+		if err != nil {
+			logger.Error("getxattr: error getting object tags", "path", path, "error", err)
+			return errnoFromError(err, -cgofuse.EIO), nil
+		}
+		v = tags[strings.TrimPrefix(name, xattrTag)]
+	case strings.HasPrefix(name, xattrSystem):
+	default:
+		v = obj.Metadata[strings.ToLower(strings.TrimPrefix(name, xattrUser))]
+	}
+	if v == "" {
+		return -cgofuse.ENODATA, nil
+	}
+	return 0, []byte(v)
+}
+
+// Listxattr lists the extended attributes of a file
+func (fs *S3FS) Listxattr(path string, fill func(name string) bool) (errc int) {
+	defer trackOp("Listxattr", time.Now(), &errc)
+	path = fs.resolvePath(path)
+	logger.Debug("listxattr", "path", path)
+
+	ctx, cancel := fs.metadataContext()
+	defer cancel()
+	obj, errc := fs.xattrObject(ctx, path)
+	if errc == -cgofuse.ENODATA || obj == nil && errc == 0 {
+		return 0
+	}
+	if errc != 0 {
+		return errc
+	}
+
+	names := []string{xattrETag, xattrStorageClass}
+	if obj.VersionID != "" {
+		names = append(names, xattrVersionID)
+	}
+	var user []string
+	for k := range obj.Metadata {
+		name := xattrUser + k
+		// Keys that would read back as tags or properties are left out
+		if !strings.HasPrefix(name, xattrSystem) && !strings.HasPrefix(name, xattrTag) {
+			user = append(user, name)
+		}
+	}
+	sort.Strings(user)
+	names = append(names, user...)
+
+	// Servers without tagging support still list the rest
+	tags, err := fs.s3Client.GetObjectTags(ctx, fs.bucketName, fs.objectKey(path))
+	if err != nil {
+		logger.Debug("listxattr: cannot get object tags", "path", path, "error", err)
+	}
+	var tagNames []string
+	for k := range tags {
+		tagNames = append(tagNames, xattrTag+k)
+	}
+	sort.Strings(tagNames)
+	names = append(names, tagNames...)
+
+	for _, name := range names {
+		if !fill(name) {
+			return -cgofuse.ERANGE
+		}
+	}
+	return 0
+}
+
+// Setxattr sets an extended attribute of the user namespace
+func (fs *S3FS) Setxattr(path string, name string, value []byte, flags int) (errc int) {
+	defer trackOp("Setxattr", time.Now(), &errc)
+	path = fs.resolvePath(path)
+	logger.Debug("setxattr", "path", path, "name", name, "size", len(value), "flags", flags)
+
+	switch {
+	case !strings.HasPrefix(name, xattrUser):
+		return -cgofuse.ENOTSUP
+	case strings.HasPrefix(name, xattrTag):
+		key := strings.TrimPrefix(name, xattrTag)
+		if !validTag(key, string(value)) {
+			return -cgofuse.EINVAL
+		}
+		return fs.updateXattrs(path, auditSetxattr, func(_, tags map[string]string) int {
+			if errc := setXattr(tags, key, string(value), flags); errc != 0 {
+				return errc
+			}
+			if len(tags) > maxTags {
+				return -cgofuse.EINVAL
+			}
+			return 0
+		})
+	case strings.HasPrefix(name, xattrSystem), strings.EqualFold(name, xattrMode):
+		return -cgofuse.EPERM
+	default:
+		key := strings.ToLower(strings.TrimPrefix(name, xattrUser))
+		if !validMetadataKey(key) || !validMetadataValue(value) {
+			return -cgofuse.EINVAL
+		}
+		return fs.updateXattrs(path, auditSetxattr, func(metadata, _ map[string]string) int {
+			return setXattr(metadata, key, string(value), flags)
+		})
+	}
+}
+
+// Removexattr removes an extended attribute of the user namespace
+func (fs *S3FS) Removexattr(path string, name string) (errc int) {
+	defer trackOp("Removexattr", time.Now(), &errc)
+	path = fs.resolvePath(path)
+	logger.Debug("removexattr", "path", path, "name", name)
+
+	switch {
+	case !strings.HasPrefix(name, xattrUser):
+		return -cgofuse.ENOTSUP
+	case strings.HasPrefix(name, xattrTag):
+		key := strings.TrimPrefix(name, xattrTag)
+		return fs.updateXattrs(path, auditRemovexattr, func(_, tags map[string]string) int {
+			return removeXattr(tags, key)
+		})
+	case strings.HasPrefix(name, xattrSystem), strings.EqualFold(name, xattrMode):
+		return -cgofuse.EPERM
+	default:
+		key := strings.ToLower(strings.TrimPrefix(name, xattrUser))
+		return fs.updateXattrs(path, auditRemovexattr, func(metadata, _ map[string]string) int {
+			return removeXattr(metadata, key)
+		})
+	}
+}
+
+func setXattr(attrs map[string]string, key, value string, flags int) int {
+	_, exists := attrs[key]
+	switch {
+	case flags&cgofuse.XATTR_CREATE != 0 && exists:
+		return -cgofuse.EEXIST
+	case flags&cgofuse.XATTR_REPLACE != 0 && !exists:
+		return -cgofuse.ENODATA
+	}
+	attrs[key] = value
+	return 0
+}
+
+func removeXattr(attrs map[string]string, key string) int {
+	if _, exists := attrs[key]; !exists {
+		return -cgofuse.ENODATA
+	}
+	delete(attrs, key)
+	return 0
+}
+
+// updateXattrs applies change to the metadata and tags of the object at path
+// and stores them with a metadata-only copy of the object onto itself
+func (fs *S3FS) updateXattrs(path, op string, change func(metadata, tags map[string]string) int) int {
+	// The upload on close, or the one queued after it, replaces the object
+	// and with it these attributes
+	fs.mu.RLock()
+	_, open := fs.nodes[path]
+	fs.mu.RUnlock()
+	if _, queued := fs.queuedFile(path); open || queued {
+		return -cgofuse.EBUSY
+	}
+
+	ctx, cancel := fs.metadataContext()
+	defer cancel()
+	obj, errc := fs.xattrObject(ctx, path)
+	if errc != 0 {
+		return errc
+	}
+	if obj == nil {
+		return -cgofuse.ENOTSUP
+	}
+	if obj.Size > storage.MaxCopySize {
+		return -cgofuse.EFBIG
+	}
+	tags, err := fs.s3Client.GetObjectTags(ctx, fs.bucketName, fs.objectKey(path))
+	if err != nil {
+		logger.Error("xattr: error getting object tags", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.EIO)
+	}
+	metadata := maps.Clone(obj.Metadata)
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	if errc := change(metadata, tags); errc != 0 {
+		return errc
+	}
+
+	rec := fs.beginAudit(op, path)
+	if rec != nil {
+		rec.ETagBefore = obj.ETag
+	}
+	etag, err := fs.s3Client.ReplaceObjectMetadata(ctx, fs.bucketName, fs.objectKey(path), obj, metadata, tags)
+	fs.finishAudit(rec, etag, err)
+	if storage.IsPreconditionFailed(err) {
+		// Changed since the HEAD request, let the caller retry on the new version
+		logger.Debug("xattr: object changed concurrently", "path", path)
+		fs.tree.invalidate()
+		fs.invalidatePath(path)
+		return -cgofuse.EAGAIN
+	}
+	if err != nil {
+		logger.Error("xattr: error updating object metadata", "path", path, "error", err)
+		return errnoFromError(err, -cgofuse.EIO)
+	}
+
+	fs.tree.putFile(path, storage.ObjectInfo{
+		Size:         obj.Size,
+		LastModified: time.Now(),
+		ETag:         etag,
+		Symlink:      obj.Symlink,
+	})
+	if etag != obj.ETag {
+		fs.invalidateBlocks(path)
+	}
+	fs.invalidatePath(path)
+	return 0
+}
+
+// validTag reports whether S3 accepts key and value as an object tag: letters,
+// digits, spaces and "+-=._:/@", up to maxTagKeyLen and maxTagValueLen characters
+func validTag(key, value string) bool {
+	if key == "" || utf8.RuneCountInString(key) > maxTagKeyLen || utf8.RuneCountInString(value) > maxTagValueLen {
+		return false
+	}
+	valid := func(c rune) bool {
+		return unicode.IsLetter(c) || unicode.IsDigit(c) || unicode.IsSpace(c) || strings.ContainsRune("+-=._:/@", c)
+	}
+	for _, s := range []string{key, value} {
+		if !utf8.ValidString(s) || strings.IndexFunc(s, func(c rune) bool { return !valid(c) }) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validMetadataKey reports whether key can be sent as an HTTP header name
+func validMetadataKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validMetadataValue reports whether value can be sent as an HTTP header value
+func validMetadataValue(value []byte) bool {
+	for _, c := range value {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}